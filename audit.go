@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/classifier"
+)
+
+// An auditEntry records a single classification in the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	MessageID string    `json:"message_id,omitempty"`
+	Label     string    `json:"label"`
+	Score     float64   `json:"score"`
+	HamScore  float64   `json:"ham_score"`
+	Eta       float64   `json:"eta"`
+
+	// Min and Max are nil if the message had no windows to classify
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+
+	// Override holds the rule that forced the verdict, if any
+	Override string `json:"override,omitempty"`
+}
+
+// newAuditEntry returns the audit log entry for the classification of msg.
+func newAuditEntry(msg []byte, label classifier.Result, override string) auditEntry {
+	e := auditEntry{
+		Time:     time.Now(),
+		Label:    label.Label,
+		Score:    label.Score,
+		HamScore: label.HamScore,
+		Eta:      label.Eta,
+		Override: override,
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err == nil {
+		e.MessageID = strings.TrimSpace(m.Header.Get("Message-Id"))
+	}
+
+	if override == "" && !math.IsInf(label.Min, 0) && !math.IsInf(label.Max, 0) {
+		e.Min = &label.Min
+		e.Max = &label.Max
+	}
+
+	return e
+}
+
+// An AuditLog is an append-only log of classifications, stored as one JSON object per line. When
+// the log grows larger than its maximum size, it is renamed by appending ".1" to its name,
+// replacing an older log with that name, and a new log is started.
+type AuditLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if necessary. The log is
+// rotated when it would grow beyond maxSize bytes.
+func OpenAuditLog(path string, maxSize int64) (*AuditLog, error) {
+	a := &AuditLog{
+		path:    path,
+		maxSize: maxSize,
+	}
+
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening audit log")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "getting size of audit log")
+	}
+
+	a.f = f
+	a.size = info.Size()
+
+	return nil
+}
+
+// rotate replaces the old log with the current one and starts a new log.
+func (a *AuditLog) rotate() error {
+	err := a.f.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing audit log")
+	}
+
+	err = os.Rename(a.path, a.path+".1")
+	if err != nil {
+		return errors.Wrap(err, "rotating audit log")
+	}
+
+	return a.open()
+}
+
+// record appends e to the log. A nil *AuditLog discards all entries.
+func (a *AuditLog) record(e auditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	// Message IDs are full of angle brackets, keep them readable
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err := enc.Encode(e)
+	if err != nil {
+		return errors.Wrap(err, "encoding audit log entry")
+	}
+
+	line := buf.Bytes()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err := a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "writing audit log entry")
+	}
+
+	return nil
+}
+
+// Close closes the log.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.f.Close()
+}
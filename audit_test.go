@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpamFilter_AuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailfilter-audit")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	s := newTestFilter()
+
+	s.audit, err = OpenAuditLog(path, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer s.audit.Close()
+
+	const msg = "From: Bob <bob@example.com>\n" +
+		"Message-Id: <1234@example.com>\n" +
+		"Subject: hello\n" +
+		"\n" +
+		"just checking in\n"
+
+	for i := 0; i < 2; i++ {
+		err = s.classify(strings.NewReader(msg), ioutil.Discard, ClassifyEmail, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(raw), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", raw)
+	}
+
+	var entry map[string]interface{}
+
+	err = json.Unmarshal(lines[1], &entry)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, field := range []string{"time", "message_id", "label", "score", "eta", "min", "max"} {
+		if _, ok := entry[field]; !ok {
+			t.Errorf("expected field %q in %s", field, lines[1])
+		}
+	}
+
+	if entry["message_id"] != "<1234@example.com>" {
+		t.Errorf("unexpected message id %v", entry["message_id"])
+	}
+
+	// The classifier hasn't been trained, so it can't decide
+	if entry["label"] != "unsure" {
+		t.Errorf("unexpected label %v", entry["label"])
+	}
+}
+
+func TestAuditLog_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailfilter-audit")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := OpenAuditLog(path, 150)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.Close()
+
+	for _, id := range []string{"<1@example.com>", "<2@example.com>", "<3@example.com>"} {
+		err := a.record(auditEntry{MessageID: id, Label: "ham"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	old, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("expected rotated log: %s", err)
+	}
+
+	if len(current) > 150 || len(old) > 150 {
+		t.Errorf("logs exceed maximum size: %d and %d bytes", len(current), len(old))
+	}
+
+	if !bytes.Contains(current, []byte("<3@example.com>")) || !bytes.Contains(old, []byte("<2@example.com>")) {
+		t.Errorf("unexpected log contents: %q and %q", old, current)
+	}
+}
@@ -0,0 +1,73 @@
+package bloom
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrInvalidFilter is returned by Restore if its input is not a filter.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Backup writes the filter of d to w, in the same format that d is persisted in. The filter is
+// written to a temporary file next to d's file first, like when persisting, and then copied to
+// w. That way, writing to a slow w blocks neither changes to d nor persisting it.
+func (d *DB) Backup(w io.Writer) error {
+	dir := d.root
+	if d.store != nil {
+		dir = filepath.Dir(d.store.path)
+	}
+
+	f, err := ioutil.TempFile(dir, ".backup-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = d.writeTo(f)
+	if err != nil {
+		return fmt.Errorf("marshal filter: %w", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
+
+// Restore replaces the filter of d with the one read from r, which has to hold exactly one
+// filter in the format written by Backup, and persists d right away. The filter has to use the
+// same hash scheme as d. If r doesn't hold such a filter, Restore returns an error that wraps
+// ErrInvalidFilter and leaves d unchanged.
+func (d *DB) Restore(r io.Reader) error {
+	other := &F{Scheme: d.f.Scheme}
+
+	br := bufio.NewReader(r)
+
+	err := readHeader(br, other)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidFilter, err)
+	}
+
+	if other.Scheme != d.f.Scheme {
+		return fmt.Errorf("%w: hash scheme %d, expected %d", ErrInvalidFilter, other.Scheme, d.f.Scheme)
+	}
+
+	err = readField(br, other)
+	if err != nil {
+		return fmt.Errorf("%w: %s, expected %d rows of %d fields", ErrInvalidFilter, err, numFuncs, filterSize)
+	}
+
+	return d.replace(func(f *F) {
+		f.Field = other.Field
+	})
+}
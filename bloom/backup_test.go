@@ -0,0 +1,197 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_BackupRestore(t *testing.T) {
+	db, err := NewDB(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	words := benchmarkWords(100)
+	for i, w := range words {
+		db.Add(w, uint64(i+1))
+	}
+
+	var backup bytes.Buffer
+
+	err = db.Backup(&backup)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n, want := backup.Len(), binary.Size(filterHeader{})+numFuncs*filterSize*4; n != want {
+		t.Errorf("expected backup of %d bytes, got %d", want, n)
+	}
+
+	root := t.TempDir()
+
+	fresh, err := NewDB(root, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = fresh.Restore(bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fresh.Dirty() {
+		t.Errorf("expected restored DB to be persisted")
+	}
+
+	reloaded, err := NewDB(root, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, w := range words {
+		want := db.Score(w)
+
+		if s := fresh.Score(w); s != want {
+			t.Errorf("expected restored score %v for %q, got %v", want, w, s)
+		}
+
+		if s := reloaded.Score(w); s != want {
+			t.Errorf("expected reloaded score %v for %q, got %v", want, w, s)
+		}
+	}
+}
+
+func TestDB_RestoreInvalid(t *testing.T) {
+	root := t.TempDir()
+
+	db, err := NewDB(root, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("fnord"), 2)
+
+	var foreign bytes.Buffer
+
+	err = writeHeader(&foreign, HashDouble)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = writeField(&foreign, new(F))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":        nil,
+		"truncated":    make([]byte, 1000),
+		"too long":     make([]byte, numFuncs*filterSize*4+1),
+		"other scheme": foreign.Bytes(),
+	} {
+		err := db.Restore(bytes.NewReader(data))
+		if !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("expected %s input to be an invalid filter, got %v", name, err)
+		}
+	}
+
+	if s := db.Score([]byte("fnord")); s != 2 {
+		t.Errorf("expected failed restores to leave the filter unchanged, got score %v", s)
+	}
+
+	if _, err := CheckFile(filepath.Join(root, "test"), HashFNV); err == nil {
+		t.Errorf("expected failed restores not to persist the filter")
+	}
+}
+
+func TestDB_BackupDoesntBlockPersist(t *testing.T) {
+	root := t.TempDir()
+
+	db, err := NewDB(root, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("before"), 1)
+
+	w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+
+	go func() {
+		done <- db.Backup(w)
+	}()
+
+	<-w.started
+
+	// The client hasn't read anything yet, but the filter can still be persisted
+	persisted := make(chan error)
+
+	go func() {
+		db.Add([]byte("during"), 1)
+		persisted <- db.persist()
+	}()
+
+	select {
+	case err := <-persisted:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected persisting not to wait for the backup to be read")
+	}
+
+	close(w.release)
+
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fresh, err := NewDB(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = fresh.Restore(&w.buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fresh.Score([]byte("before")) != 1 || fresh.Score([]byte("during")) != 0 {
+		t.Errorf("expected the backup to hold only the word added before it started")
+	}
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("expected only the filter in %s, got %d files", root, len(files))
+	}
+}
+
+func BenchmarkDB_Backup(b *testing.B) {
+	db, err := NewDB(b.TempDir(), "test")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("word"), 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := db.Backup(ioutil.Discard)
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
@@ -1,16 +1,21 @@
 package bloom
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"mailfilter/logger"
 )
 
 type DB struct {
@@ -21,49 +26,248 @@ type DB struct {
 
 	dirty bool
 	f     F
+
+	// changes counts the fields that changed since the last time d was persisted, and
+	// lastPersist is the time of that. Unless minChanges fields changed or maxDelay has passed,
+	// Run doesn't persist d.
+	changes     int
+	lastPersist time.Time
+	minChanges  int
+	maxDelay    time.Duration
+
+	// store is the store that d is persisted with, if it is part of one
+	store *Store
+
+	// cache holds recently looked up scores, if it is not nil. It is emptied whenever f changes.
+	cache *scoreCache
+
+	// spare is the copy of f that is written to disk, so that mu is only held while copying f
+	// and not while writing it. It is kept between writes to avoid allocating it each time.
+	// writeMu is held while spare is in use.
+	writeMu sync.Mutex
+	spare   *F
+
+	// snapshot holds the *F that Snapshot returns if snapshots is set. Filters stored in it are
+	// never changed, writing d swaps in its spare instead.
+	snapshots bool
+	snapshot  atomic.Value
+}
+
+// An Option configures a DB.
+type Option func(*DB)
+
+// WithSnapshots makes a DB keep the copy of its filter that it last wrote to disk for Snapshot,
+// instead of reusing it for the next write. This costs a new copy each time the filter is
+// written, but makes Snapshot free.
+func WithSnapshots() Option {
+	return func(d *DB) {
+		d.snapshots = true
+	}
 }
 
-func NewDB(root, name string) (*DB, error) {
+// WithHashScheme makes a DB use the given hash scheme for its filter. A filter must always be
+// loaded with the scheme it was created with.
+func WithHashScheme(s HashScheme) Option {
+	return func(d *DB) {
+		d.f.Scheme = s
+	}
+}
+
+// WithLazyPersist makes Run persist a DB only once at least minChanges fields of its filter have
+// changed, or maxDelay has passed since it was last persisted. This saves rewriting the whole
+// filter every minute on a lightly used server, at the expense of losing more changes if the
+// process crashes. Changes are always persisted when Run stops.
+func WithLazyPersist(minChanges int, maxDelay time.Duration) Option {
+	return func(d *DB) {
+		d.minChanges = minChanges
+		d.maxDelay = maxDelay
+	}
+}
+
+// NewDB returns a DB whose filter is stored in the file name in the directory root. The filter
+// is loaded from the file if it exists, and the directory is created if it doesn't.
+func NewDB(root, name string, opts ...Option) (*DB, error) {
+	return NewDBAtPath(filepath.Join(root, name), opts...)
+}
+
+// NewDBAtPath works like NewDB, but takes the full path of the file the filter is stored in, so
+// that the filters of a classifier can be kept in different directories, for example on
+// different disks. The filter is written to a temporary file in the same directory first, which
+// is then renamed to path.
+func NewDBAtPath(path string, opts ...Option) (*DB, error) {
+	root, name := filepath.Split(path)
+	if root == "" {
+		root = "."
+	}
+
 	db := &DB{
-		root: root,
-		name: name,
+		root:        root,
+		name:        name,
+		lastPersist: time.Now(),
 	}
 
-	fp := filepath.Join(root, name)
+	for _, o := range opts {
+		o(db)
+	}
 
-	var perr *os.PathError
+	// Create the directory right away, otherwise persisting the filter fails later on and the
+	// changes are lost.
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("creating database directory: %w", err)
+	}
 
-	fh, err := os.Open(fp)
+	scheme := db.f.Scheme
+
+	err = readFilter(path, &db.f)
+
+	var perr *os.PathError
 	if errors.As(err, &perr) {
 		return db, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+
+	if db.f.Scheme != scheme {
+		return nil, fmt.Errorf("%s uses hash scheme %d, not %d", path, db.f.Scheme, scheme)
+	}
+
+	return db, nil
+}
+
+// filterMagic starts the files that a DB persists its filter in. It is followed by the format
+// version and the hash scheme of the filter, and then by its fields:
+//
+//	"MFBF" | version (uint32) | hash scheme (uint32)
+//	fields
+//
+// All numbers are big endian. Files written before the header was introduced only hold the
+// fields, and are assumed to use the hash scheme they are loaded with.
+var filterMagic = []byte("MFBF")
+
+const filterVersion = 1
+
+type filterHeader struct {
+	Magic   [4]byte
+	Version uint32
+	Scheme  uint32
+}
+
+// writeHeader writes the header for a filter with the given hash scheme to w.
+func writeHeader(w io.Writer, scheme HashScheme) error {
+	h := filterHeader{Version: filterVersion, Scheme: uint32(scheme)}
+	copy(h.Magic[:], filterMagic)
+
+	return binary.Write(w, binary.BigEndian, &h)
+}
+
+// readHeader reads the header of a filter from r and sets the hash scheme of f to the one it
+// names. If r doesn't start with a header, it holds only the fields of a filter, and f is left
+// unchanged.
+func readHeader(r *bufio.Reader, f *F) error {
+	magic, err := r.Peek(len(filterMagic))
+	if err != nil || !bytes.Equal(magic, filterMagic) {
+		// Let reading the fields report short files
+		return nil
+	}
+
+	var h filterHeader
+
+	err = binary.Read(r, binary.BigEndian, &h)
+	if err != nil {
+		return err
+	}
+
+	if h.Version != filterVersion {
+		return fmt.Errorf("unsupported filter version %d", h.Version)
+	}
+
+	if h.Scheme > uint32(HashDouble) {
+		return fmt.Errorf("unknown hash scheme %d", h.Scheme)
+	}
+
+	f.Scheme = HashScheme(h.Scheme)
+
+	return nil
+}
+
+// readFilter reads the filter stored in the file at path into f. If the file names the hash
+// scheme of the filter, the scheme of f is set to it.
+func readFilter(path string, f *F) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
 	defer fh.Close()
 
-	err = binary.Read(fh, binary.BigEndian, &db.f)
+	r := bufio.NewReader(fh)
+
+	err = readHeader(r, f)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return db, nil
+	return binary.Read(r, binary.BigEndian, &f.Field)
 }
 
 func (d *DB) persist() error {
+	changes := d.resetChanges()
+
+	err := d.write()
+	d.persisted(err, changes)
+
+	return err
+}
+
+// resetChanges marks d as clean before its filter is written, so that changes made while it is
+// written mark it as dirty again. It returns the number of changes that are being persisted.
+func (d *DB) resetChanges() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changes := d.changes
+	d.dirty, d.changes = false, 0
+
+	return changes
+}
+
+// persisted records the outcome of writing the filter of d. If writing failed, the changes that
+// were reset by resetChanges still need to be persisted.
+func (d *DB) persisted(err error, changes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err != nil {
+		d.dirty = true
+		d.changes += changes
+
+		return
+	}
+
+	d.lastPersist = time.Now()
+}
+
+// due reports whether enough changes have accumulated in d, or enough time has passed, for Run
+// to persist it.
+func (d *DB) due(now time.Time) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.dirty && (d.changes >= d.minChanges || now.Sub(d.lastPersist) >= d.maxDelay)
+}
+
+func (d *DB) write() error {
 	f, err := ioutil.TempFile(d.root, "*")
 	if err != nil {
 		return fmt.Errorf("creating temp file: %w", err)
 	}
 	defer f.Close()
 
-	d.mu.RLock()
-	err = binary.Write(f, binary.BigEndian, &d.f)
+	err = d.writeTo(f)
 	if err != nil {
-		d.mu.RUnlock()
 		return fmt.Errorf("marshal filter: %w", err)
 	}
-	d.mu.RUnlock()
 
 	err = os.Rename(f.Name(), filepath.Join(d.root, d.name))
 	if err != nil {
@@ -73,6 +277,102 @@ func (d *DB) persist() error {
 	return nil
 }
 
+// writeTo writes the filter of d to w. d is only locked while its filter is copied to d.spare, so
+// that changes to d aren't blocked while the copy is written.
+func (d *DB) writeTo(w io.Writer) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	d.mu.RLock()
+	d.copyToSpare()
+	d.mu.RUnlock()
+
+	err := writeHeader(w, d.spare.Scheme)
+	if err != nil {
+		return err
+	}
+
+	err = writeField(w, d.spare)
+	if err != nil {
+		return err
+	}
+
+	d.publishSpare()
+
+	return nil
+}
+
+// copyToSpare copies the fields of d.f to d.spare, allocating it if needed. Callers must hold
+// d.writeMu, and d.mu for reading.
+func (d *DB) copyToSpare() {
+	if d.spare == nil {
+		d.spare = new(F)
+	}
+
+	d.spare.Field = d.f.Field
+	d.spare.Scheme = d.f.Scheme
+}
+
+// publishSpare makes d.spare the snapshot of d if d keeps snapshots, so that the next write
+// allocates a new spare. Callers must hold d.writeMu.
+func (d *DB) publishSpare() {
+	if !d.snapshots {
+		return
+	}
+
+	d.snapshot.Store(d.spare)
+	d.spare = nil
+}
+
+// Snapshot returns a copy of the filter in d that never changes, so that it can be used for any
+// number of lookups without contending for d's lock. With WithSnapshots, this is the copy that
+// was last written to disk, which is swapped for a new one whenever d is written again, and words
+// added since then are missing from it. Otherwise, and before d is written for the first time,
+// the filter is copied, which is expensive since filters are large.
+func (d *DB) Snapshot() *F {
+	if f, ok := d.snapshot.Load().(*F); ok {
+		return f
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	// Another call may have made the snapshot in the meantime
+	if f, ok := d.snapshot.Load().(*F); ok {
+		return f
+	}
+
+	d.mu.RLock()
+	f := new(F)
+	*f = d.f
+	d.mu.RUnlock()
+
+	if d.snapshots {
+		d.snapshot.Store(f)
+	}
+
+	return f
+}
+
+// writeField writes the fields of f to w in big endian byte order, like binary.Write, but one row
+// at a time, so that it doesn't need a buffer for the whole filter.
+func writeField(w io.Writer, f *F) error {
+	buf := make([]byte, 4*filterSize)
+
+	for i := range f.Field {
+		for j, v := range f.Field[i] {
+			binary.BigEndian.PutUint32(buf[4*j:], v)
+		}
+
+		_, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (d *DB) Run(ctx context.Context) {
 	tick := time.NewTicker(1 * time.Minute)
 	done := false
@@ -87,28 +387,57 @@ func (d *DB) Run(ctx context.Context) {
 		}
 
 		// Persist DB
-		if !d.dirty {
+		if !d.Dirty() || (!done && !d.due(time.Now())) {
 			continue
 		}
 
-		log.Println("persisting updates")
+		logger.Debugf("persisting updates to %s", d.name)
 
 		err := d.persist()
 		if err != nil {
-			log.Println("failed to persist:", err)
-			continue
+			logger.Errorf("failed to persist %s: %s", d.name, err)
 		}
-
-		d.dirty = false
 	}
 }
 
+// Dirty reports whether d has changes that haven't been persisted yet.
+func (d *DB) Dirty() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.dirty
+}
+
 func (d *DB) Add(w []byte, delta uint64) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	d.f.Add(w, uint32(delta))
+	d.changed()
+	d.dirty = true
+	d.changes += numFuncs
+}
+
+// Remove undoes adding w to d delta times.
+func (d *DB) Remove(w []byte, delta uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.f.Remove(w, uint32(delta))
+	d.changed()
+	d.dirty = true
+	d.changes += numFuncs
+}
+
+// Scale multiplies the count of w in d by factor, see F.Scale.
+func (d *DB) Scale(w []byte, factor float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.f.Scale(w, factor)
+	d.changed()
 	d.dirty = true
+	d.changes += numFuncs
 }
 
 // Score returns the approximate number of times w has been added to d.
@@ -116,5 +445,130 @@ func (d *DB) Score(w []byte) uint64 {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	return uint64(d.f.Score(w))
+	return uint64(d.score(w))
+}
+
+// score looks up w in the cache of d, or in its filter if the cache doesn't have it. Callers
+// must hold d.mu for reading, so that the filter doesn't change before the score is cached.
+func (d *DB) score(w []byte) uint32 {
+	if d.cache == nil {
+		return d.f.Score(w)
+	}
+
+	if s, ok := d.cache.get(w); ok {
+		return s
+	}
+
+	s := d.f.Score(w)
+	d.cache.put(w, s)
+
+	return s
+}
+
+// changed empties the cache of d after its filter changed. Callers must hold d.mu for writing.
+func (d *DB) changed() {
+	if d.cache != nil {
+		d.cache.clear()
+	}
+}
+
+// ScoreMany returns the approximate number of times each of words has been added to d. All
+// words are looked up while holding the lock only once.
+func (d *DB) ScoreMany(words [][]byte) []uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	scores := make([]uint64, len(words))
+	for i, w := range words {
+		scores[i] = uint64(d.score(w))
+	}
+
+	return scores
+}
+
+// Stats returns statistics about the filter in d.
+func (d *DB) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.f.Stats()
+}
+
+// MergeFrom adds the filter stored in the file at path to the filter in d, as if all words that
+// were added to it had been added to d. The file needs to be a filter persisted by a DB that
+// uses the same hash scheme as d. Filters whose file names a different scheme are rejected, and
+// files without a header are assumed to use the scheme of d.
+func (d *DB) MergeFrom(path string) error {
+	other := &F{Scheme: d.f.Scheme}
+
+	err := readFilter(path, other)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err = d.f.Merge(other)
+	if err != nil {
+		return err
+	}
+
+	d.changed()
+
+	d.dirty = true
+	d.changes += numFuncs * filterSize
+
+	return nil
+}
+
+// Reset clears the filter of d and persists it right away, so that the old counts are gone from
+// disk as well. If d is part of a Store, the whole store is persisted.
+func (d *DB) Reset() error {
+	return d.replace(func(f *F) {
+		f.Reset()
+	})
+}
+
+// replace changes the filter of d with fn while holding the lock, and persists d right away.
+func (d *DB) replace(fn func(f *F)) error {
+	d.mu.Lock()
+	fn(&d.f)
+	d.changed()
+	d.dirty = true
+	d.changes += numFuncs * filterSize
+	d.mu.Unlock()
+
+	if d.store != nil {
+		return d.store.persist()
+	}
+
+	return d.persist()
+}
+
+// SubtractFrom undoes merging the filter stored in the file at path into the filter in d with
+// MergeFrom. This is much faster than removing all words that were added to that filter. Like
+// MergeFrom, it rejects filters whose file names a different hash scheme than d uses.
+func (d *DB) SubtractFrom(path string) error {
+	other := &F{Scheme: d.f.Scheme}
+
+	err := readFilter(path, other)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err = d.f.Subtract(other)
+	if err != nil {
+		return err
+	}
+
+	d.changed()
+
+	d.dirty = true
+	d.changes += numFuncs * filterSize
+
+	return nil
 }
@@ -10,24 +10,112 @@ const (
 	numFuncs   = 16
 )
 
+// A HashScheme selects how the positions of a word in the rows of a filter are derived.
+type HashScheme uint8
+
+const (
+	// HashFNV derives the position in each row from an FNV32 hash seeded with the row index.
+	// This is the original scheme, and the default.
+	HashFNV HashScheme = iota
+
+	// HashDouble derives the positions by double hashing (h1 + i*h2) from the two halves of a
+	// single 64 bit hash, which makes the rows less correlated and is cheaper to compute.
+	HashDouble
+)
+
 type F struct {
 	Field [numFuncs][filterSize]uint32
+
+	// Scheme is stored in the header of the file or store that the filter is persisted in.
+	// Filters have to be loaded with the same scheme they were created with.
+	Scheme HashScheme
 }
 
 func (b *F) Add(w []byte, delta uint32) {
-	for i := uint32(0); i < numFuncs; i++ {
-		j := b.hash(i, w)
-
+	for i, j := range b.positions(w) {
 		b.Field[i][j] += delta
 	}
 }
 
+// Remove undoes adding w to b delta times. Fields are clamped at zero, since words that share
+// fields with w might have been removed already.
+func (b *F) Remove(w []byte, delta uint32) {
+	for i, j := range b.positions(w) {
+		if b.Field[i][j] < delta {
+			b.Field[i][j] = 0
+		} else {
+			b.Field[i][j] -= delta
+		}
+	}
+}
+
+// Scale multiplies the fields of w in b by factor, which has to be between 0 and 1, rounding
+// down. This decays the count of w, and of the words that share fields with it.
+func (b *F) Scale(w []byte, factor float64) {
+	for i, j := range b.positions(w) {
+		b.Field[i][j] = uint32(float64(b.Field[i][j]) * factor)
+	}
+}
+
+// Reset zeroes all fields of b, as if no word had ever been added to it. The hash scheme stays
+// the same.
+func (b *F) Reset() {
+	for i := range b.Field {
+		for j := range b.Field[i] {
+			b.Field[i][j] = 0
+		}
+	}
+}
+
+// Merge adds the fields of other to those of b, as if all words that were added to other had
+// been added to b as well. Fields saturate at the largest uint32 instead of overflowing. Both
+// filters need to use the same hash scheme.
+func (b *F) Merge(other *F) error {
+	if b.Scheme != other.Scheme {
+		return fmt.Errorf("can't merge filters with hash schemes %d and %d", b.Scheme, other.Scheme)
+	}
+
+	for i := range b.Field {
+		for j := range other.Field[i] {
+			v := other.Field[i][j]
+			if b.Field[i][j] > math.MaxUint32-v {
+				b.Field[i][j] = math.MaxUint32
+			} else {
+				b.Field[i][j] += v
+			}
+		}
+	}
+
+	return nil
+}
+
+// Subtract undoes merging other into b. Fields are clamped at zero, since b might have lost
+// counts that other contributed, for example by removing words. Both filters need to use the
+// same hash scheme.
+func (b *F) Subtract(other *F) error {
+	if b.Scheme != other.Scheme {
+		return fmt.Errorf("can't subtract filters with hash schemes %d and %d", b.Scheme, other.Scheme)
+	}
+
+	for i := range b.Field {
+		for j := range other.Field[i] {
+			v := other.Field[i][j]
+			if b.Field[i][j] < v {
+				b.Field[i][j] = 0
+			} else {
+				b.Field[i][j] -= v
+			}
+		}
+	}
+
+	return nil
+}
+
 // Score returns the approximate number of times w has been added to b.
 func (b *F) Score(w []byte) uint32 {
 	var s uint32 = math.MaxUint32
 
-	for i := uint32(0); i < numFuncs; i++ {
-		j := b.hash(i, w)
+	for i, j := range b.positions(w) {
 		if s > b.Field[i][j] {
 			s = b.Field[i][j]
 		}
@@ -36,6 +124,62 @@ func (b *F) Score(w []byte) uint32 {
 	return s
 }
 
+// positions returns the position of w in each row of b.
+func (b *F) positions(w []byte) [numFuncs]uint32 {
+	var p [numFuncs]uint32
+
+	switch b.Scheme {
+	case HashDouble:
+		h := fmix64(fnv64(w))
+		h1, h2 := h&math.MaxUint32, h>>32
+
+		for i := range p {
+			p[i] = uint32((h1 + uint64(i)*h2) % filterSize)
+		}
+	default:
+		for i := range p {
+			p[i] = b.hash(uint32(i), w)
+		}
+	}
+
+	return p
+}
+
+// Stats holds statistics about the fields of a filter.
+type Stats struct {
+	// Load is the fraction of fields that are not zero
+	Load float64
+
+	// Max is the largest value of any field
+	Max uint32
+}
+
+// Stats returns statistics about the fields of b.
+func (b *F) Stats() Stats {
+	var (
+		s       Stats
+		nonZero int
+	)
+
+	for i := range b.Field {
+		for _, v := range b.Field[i] {
+			if v == 0 {
+				continue
+			}
+
+			nonZero++
+
+			if s.Max < v {
+				s.Max = v
+			}
+		}
+	}
+
+	s.Load = float64(nonZero) / float64(numFuncs*filterSize)
+
+	return s
+}
+
 func (b *F) String() string {
 	return fmt.Sprint(b.Field)
 }
@@ -60,3 +204,31 @@ func (b *F) hash(i uint32, w []byte) uint32 {
 
 	return s % filterSize
 }
+
+// Inlined FNV64a, with the finalizer of MurmurHash3 to spread the bits over both halves
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+func fnv64(w []byte) uint64 {
+	var s uint64 = offset64
+
+	for _, c := range w {
+		s ^= uint64(c)
+		s *= prime64
+	}
+
+	return s
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+
+	return k
+}
@@ -1,12 +1,16 @@
 package bloom
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io/ioutil"
 	"math"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -32,6 +36,260 @@ func TestBloom(t *testing.T) {
 	}
 }
 
+func TestBloom_Remove(t *testing.T) {
+	f := F{}
+
+	f.Add([]byte("foo"), 3)
+	f.Add([]byte("bar"), 1)
+
+	f.Remove([]byte("foo"), 2)
+	if s := f.Score([]byte("foo")); s != 1 {
+		t.Errorf("expected score 1 for foo, got %v", s)
+	}
+
+	// Removing more than was added clamps at zero
+	f.Remove([]byte("bar"), 5)
+	if s := f.Score([]byte("bar")); s != 0 {
+		t.Errorf("expected score 0 for bar, got %v", s)
+	}
+}
+
+func TestBloom_Scale(t *testing.T) {
+	f := F{}
+
+	f.Add([]byte("foo"), 9)
+	f.Add([]byte("bar"), 4)
+
+	f.Scale([]byte("foo"), 0.5)
+	if s := f.Score([]byte("foo")); s != 4 {
+		t.Errorf("expected score 4 for foo, got %v", s)
+	}
+
+	if s := f.Score([]byte("bar")); s != 4 {
+		t.Errorf("expected score of bar to stay 4, got %v", s)
+	}
+}
+
+func TestBloom_Stats(t *testing.T) {
+	f := F{}
+
+	s := f.Stats()
+	if s.Load != 0 || s.Max != 0 {
+		t.Errorf("expected empty stats for empty filter, got %+v", s)
+	}
+
+	f.Add([]byte("foo"), 3)
+
+	s = f.Stats()
+	if s.Max != 3 {
+		t.Errorf("expected max 3, got %+v", s)
+	}
+
+	if s.Load <= 0 || s.Load > float64(numFuncs)/(numFuncs*filterSize) {
+		t.Errorf("unexpected load %+v", s)
+	}
+}
+
+// window returns the k-th of all 6 byte sequences of lower case letters and spaces, which look a
+// lot like the windows the classifier feeds to filters.
+func window(k int) []byte {
+	b := make([]byte, 6)
+	for i := range b {
+		d := k % 27
+		k /= 27
+
+		if d == 26 {
+			b[i] = ' '
+		} else {
+			b[i] = byte('a' + d)
+		}
+	}
+
+	return b
+}
+
+// overestimated returns the number of words among the first n windows whose score in a filter
+// with the given scheme is higher than 1 after adding each of them once.
+func overestimated(scheme HashScheme, n int) int {
+	f := &F{Scheme: scheme}
+
+	for k := 0; k < n; k++ {
+		f.Add(window(k), 1)
+	}
+
+	var over int
+	for k := 0; k < n; k++ {
+		if f.Score(window(k)) > 1 {
+			over++
+		}
+	}
+
+	return over
+}
+
+func TestBloom_HashSchemeCollisions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+
+	const n = 1_000_000
+
+	fnv := overestimated(HashFNV, n)
+	double := overestimated(HashDouble, n)
+
+	t.Logf("overestimated words out of %d: fnv: %d, double: %d", n, fnv, double)
+
+	if double >= fnv {
+		t.Errorf("expected double hashing to overestimate fewer words than fnv (%d), got %d", fnv, double)
+	}
+}
+
+func TestDB_HashSchemePersist(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := NewDB(tmp, "test", WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("fnord"), 3)
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db, err = NewDB(tmp, "test", WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Score([]byte("fnord")); s != 3 {
+		t.Errorf("expected score 3 after reloading, got %v", s)
+	}
+}
+
+func TestDB_MissingDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "does", "not", "exist")
+
+	db, err := NewDB(root, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("fnord"), 2)
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db, err = NewDB(root, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Score([]byte("fnord")); s != 2 {
+		t.Errorf("expected score 2 after reloading, got %v", s)
+	}
+}
+
+func TestDB_AtPath(t *testing.T) {
+	paths := []string{
+		filepath.Join(t.TempDir(), "spam.filter"),
+		filepath.Join(t.TempDir(), "fast", "disk", "total"),
+	}
+
+	for i, p := range paths {
+		db, err := NewDBAtPath(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		db.Add([]byte("fnord"), uint64(i+1))
+
+		err = db.persist()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	for i, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			t.Fatalf("expected the filter to be stored at %s, got %v", p, err)
+		}
+
+		// Nothing but the filter is left in its directory
+		entries, err := ioutil.ReadDir(filepath.Dir(p))
+		if err != nil || len(entries) != 1 {
+			t.Errorf("expected only the filter in %s, got %v, %v", filepath.Dir(p), entries, err)
+		}
+
+		db, err := NewDBAtPath(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if s := db.Score([]byte("fnord")); s != uint64(i+1) {
+			t.Errorf("expected score %d after reloading %s, got %v", i+1, p, s)
+		}
+	}
+}
+
+func TestDB_Reset(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := NewDB(tmp, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	words := []string{"fnord", "bitcoin", "cheap pills"}
+	for i, w := range words {
+		db.Add([]byte(w), uint64(i+1))
+	}
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = db.Reset()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if db.Dirty() {
+		t.Errorf("expected DB to be persisted after resetting")
+	}
+
+	if st := db.Stats(); st.Max != 0 {
+		t.Errorf("expected all fields to be zero after resetting, got %+v", st)
+	}
+
+	reloaded, err := NewDB(tmp, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, w := range words {
+		if s := db.Score([]byte(w)); s != 0 {
+			t.Errorf("expected score 0 for %q after resetting, got %v", w, s)
+		}
+
+		if s := reloaded.Score([]byte(w)); s != 0 {
+			t.Errorf("expected score 0 for %q after reloading, got %v", w, s)
+		}
+	}
+
+	db.Add([]byte("fnord"), 2)
+
+	if s := db.Score([]byte("fnord")); s != 2 {
+		t.Errorf("expected score 2 after adding to the reset DB, got %v", s)
+	}
+}
+
 func TestBloom_HowManyFnords(t *testing.T) {
 	f := F{}
 
@@ -290,3 +548,610 @@ func BenchmarkF_AddTestData(b *testing.B) {
 	b.ReportMetric(mse, "mse")
 	b.ReportMetric(float64(errors), "errors")
 }
+
+func benchmarkWords(n int) [][]byte {
+	words := make([][]byte, n)
+	for i := range words {
+		words[i] = []byte("word" + strconv.Itoa(i))
+	}
+
+	return words
+}
+
+func TestDB_ScoreMany(t *testing.T) {
+	db, err := NewDB(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	words := benchmarkWords(100)
+	for i, w := range words {
+		db.Add(w, uint64(i))
+	}
+
+	scores := db.ScoreMany(words)
+	for i, w := range words {
+		if s := db.Score(w); s != scores[i] {
+			t.Errorf("unexpected batched score for %q: want %v, have %v", w, s, scores[i])
+		}
+	}
+}
+
+func BenchmarkDB_Score(b *testing.B) {
+	db, err := NewDB(b.TempDir(), "bench")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	words := benchmarkWords(4096)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, w := range words {
+			db.Score(w)
+		}
+	}
+}
+
+func BenchmarkDB_ScoreMany(b *testing.B) {
+	db, err := NewDB(b.TempDir(), "bench")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	words := benchmarkWords(4096)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		db.ScoreMany(words)
+	}
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	db, err := NewDB(t.TempDir(), "test", WithSnapshots())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("foo"), 1)
+
+	snap := db.Snapshot()
+	if db.Snapshot() != snap {
+		t.Errorf("expected the same snapshot until the filter is written")
+	}
+
+	db.Add([]byte("foo"), 1)
+
+	if s := snap.Score([]byte("foo")); s != 1 {
+		t.Errorf("expected snapshot score 1, got %v", s)
+	}
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Snapshot().Score([]byte("foo")); s != 2 {
+		t.Errorf("expected score 2 in the snapshot swapped in by persisting, got %v", s)
+	}
+
+	if s := snap.Score([]byte("foo")); s != 1 {
+		t.Errorf("expected the old snapshot to stay unchanged, got score %v", s)
+	}
+
+	db.Add([]byte("foo"), 1)
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Snapshot().Score([]byte("foo")); s != 3 {
+		t.Errorf("expected score 3 after persisting again, got %v", s)
+	}
+}
+
+func TestDB_SnapshotCopy(t *testing.T) {
+	db, err := NewDB(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("foo"), 1)
+
+	snap := db.Snapshot()
+
+	db.Add([]byte("foo"), 1)
+
+	if s := snap.Score([]byte("foo")); s != 1 {
+		t.Errorf("expected snapshot score 1, got %v", s)
+	}
+
+	if s := db.Snapshot().Score([]byte("foo")); s != 2 {
+		t.Errorf("expected a fresh copy without WithSnapshots, got score %v", s)
+	}
+}
+
+// BenchmarkDB_Snapshot scores words while another goroutine keeps adding words, once with
+// ScoreMany, which takes the read lock for each call, and once in a snapshot, which doesn't take
+// any lock.
+func BenchmarkDB_Snapshot(b *testing.B) {
+	db, err := NewDB(b.TempDir(), "bench", WithSnapshots())
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	words := benchmarkWords(4096)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				db.Add(words[i%len(words)], 1)
+			}
+		}
+	}()
+
+	b.Run("ScoreMany", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				db.ScoreMany(words)
+			}
+		})
+	})
+
+	b.Run("Snapshot", func(b *testing.B) {
+		db.Snapshot()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				snap := db.Snapshot()
+				for _, w := range words {
+					snap.Score(w)
+				}
+			}
+		})
+	})
+}
+
+func TestBloom_Merge(t *testing.T) {
+	a, b, union := new(F), new(F), new(F)
+
+	for k := 0; k < 1000; k++ {
+		a.Add(window(k), 1)
+		union.Add(window(k), 1)
+	}
+
+	for k := 1000; k < 2000; k++ {
+		b.Add(window(k), 2)
+		union.Add(window(k), 2)
+	}
+
+	err := a.Merge(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if a.Field != union.Field {
+		t.Errorf("merged filter differs from filter trained on the union")
+	}
+
+	for k := 0; k < 2000; k++ {
+		if a.Score(window(k)) != union.Score(window(k)) {
+			t.Errorf("score of %q differs", window(k))
+		}
+	}
+
+	err = a.Merge(&F{Scheme: HashDouble})
+	if err == nil {
+		t.Errorf("expected error when merging filters with different hash schemes")
+	}
+}
+
+func TestBloom_MergeSaturates(t *testing.T) {
+	a, b := new(F), new(F)
+
+	a.Add([]byte("foo"), math.MaxUint32-1)
+	b.Add([]byte("foo"), 2)
+
+	err := a.Merge(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := a.Score([]byte("foo")); s != math.MaxUint32 {
+		t.Errorf("expected saturated score, got %v", s)
+	}
+}
+
+func TestDB_MergeFrom(t *testing.T) {
+	tmp := t.TempDir()
+
+	worker, err := NewDB(tmp, "worker")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	worker.Add([]byte("foo"), 2)
+
+	err = worker.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db, err := NewDB(tmp, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("foo"), 1)
+
+	err = db.MergeFrom(filepath.Join(tmp, "worker"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Score([]byte("foo")); s != 3 {
+		t.Errorf("expected score 3 after merge, got %v", s)
+	}
+
+	err = db.MergeFrom(filepath.Join(tmp, "missing"))
+	if err == nil {
+		t.Errorf("expected error for missing filter")
+	}
+}
+
+func TestDB_MergeFromScheme(t *testing.T) {
+	tmp := t.TempDir()
+
+	worker, err := NewDB(tmp, "worker", WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	worker.Add([]byte("foo"), 2)
+
+	err = worker.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db, err := NewDB(tmp, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = db.MergeFrom(filepath.Join(tmp, "worker"))
+	if err == nil {
+		t.Errorf("expected error for filter with a different hash scheme")
+	}
+
+	if s := db.Score([]byte("foo")); s != 0 {
+		t.Errorf("expected filter to be unchanged, got score %v", s)
+	}
+
+	_, err = NewDB(tmp, "worker")
+	if err == nil {
+		t.Errorf("expected error for loading filter with a different hash scheme")
+	}
+
+	// Files without a header are assumed to use the scheme of the DB
+	var legacy F
+	legacy.Add([]byte("foo"), 2)
+
+	var buf bytes.Buffer
+
+	err = writeField(&buf, &legacy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmp, "legacy"), buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = db.MergeFrom(filepath.Join(tmp, "legacy"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Score([]byte("foo")); s != 2 {
+		t.Errorf("expected score 2 after merging headerless filter, got %v", s)
+	}
+}
+
+func TestBloom_Subtract(t *testing.T) {
+	a, b := new(F), new(F)
+
+	for k := 0; k < 1000; k++ {
+		a.Add(window(k), 1)
+		b.Add(window(k+500), 3)
+	}
+
+	prior := a.Field
+
+	err := a.Merge(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = a.Subtract(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if a.Field != prior {
+		t.Errorf("filter differs from its state before merging")
+	}
+
+	// Subtracting again clamps at zero
+	err = a.Subtract(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for k := 500; k < 1500; k++ {
+		if s := a.Score(window(k)); s != 0 {
+			t.Errorf("expected score 0 for %q, got %v", window(k), s)
+			break
+		}
+	}
+
+	err = a.Subtract(&F{Scheme: HashDouble})
+	if err == nil {
+		t.Errorf("expected error when subtracting filters with different hash schemes")
+	}
+}
+
+func TestDB_SubtractFrom(t *testing.T) {
+	tmp := t.TempDir()
+
+	worker, err := NewDB(tmp, "worker")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	worker.Add([]byte("foo"), 2)
+
+	err = worker.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db, err := NewDB(tmp, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("foo"), 1)
+
+	err = db.MergeFrom(filepath.Join(tmp, "worker"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = db.SubtractFrom(filepath.Join(tmp, "worker"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := db.Score([]byte("foo")); s != 1 {
+		t.Errorf("expected score 1 after subtracting, got %v", s)
+	}
+}
+
+func TestDB_SubtractFromScheme(t *testing.T) {
+	tmp := t.TempDir()
+
+	worker, err := NewDB(tmp, "worker", WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	worker.Add([]byte("foo"), 1)
+
+	err = worker.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db, err := NewDB(tmp, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("foo"), 2)
+
+	err = db.SubtractFrom(filepath.Join(tmp, "worker"))
+	if err == nil {
+		t.Errorf("expected error for filter with a different hash scheme")
+	}
+
+	if s := db.Score([]byte("foo")); s != 2 {
+		t.Errorf("expected filter to be unchanged, got score %v", s)
+	}
+}
+
+func TestDB_LazyPersist(t *testing.T) {
+	// Simulate a lightly used server that learns one word a minute for a day, and count how
+	// often Run would rewrite the filter.
+	persists := func(opts ...Option) int {
+		db, err := NewDB(t.TempDir(), "test", opts...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		now := db.lastPersist
+		count := 0
+
+		for i := 0; i < 24*60; i++ {
+			now = now.Add(time.Minute)
+
+			db.Add([]byte("word"+strconv.Itoa(i)), 1)
+
+			if !db.due(now) {
+				continue
+			}
+
+			// Only account for the write instead of writing 64MB every time
+			db.persisted(nil, db.resetChanges())
+			db.lastPersist = now
+			count++
+		}
+
+		return count
+	}
+
+	eager := persists()
+	lazy := persists(WithLazyPersist(1000, 2*time.Hour))
+
+	size := int64(binary.Size(F{}.Field))
+	t.Logf("bytes written: %d eagerly, %d lazily", int64(eager)*size, int64(lazy)*size)
+
+	if eager != 24*60 {
+		t.Errorf("expected the filter to be persisted every minute without a threshold, got %d times", eager)
+	}
+
+	// 1000 cells change after 63 words, which is sooner than the maximum delay of two hours
+	if lazy != 24*60/63 {
+		t.Errorf("expected the filter to be persisted %d times with a threshold, got %d", 24*60/63, lazy)
+	}
+}
+
+func TestDB_LazyPersistMaxDelay(t *testing.T) {
+	db, err := NewDB(t.TempDir(), "test", WithLazyPersist(1000, time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if db.due(db.lastPersist.Add(2 * time.Hour)) {
+		t.Errorf("expected a clean filter not to be due")
+	}
+
+	db.Add([]byte("fnord"), 1)
+
+	if db.due(db.lastPersist.Add(time.Minute)) {
+		t.Errorf("expected a single change not to be due before the maximum delay")
+	}
+
+	if !db.due(db.lastPersist.Add(time.Hour)) {
+		t.Errorf("expected a single change to be due after the maximum delay")
+	}
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if db.Dirty() || db.changes != 0 {
+		t.Errorf("expected the filter to be clean after persisting, got %d changes", db.changes)
+	}
+}
+
+// blockingWriter blocks the first write until release is closed, and signals on started once it
+// does.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() == 0 {
+		close(w.started)
+		<-w.release
+	}
+
+	return w.buf.Write(p)
+}
+
+func TestDB_WriteDoesntBlockChanges(t *testing.T) {
+	db, err := NewDB(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("before"), 1)
+
+	w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+
+	go func() {
+		done <- db.writeTo(w)
+	}()
+
+	<-w.started
+
+	added := make(chan struct{})
+
+	go func() {
+		db.Add([]byte("during"), 1)
+		close(added)
+	}()
+
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected changes not to wait for the filter to be written")
+	}
+
+	close(w.release)
+
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The written filter holds the state from before the write started
+	var f F
+
+	r := bufio.NewReader(&w.buf)
+
+	err = readHeader(r, &f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = binary.Read(r, binary.BigEndian, &f.Field)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if f.Score([]byte("before")) != 1 || f.Score([]byte("during")) != 0 {
+		t.Errorf("expected the written filter to hold only the word added before writing")
+	}
+
+	if db.Score([]byte("during")) != 1 {
+		t.Errorf("expected the word added while writing to be in the database")
+	}
+}
+
+func BenchmarkDB_Persist(b *testing.B) {
+	db, err := NewDB(b.TempDir(), "test")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("word"), 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := db.persist()
+		if err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package bloom
+
+import (
+	"container/list"
+	"sync"
+)
+
+// WithScoreCache makes a DB remember the scores of the size words it looked up most recently, so
+// that scoring them again doesn't compute their positions in the filter again. Since adding or
+// removing any word can change the score of others that share fields with it, every change to
+// the filter empties the cache. This pays off for workloads that classify a lot more than they
+// train. A size of 0 disables the cache, which is the default.
+func WithScoreCache(size int) Option {
+	return func(d *DB) {
+		if size <= 0 {
+			d.cache = nil
+			return
+		}
+
+		d.cache = newScoreCache(size)
+	}
+}
+
+// A scoreCache is a least recently used cache of the scores of words. It is safe for concurrent
+// use.
+type scoreCache struct {
+	mu sync.Mutex
+
+	size  int
+	order *list.List // of *cacheEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	word  string
+	score uint32
+}
+
+func newScoreCache(size int) *scoreCache {
+	return &scoreCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// get returns the cached score of w, if there is one.
+func (c *scoreCache) get(w []byte) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[string(w)]
+	if !ok {
+		return 0, false
+	}
+
+	c.order.MoveToFront(e)
+
+	return e.Value.(*cacheEntry).score, true
+}
+
+// put caches score for w, evicting the least recently used score if the cache is full.
+func (c *scoreCache) put(w []byte, score uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[string(w)]; ok {
+		e.Value.(*cacheEntry).score = score
+		c.order.MoveToFront(e)
+
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).word)
+	}
+
+	entry := &cacheEntry{word: string(w), score: score}
+	c.items[entry.word] = c.order.PushFront(entry)
+}
+
+// clear removes all scores from the cache.
+func (c *scoreCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.order.Len() == 0 {
+		return
+	}
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element, c.size)
+}
+
+// len returns the number of cached scores.
+func (c *scoreCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
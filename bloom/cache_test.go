@@ -0,0 +1,107 @@
+package bloom
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ScoreCache(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := NewDB(tmp, "test", WithScoreCache(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("fnord"), 2)
+
+	for _, w := range []string{"fnord", "bitcoin", "fnord", "cheap"} {
+		db.Score([]byte(w))
+	}
+
+	if n := db.cache.len(); n != 2 {
+		t.Errorf("expected cache to be limited to 2 scores, got %d", n)
+	}
+
+	// "bitcoin" was used least recently, so it was evicted
+	if _, ok := db.cache.get([]byte("bitcoin")); ok {
+		t.Errorf("expected least recently used score to be evicted")
+	}
+
+	if s, ok := db.cache.get([]byte("fnord")); !ok || s != 2 {
+		t.Errorf("expected score 2 for \"fnord\" to be cached, got %v, %v", s, ok)
+	}
+
+	other, err := NewDB(tmp, "other")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	other.Add([]byte("fnord"), 5)
+
+	err = other.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Every change has to be visible in the scores right away
+	testCases := []struct {
+		name   string
+		change func() error
+		expect uint64
+	}{
+		{"add", func() error { db.Add([]byte("fnord"), 1); return nil }, 3},
+		{"remove", func() error { db.Remove([]byte("fnord"), 2); return nil }, 1},
+		{"merge", func() error { return db.MergeFrom(filepath.Join(tmp, "other")) }, 6},
+		{"subtract", func() error { return db.SubtractFrom(filepath.Join(tmp, "other")) }, 1},
+		{"reset", db.Reset, 0},
+	}
+
+	for _, tc := range testCases {
+		if s := db.Score([]byte("fnord")); s == tc.expect {
+			t.Fatalf("expected score before %s to differ from %v", tc.name, tc.expect)
+		}
+
+		err := tc.change()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if s := db.Score([]byte("fnord")); s != tc.expect {
+			t.Errorf("expected score %v after %s, got %v", tc.expect, tc.name, s)
+		}
+
+		if s := db.ScoreMany([][]byte{[]byte("fnord")}); s[0] != tc.expect {
+			t.Errorf("expected batched score %v after %s, got %v", tc.expect, tc.name, s[0])
+		}
+	}
+}
+
+func BenchmarkDB_ScoreCache(b *testing.B) {
+	// Few distinct words, scored over and over, like the frequent ngrams of many messages
+	words := benchmarkWords(256)
+
+	for _, size := range []int{0, 1024} {
+		name := "uncached"
+		if size > 0 {
+			name = "cached"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			db, err := NewDB(b.TempDir(), "bench", WithScoreCache(size))
+			if err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+
+			for _, w := range words {
+				db.Add(w, 1)
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				db.ScoreMany(words)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package bloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// Saturated reports whether any field of the filter has reached the largest count it can hold.
+// Counts of words that hash to saturated fields are under-estimated from then on.
+func (s Stats) Saturated() bool {
+	return s.Max == math.MaxUint32
+}
+
+// CheckFile reads the filter persisted by a DB in the file at path and returns its statistics.
+// It returns an error if the file can't be read, doesn't hold exactly one filter or names a hash
+// scheme other than scheme. Files that don't name their scheme are assumed to use scheme, like a
+// DB does.
+func CheckFile(path string, scheme HashScheme) (Stats, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+
+	f := F{Scheme: scheme}
+
+	err = readHeader(r, &f)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if f.Scheme != scheme {
+		return Stats{}, fmt.Errorf("uses hash scheme %d, not %d", f.Scheme, scheme)
+	}
+
+	err = readField(r, &f)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return f.Stats(), nil
+}
+
+// CheckStore reads all filters of the store in the file at path and returns their statistics by
+// name. It returns an error if the file can't be read, doesn't hold exactly the filters listed
+// in its index or names a hash scheme other than scheme, see CheckFile.
+func CheckStore(path string, scheme HashScheme) (map[string]Stats, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+
+	stored := scheme
+
+	names, err := readStoreIndex(r, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+
+	if stored != scheme {
+		return nil, fmt.Errorf("uses hash scheme %d, not %d", stored, scheme)
+	}
+
+	stats := make(map[string]Stats, len(names))
+
+	for i, name := range names {
+		var f F
+
+		// Only the last filter has to end the file
+		if i < len(names)-1 {
+			err = binary.Read(r, binary.BigEndian, &f.Field)
+		} else {
+			err = readField(r, &f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading filter %q: %w", name, err)
+		}
+
+		stats[name] = f.Stats()
+	}
+
+	return stats, nil
+}
+
+// readField reads the fields of f from r and makes sure that nothing follows them.
+func readField(r io.Reader, f *F) error {
+	err := binary.Read(r, binary.BigEndian, &f.Field)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("file is empty")
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("file is truncated")
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return fmt.Errorf("%d unexpected bytes after the filter", n)
+	}
+
+	return nil
+}
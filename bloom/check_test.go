@@ -0,0 +1,144 @@
+package bloom
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckFile(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewDB(dir, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("fnord"), math.MaxUint32)
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	path := filepath.Join(dir, "test")
+
+	stats, err := CheckFile(path, HashFNV)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if stats.Load == 0 || !stats.Saturated() {
+		t.Errorf("expected a saturated filter, got %+v", stats)
+	}
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = fh.Write([]byte("junk"))
+	fh.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = CheckFile(path, HashFNV)
+	if err == nil || !strings.Contains(err.Error(), "4 unexpected bytes") {
+		t.Errorf("expected trailing bytes to be reported, got %v", err)
+	}
+
+	err = os.Truncate(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = CheckFile(path, HashFNV)
+	if err == nil || err.Error() != "file is empty" {
+		t.Errorf("expected an empty file to be reported, got %v", err)
+	}
+}
+
+func TestCheckStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+
+	s, err := OpenStore(path, []string{"ham", "spam"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s.DB("spam").Add([]byte("fnord"), 1)
+
+	err = s.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	stats, err := CheckStore(path, HashFNV)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(stats) != 2 || stats["ham"].Load != 0 || stats["spam"].Max != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = os.Truncate(path, info.Size()-1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = CheckStore(path, HashFNV)
+	if err == nil || !strings.Contains(err.Error(), `reading filter "spam": file is truncated`) {
+		t.Errorf("expected a truncated store to be reported, got %v", err)
+	}
+}
+
+func TestCheck_Scheme(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewDB(dir, "test", WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = db.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s, err := OpenStore(filepath.Join(dir, "filters"), []string{"ham", "spam"}, WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = s.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := CheckFile(filepath.Join(dir, "test"), HashDouble); err != nil {
+		t.Errorf("unexpected error for the right scheme: %s", err)
+	}
+
+	if _, err := CheckStore(filepath.Join(dir, "filters"), HashDouble); err != nil {
+		t.Errorf("unexpected error for the right scheme: %s", err)
+	}
+
+	_, err = CheckFile(filepath.Join(dir, "test"), HashFNV)
+	if err == nil || err.Error() != "uses hash scheme 1, not 0" {
+		t.Errorf("expected a scheme mismatch to be reported, got %v", err)
+	}
+
+	_, err = CheckStore(filepath.Join(dir, "filters"), HashFNV)
+	if err == nil || err.Error() != "uses hash scheme 1, not 0" {
+		t.Errorf("expected a scheme mismatch to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package bloom
+
+import (
+	"math"
+)
+
+// Params returns the dimensions of the filters of this package: the number of fields in each row,
+// and the number of rows, i.e. of hash functions.
+func Params() (size, rows uint32) {
+	return filterSize, numFuncs
+}
+
+// ErrorRate returns the probability that a word that was never added to a filter of this package
+// still has a count above zero, once expectedDistinct distinct words have been added to it.
+func ErrorRate(expectedDistinct uint64) float64 {
+	return errorRate(expectedDistinct, filterSize, numFuncs)
+}
+
+// errorRate returns the error rate of a filter with numFuncs rows of size fields each after
+// adding n distinct words. Each word sets one field per row, so a field stays zero with
+// probability (1-1/size)^n ≈ e^(-n/size), and an unknown word is counted if its fields in all
+// rows are set.
+func errorRate(n uint64, size, numFuncs uint32) float64 {
+	return math.Pow(1-math.Exp(-float64(n)/float64(size)), float64(numFuncs))
+}
+
+// RecommendParams returns the dimensions of a filter that counts words it has never seen with at
+// most the probability targetError, once expectedDistinct distinct words have been added to it.
+// The number of hash functions is the optimal -log2(targetError), rounded up, and the size of
+// each row is the smallest one for which errorRate stays below targetError with that many rows.
+// In total, this is close to the usual n·ln(1/p)/ln(2)² fields. Sizes that don't fit into a
+// uint32 are capped. RecommendParams panics if targetError is not between 0 and 1 or
+// expectedDistinct is 0.
+func RecommendParams(expectedDistinct uint64, targetError float64) (size, numFuncs uint32) {
+	if !(targetError > 0 && targetError < 1) {
+		panic("target error rate must be between 0 and 1")
+	}
+
+	if expectedDistinct == 0 {
+		panic("expected number of distinct words must be above 0")
+	}
+
+	k := math.Max(1, math.Ceil(-math.Log2(targetError)))
+
+	// Solve (1-e^(-n/size))^k = targetError for size
+	m := math.Ceil(-float64(expectedDistinct) / math.Log(1-math.Pow(targetError, 1/k)))
+	if m > math.MaxUint32 {
+		m = math.MaxUint32
+	}
+
+	return uint32(m), uint32(k)
+}
@@ -0,0 +1,70 @@
+package bloom
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecommendParams(t *testing.T) {
+	testCases := []struct {
+		distinct    uint64
+		targetError float64
+		size        uint32
+		numFuncs    uint32
+	}{
+		{1_000_000, 0.01, 1_370_423, 7},
+		{1000, 0.001, 1438, 10},
+		{100_000, 0.5, 144_270, 1},
+		{1, 0.01, 2, 7},
+		{math.MaxUint64, 0.01, math.MaxUint32, 7},
+	}
+
+	for _, tc := range testCases {
+		size, numFuncs := RecommendParams(tc.distinct, tc.targetError)
+		if size != tc.size || numFuncs != tc.numFuncs {
+			t.Errorf("expected size %d and %d functions for %d words at %v, got %d and %d", tc.size, tc.numFuncs, tc.distinct, tc.targetError, size, numFuncs)
+		}
+
+		if size < math.MaxUint32 {
+			if rate := errorRate(tc.distinct, size, numFuncs); rate > tc.targetError {
+				t.Errorf("expected an error rate of at most %v for %d words, got %v", tc.targetError, tc.distinct, rate)
+			}
+		}
+
+		// The total size is close to the classic n·ln(1/p)/ln(2)²
+		classic := float64(tc.distinct) * math.Log(1/tc.targetError) / (math.Ln2 * math.Ln2)
+		if total := float64(size) * float64(numFuncs); tc.distinct > 1000 && size < math.MaxUint32 && math.Abs(total-classic)/classic > 0.01 {
+			t.Errorf("expected about %v fields in total for %d words at %v, got %v", classic, tc.distinct, tc.targetError, total)
+		}
+	}
+
+	for _, targetError := range []float64{0, 1, -0.5, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a target error of %v to panic", targetError)
+				}
+			}()
+
+			RecommendParams(1000, targetError)
+		}()
+	}
+}
+
+func TestParams(t *testing.T) {
+	if size, rows := Params(); size != filterSize || rows != numFuncs {
+		t.Errorf("expected %d rows of %d fields, got %d of %d", numFuncs, filterSize, rows, size)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	if rate := ErrorRate(0); rate != 0 {
+		t.Errorf("expected no errors in an empty filter, got %v", rate)
+	}
+
+	// With as many words as fields per row, each row is set with probability 1-1/e
+	want := math.Pow(1-1/math.E, numFuncs)
+	if rate := ErrorRate(filterSize); math.Abs(rate-want) > 1e-12 {
+		t.Errorf("expected error rate %v, got %v", want, rate)
+	}
+}
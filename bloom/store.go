@@ -0,0 +1,332 @@
+package bloom
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"mailfilter/logger"
+)
+
+// storeMagic starts every store file, followed by the format version.
+var storeMagic = []byte("MFBS")
+
+// storeVersion is the version of the store files that are written. Version 1 files lack the hash
+// scheme, and are assumed to use the one they are opened with.
+const storeVersion = 2
+
+// A Store keeps several named filters in a single file. The file starts with an index of the
+// names of the filters, followed by their fields in the same order:
+//
+//	"MFBS" | version (uint32) | number of filters (uint32) | hash scheme (uint32)
+//	name length (uint16) | name, for each filter
+//	fields, for each filter
+//
+// All numbers are big endian. Since the filters are persisted together, the file always holds
+// a consistent state of all of them. All filters use the same hash scheme.
+type Store struct {
+	path   string
+	names  []string
+	dbs    map[string]*DB
+	scheme HashScheme
+}
+
+// OpenStore loads the filters stored in the file at path. Filters with the given names are
+// created if the file doesn't contain them yet, and if the file doesn't exist, it is created
+// when the store is persisted for the first time. The options apply to all filters. If the file
+// was written with a different hash scheme than the options select, OpenStore returns an error.
+func OpenStore(path string, names []string, opts ...Option) (*Store, error) {
+	s := &Store{
+		path: path,
+		dbs:  make(map[string]*DB),
+	}
+
+	probe := &DB{}
+	for _, o := range opts {
+		o(probe)
+	}
+
+	s.scheme = probe.f.Scheme
+
+	newDB := func(name string) *DB {
+		db := &DB{name: name, lastPersist: time.Now(), store: s}
+		for _, o := range opts {
+			o(db)
+		}
+
+		s.names = append(s.names, name)
+		s.dbs[name] = db
+
+		return db
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer fh.Close()
+
+		r := bufio.NewReader(fh)
+
+		scheme := s.scheme
+
+		stored, err := readStoreIndex(r, &scheme)
+		if err != nil {
+			return nil, fmt.Errorf("reading index of %s: %w", path, err)
+		}
+
+		if scheme != s.scheme {
+			return nil, fmt.Errorf("%s uses hash scheme %d, not %d", path, scheme, s.scheme)
+		}
+
+		for _, name := range stored {
+			db := newDB(name)
+
+			err := binary.Read(r, binary.BigEndian, &db.f.Field)
+			if err != nil {
+				return nil, fmt.Errorf("reading filter %q from %s: %w", name, path, err)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := s.dbs[name]; !ok {
+			newDB(name)
+		}
+	}
+
+	sort.Strings(s.names)
+
+	return s, nil
+}
+
+// readStoreIndex reads the header and the names of the filters from a store file. If the header
+// names the hash scheme of the filters, it is stored in scheme.
+func readStoreIndex(r io.Reader, scheme *HashScheme) ([]string, error) {
+	var header struct {
+		Magic   [4]byte
+		Version uint32
+		Count   uint32
+	}
+
+	err := binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header.Magic[:], storeMagic) {
+		return nil, fmt.Errorf("not a filter store")
+	}
+
+	switch header.Version {
+	case 1:
+	case storeVersion:
+		var s uint32
+
+		err := binary.Read(r, binary.BigEndian, &s)
+		if err != nil {
+			return nil, err
+		}
+
+		if s > uint32(HashDouble) {
+			return nil, fmt.Errorf("unknown hash scheme %d", s)
+		}
+
+		*scheme = HashScheme(s)
+	default:
+		return nil, fmt.Errorf("unsupported store version %d", header.Version)
+	}
+
+	names := make([]string, header.Count)
+
+	for i := range names {
+		var n uint16
+
+		err := binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			return nil, err
+		}
+
+		name := make([]byte, n)
+
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return nil, err
+		}
+
+		names[i] = string(name)
+	}
+
+	return names, nil
+}
+
+// DB returns the filter with the given name, or nil if s doesn't have one. The returned DB must
+// not be run or persisted on its own, s does that for all of its filters.
+func (s *Store) DB(name string) *DB {
+	return s.dbs[name]
+}
+
+// Names returns the names of the filters in s, in alphabetical order.
+func (s *Store) Names() []string {
+	return append([]string(nil), s.names...)
+}
+
+// dirty reports whether any filter in s has changes that haven't been persisted yet.
+func (s *Store) dirty() bool {
+	for _, db := range s.dbs {
+		if db.Dirty() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// due reports whether any filter in s is due to be persisted, see DB.due.
+func (s *Store) due(now time.Time) bool {
+	for _, db := range s.dbs {
+		if db.due(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// persist writes all filters of s to its file, replacing the previous contents atomically.
+func (s *Store) persist() error {
+	changes := make(map[string]int, len(s.dbs))
+	for name, db := range s.dbs {
+		changes[name] = db.resetChanges()
+	}
+
+	err := s.write()
+
+	for name, db := range s.dbs {
+		db.persisted(err, changes[name])
+	}
+
+	return err
+}
+
+func (s *Store) write() error {
+	f, err := ioutil.TempFile(filepath.Dir(s.path), "*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	header := struct {
+		Magic   [4]byte
+		Version uint32
+		Count   uint32
+		Scheme  uint32
+	}{Version: storeVersion, Count: uint32(len(s.names)), Scheme: uint32(s.scheme)}
+	copy(header.Magic[:], storeMagic)
+
+	err = binary.Write(w, binary.BigEndian, header)
+	if err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+
+	for _, name := range s.names {
+		err := binary.Write(w, binary.BigEndian, uint16(len(name)))
+		if err == nil {
+			_, err = w.WriteString(name)
+		}
+		if err != nil {
+			return fmt.Errorf("writing index: %w", err)
+		}
+	}
+
+	// Copy all filters while holding all of their locks, so that the file holds a state of them
+	// that is consistent with each other. Writing the copies doesn't block changes.
+	for _, name := range s.names {
+		s.dbs[name].writeMu.Lock()
+		defer s.dbs[name].writeMu.Unlock()
+	}
+
+	for _, name := range s.names {
+		s.dbs[name].mu.RLock()
+	}
+
+	for _, name := range s.names {
+		s.dbs[name].copyToSpare()
+		s.dbs[name].mu.RUnlock()
+	}
+
+	for _, name := range s.names {
+		err := writeField(w, s.dbs[name].spare)
+		if err != nil {
+			return fmt.Errorf("marshal filter %q: %w", name, err)
+		}
+	}
+
+	for _, name := range s.names {
+		s.dbs[name].publishSpare()
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("writing filters: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("writing filters: %w", err)
+	}
+
+	err = os.Rename(f.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+
+	return nil
+}
+
+// Run persists the filters of s once a minute if any of them changed, until ctx is canceled.
+// They are persisted one last time before Run returns. If the filters were created with
+// WithLazyPersist, they are persisted once any of them is due.
+func (s *Store) Run(ctx context.Context) {
+	tick := time.NewTicker(1 * time.Minute)
+	done := false
+
+	for !done {
+		select {
+		case <-ctx.Done():
+			// Persist one last time, then quit
+			done = true
+			tick.Stop()
+		case <-tick.C:
+		}
+
+		if !s.dirty() || (!done && !s.due(time.Now())) {
+			continue
+		}
+
+		logger.Debugf("persisting updates to %s", s.path)
+
+		err := s.persist()
+		if err != nil {
+			logger.Errorf("failed to persist %s: %s", s.path, err)
+		}
+	}
+}
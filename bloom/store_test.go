@@ -0,0 +1,189 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStore_Persist(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "filters")
+
+	s, err := OpenStore(path, []string{"total", "spam"}, WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s.DB("total").Add([]byte("fnord"), 3)
+	s.DB("spam").Add([]byte("fnord"), 2)
+	s.DB("spam").Add([]byte("bitcoin"), 1)
+
+	if !s.dirty() {
+		t.Errorf("expected store to be dirty after adding words")
+	}
+
+	err = s.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s.dirty() {
+		t.Errorf("expected store to be clean after persisting")
+	}
+
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "filters" {
+		t.Errorf("expected a single file, got %v", entries)
+	}
+
+	s, err = OpenStore(path, []string{"ham"}, WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"ham", "spam", "total"}) {
+		t.Errorf("unexpected filters %v", names)
+	}
+
+	testCases := []struct {
+		db    string
+		word  string
+		score uint64
+	}{
+		{"total", "fnord", 3},
+		{"spam", "fnord", 2},
+		{"spam", "bitcoin", 1},
+		{"total", "bitcoin", 0},
+		{"ham", "fnord", 0},
+	}
+
+	for _, tc := range testCases {
+		if score := s.DB(tc.db).Score([]byte(tc.word)); score != tc.score {
+			t.Errorf("expected score %d for %q in %s after reloading, got %d", tc.score, tc.word, tc.db, score)
+		}
+	}
+
+	if s.DB("unknown") != nil {
+		t.Errorf("expected no filter for an unknown name")
+	}
+}
+
+func TestStore_Reset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+
+	s, err := OpenStore(path, []string{"total", "spam"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s.DB("total").Add([]byte("fnord"), 3)
+	s.DB("spam").Add([]byte("fnord"), 2)
+
+	err = s.DB("spam").Reset()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s.dirty() {
+		t.Errorf("expected store to be persisted after resetting a filter")
+	}
+
+	s, err = OpenStore(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := s.DB("spam").Score([]byte("fnord")); got != 0 {
+		t.Errorf("expected score 0 in the reset filter, got %d", got)
+	}
+
+	if got := s.DB("total").Score([]byte("fnord")); got != 3 {
+		t.Errorf("expected score 3 in the other filter, got %d", got)
+	}
+}
+
+func TestStore_NotAStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+
+	err := ioutil.WriteFile(path, []byte("this is not a filter store"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = OpenStore(path, []string{"total"})
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestStore_Scheme(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+
+	s, err := OpenStore(path, []string{"total"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s.DB("total").Add([]byte("fnord"), 1)
+
+	err = s.persist()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = OpenStore(path, []string{"total"}, WithHashScheme(HashDouble))
+	if err == nil {
+		t.Errorf("expected error for reopening the store with a different hash scheme")
+	}
+
+	s, err = OpenStore(path, []string{"total"}, WithHashScheme(HashFNV))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := s.DB("total").Score([]byte("fnord")); got != 1 {
+		t.Errorf("expected score 1 after reopening with the same scheme, got %d", got)
+	}
+}
+
+func TestStore_Version1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+
+	// Version 1 stores don't record the hash scheme
+	var f F
+	f.Scheme = HashDouble
+	f.Add([]byte("fnord"), 2)
+
+	var buf bytes.Buffer
+	buf.Write(storeMagic)
+	binary.Write(&buf, binary.BigEndian, []uint32{1, 1})
+	binary.Write(&buf, binary.BigEndian, uint16(len("total")))
+	buf.WriteString("total")
+
+	err := writeField(&buf, &f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = ioutil.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s, err := OpenStore(path, []string{"total"}, WithHashScheme(HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := s.DB("total").Score([]byte("fnord")); got != 2 {
+		t.Errorf("expected score 2 in version 1 store, got %d", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"mailfilter/bloom"
+)
+
+// checkDBs checks that the filters of the models in dirs can be loaded with the hash scheme
+// scheme, and writes their load and whether they are saturated to out. With store, each model
+// keeps its filters in a single store file, see bloom.Store. It returns false if any filter is
+// missing, broken or uses another hash scheme.
+func checkDBs(dirs []string, store bool, scheme bloom.HashScheme, out io.Writer) bool {
+	ok := true
+
+	report := func(path string, stats bloom.Stats, err error) {
+		if err != nil {
+			fmt.Fprintf(out, "%s: FAIL: %s\n", path, err)
+			ok = false
+			return
+		}
+
+		status := "ok"
+		if stats.Saturated() {
+			status = "SATURATED"
+			ok = false
+		}
+
+		fmt.Fprintf(out, "%s: %s, load %.2f%%, max %d\n", path, status, stats.Load*100, stats.Max)
+	}
+
+	for _, dir := range dirs {
+		if !store {
+			for _, name := range []string{"total", "ham", "spam"} {
+				path := filepath.Join(dir, name)
+
+				stats, err := bloom.CheckFile(path, scheme)
+				report(path, stats, err)
+			}
+
+			continue
+		}
+
+		path := filepath.Join(dir, "filters")
+
+		stats, err := bloom.CheckStore(path, scheme)
+		if err != nil {
+			report(path, bloom.Stats{}, err)
+			continue
+		}
+
+		for _, name := range []string{"total", "ham", "spam"} {
+			st, found := stats[name]
+			if !found {
+				report(path+":"+name, st, fmt.Errorf("missing from store"))
+				continue
+			}
+
+			report(path+":"+name, st, nil)
+		}
+	}
+
+	return ok
+}
+
+// recommendParams writes the dimensions that a filter needs to count ngrams it has never seen
+// with at most the error rate targetError, once distinct distinct ngrams have been trained, to
+// out, see bloom.RecommendParams. It also writes the error rate that the filters of this build
+// have for as many ngrams, since their dimensions are fixed at compile time.
+func recommendParams(distinct uint64, targetError float64, out io.Writer) {
+	size, numFuncs := bloom.RecommendParams(distinct, targetError)
+
+	// Each field is a uint32
+	fmt.Fprintf(out, "recommended for %d ngrams at an error rate of %g: %d rows of %d fields, %d MiB per filter\n",
+		distinct, targetError, numFuncs, size, uint64(size)*uint64(numFuncs)*4>>20)
+
+	size, numFuncs = bloom.Params()
+	fmt.Fprintf(out, "this build: %d rows of %d fields, %d MiB per filter, error rate %.4g for %d ngrams\n",
+		numFuncs, size, uint64(size)*uint64(numFuncs)*4>>20, bloom.ErrorRate(distinct), distinct)
+}
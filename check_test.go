@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mailfilter/bloom"
+)
+
+func TestCheckDBs(t *testing.T) {
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Run persists the filters once when ctx is done
+	for _, name := range []string{"total", "ham", "spam"} {
+		db, err := bloom.NewDB(dir, name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		db.Add([]byte("fnord"), 1)
+		db.Run(ctx)
+	}
+
+	var out bytes.Buffer
+
+	if !checkDBs([]string{dir}, false, bloom.HashFNV, &out) {
+		t.Fatalf("expected intact filters to pass the check:\n%s", out.String())
+	}
+
+	if strings.Count(out.String(), ": ok,") != 3 {
+		t.Errorf("expected a line for each filter, got:\n%s", out.String())
+	}
+
+	err := os.Truncate(filepath.Join(dir, "spam"), 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out.Reset()
+
+	if checkDBs([]string{dir}, false, bloom.HashFNV, &out) {
+		t.Fatalf("expected a truncated filter to fail the check:\n%s", out.String())
+	}
+
+	if !strings.Contains(out.String(), "spam: FAIL: file is truncated") {
+		t.Errorf("expected the truncated filter to be reported, got:\n%s", out.String())
+	}
+
+	out.Reset()
+
+	if checkDBs([]string{filepath.Join(dir, "missing")}, false, bloom.HashFNV, &out) {
+		t.Errorf("expected missing filters to fail the check:\n%s", out.String())
+	}
+}
+
+func TestRecommendParams(t *testing.T) {
+	var out bytes.Buffer
+
+	recommendParams(1_000_000, 0.01, &out)
+
+	for _, want := range []string{
+		"recommended for 1000000 ngrams at an error rate of 0.01: 7 rows of 1370423 fields, 36 MiB per filter\n",
+		"this build: 16 rows of 1000000 fields, 61 MiB per filter, error rate 0.0006498 for 1000000 ngrams\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the output, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCheckDBs_Scheme(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := bloom.OpenStore(filepath.Join(dir, "filters"), []string{"total", "ham", "spam"}, bloom.WithHashScheme(bloom.HashDouble))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s.DB("spam").Add([]byte("fnord"), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Run persists the store once when ctx is done
+	s.Run(ctx)
+
+	var out bytes.Buffer
+
+	if !checkDBs([]string{dir}, true, bloom.HashDouble, &out) {
+		t.Fatalf("expected a store with the right scheme to pass the check:\n%s", out.String())
+	}
+
+	out.Reset()
+
+	if checkDBs([]string{dir}, true, bloom.HashFNV, &out) {
+		t.Fatalf("expected a store with another scheme to fail the check:\n%s", out.String())
+	}
+
+	if !strings.Contains(out.String(), "filters: FAIL: uses hash scheme 1, not 0") {
+		t.Errorf("expected the scheme mismatch to be reported, got:\n%s", out.String())
+	}
+}
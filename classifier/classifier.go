@@ -1,13 +1,18 @@
 package classifier
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"math"
+	"sync"
 
 	"github.com/pkg/errors"
 
+	"mailfilter/features"
+	"mailfilter/logger"
 	"mailfilter/ntuple"
 )
 
@@ -27,16 +32,8 @@ func (w Word) HamLikelihood() float64 {
 
 	score := float64(w.Ham) / float64(w.Total)
 
-	if math.IsInf(score, 0) {
-		panic(fmt.Sprintf("infinite score for %v", w))
-	}
-
-	if math.IsNaN(score) {
-		panic(fmt.Sprintf("nan score for %v", w))
-	}
-
-	if score < 0 || score > 1 {
-		log.Printf("possibly corrupt database: score for {%q, %v, %v}: %f", w.Text, w.Total, w.Ham, score)
+	if math.IsNaN(score) || score < 0 || score > 1 {
+		logger.Errorf("possibly corrupt database: score for {%q, %v, %v}: %f", w.Text, w.Total, w.Ham, score)
 		score = 0.5
 	}
 
@@ -51,16 +48,8 @@ func (w Word) SpamLikelihood() float64 {
 
 	score := float64(w.Spam) / float64(w.Total)
 
-	if math.IsInf(score, 0) {
-		panic(fmt.Sprintf("infinite score for %v", w))
-	}
-
-	if math.IsNaN(score) {
-		panic(fmt.Sprintf("nan score for %v", w))
-	}
-
-	if score < 0 || score > 1 {
-		log.Printf("possibly corrupt database: score for {%q, %v, %v}: %f", w.Text, w.Total, w.Spam, score)
+	if math.IsNaN(score) || score < 0 || score > 1 {
+		logger.Errorf("possibly corrupt database: score for {%q, %v, %v}: %f", w.Text, w.Total, w.Spam, score)
 		score = 0.5
 	}
 
@@ -71,9 +60,40 @@ func (w Word) String() string {
 	return fmt.Sprintf("{%q %v %v → %.3f}", w.Text, w.Total, w.Spam, w.SpamLikelihood())
 }
 
+// A DB stores (approximate) counts of byte sequences. The classifier keeps one DB for all
+// messages and one for each class. Train calls Add and Untrain calls Remove for every window
+// of a message, Classify only calls Score.
 type DB interface {
 	Add([]byte, uint64)
-	Score([]byte) uint64 // (approximate) count of times that the sequences has been added to the db
+	Remove([]byte, uint64) // undoes Add, used to untrain messages
+	Score([]byte) uint64   // (approximate) count of times that the sequences has been added to the db
+}
+
+// A BatchDB is a DB that can look up the scores of many sequences at once, which is cheaper
+// than calling Score for each of them.
+type BatchDB interface {
+	DB
+	ScoreMany([][]byte) []uint64
+}
+
+// A ScalableDB is a DB that can scale down the count of a sequence, see WithDecayBefore.
+type ScalableDB interface {
+	DB
+	Scale([]byte, float64) // multiplies the count by a factor between 0 and 1, rounding down
+}
+
+// scoreMany returns the scores of words in db, using a single batched lookup if db supports it.
+func scoreMany(db DB, words [][]byte) []uint64 {
+	if b, ok := db.(BatchDB); ok {
+		return b.ScoreMany(words)
+	}
+
+	scores := make([]uint64, len(words))
+	for i, w := range words {
+		scores[i] = db.Score(w)
+	}
+
+	return scores
 }
 
 type Classifier struct {
@@ -85,10 +105,258 @@ type Classifier struct {
 	thresholdSpam   float64
 
 	windowSize int
+
+	// shingles, if set, is the number of words that texts are split into instead of windows.
+	// If shouting is set as well, words in upper case add the token features.Shouting.
+	shingles int
+	shouting bool
+
+	sigmoid Sigmoid
+
+	// bands label the scores of messages, in order of increasing threshold
+	bands []LabelBand
+
+	// normalize is the number of windows that each trained text counts as, regardless of its
+	// length. If it is 0, every window counts fully.
+	normalize uint64
+
+	// dedup makes training count each distinct window of a text only once
+	dedup bool
+
+	// Windows of ham and spam are trained with the learn factor multiplied by these weights
+	hamWeight  uint64
+	spamWeight uint64
+
+	// If featureTokens is set, URLs and email addresses are replaced with feature tokens before
+	// texts are split, followed by their domains if featureDomains is set as well
+	featureTokens  bool
+	featureDomains bool
+
+	// decay is the fraction by which the counts of a window are decayed before it is trained
+	decay float64
+
+	// Texts with fewer than minTokens windows are labeled insufficientLabel
+	minTokens         int
+	insufficientLabel string
+
+	// tokenKey, if set, is the key that windows are hashed with before they are stored
+	tokenKey []byte
+
+	// maxDocFreq, if set, is the fraction of the trained documents above which the total count
+	// of a window makes classification skip it
+	maxDocFreq float64
+
+	// classPrior makes classification start from the ratio of trained ham and spam documents
+	classPrior bool
+
+	// documents counts the texts that were trained as spam and ham
+	documents DocumentCounter
+}
+
+// A DocumentCounter counts the texts that a Classifier was trained with as spam and as ham. The
+// counts are kept apart from the databases, where they would share counters with windows. It
+// has to be safe for concurrent use.
+type DocumentCounter interface {
+	AddDocuments(spam bool, n uint64)
+	RemoveDocuments(spam bool, n uint64) // undoes AddDocuments, counts don't go below 0
+	Documents() (spam, ham uint64)
+}
+
+// MemoryDocuments is a DocumentCounter that keeps the counts in memory. The zero value counts no
+// documents and is ready to use.
+type MemoryDocuments struct {
+	mu        sync.Mutex
+	spam, ham uint64
+}
+
+// AddDocuments adds n to the count of spam or ham documents.
+func (d *MemoryDocuments) AddDocuments(spam bool, n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if spam {
+		d.spam += n
+	} else {
+		d.ham += n
+	}
+}
+
+// RemoveDocuments subtracts n from the count of spam or ham documents, stopping at 0.
+func (d *MemoryDocuments) RemoveDocuments(spam bool, n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := &d.ham
+	if spam {
+		count = &d.spam
+	}
+
+	if *count < n {
+		*count = 0
+	} else {
+		*count -= n
+	}
+}
+
+// Documents returns the number of spam and ham documents.
+func (d *MemoryDocuments) Documents() (spam, ham uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.spam, d.ham
+}
+
+// Set replaces the counts of spam and ham documents.
+func (d *MemoryDocuments) Set(spam, ham uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.spam, d.ham = spam, ham
+}
+
+// InsufficientData is the label that WithMinTokens suggests for texts that are too short to
+// classify.
+const InsufficientData = "insufficient-data"
+
+// An Option configures a Classifier.
+type Option func(*Classifier)
+
+// WithSigmoid makes a Classifier use the given sigmoid instead of DefaultSigmoid.
+func WithSigmoid(s Sigmoid) Option {
+	return func(c *Classifier) {
+		c.sigmoid = s
+	}
+}
+
+// WithLabels makes a Classifier label messages according to bands, instead of labeling them as
+// "ham", "unsure" and "spam" according to the thresholds passed to New.
+func WithLabels(bands []LabelBand) Option {
+	return func(c *Classifier) {
+		c.bands = append([]LabelBand(nil), bands...)
+	}
+}
+
+// WithNormalizedTraining makes a Classifier train and untrain each text as if it had the given
+// number of windows, so that long texts don't outweigh short ones. The learn factor is scaled
+// accordingly for each window.
+func WithNormalizedTraining(windows uint64) Option {
+	return func(c *Classifier) {
+		c.normalize = windows
+	}
+}
+
+// WithDedupedTraining makes a Classifier train and untrain each distinct window of a text only
+// once, no matter how often it is repeated. This counts which windows are present in a text
+// rather than how often they occur, so that repeating a phrase doesn't make it dominate.
+func WithDedupedTraining() Option {
+	return func(c *Classifier) {
+		c.dedup = true
+	}
+}
+
+// WithTrainingWeights makes a Classifier multiply the learn factor by ham when training and
+// untraining ham, and by spam for spam. Since false positives are usually more costly than false
+// negatives, a higher weight for ham makes the classifier more cautious about labeling texts as
+// spam. Both weights default to 1. Texts have to be untrained with the weights they were trained
+// with.
+func WithTrainingWeights(ham, spam uint64) Option {
+	return func(c *Classifier) {
+		c.hamWeight = ham
+		c.spamWeight = spam
+	}
+}
+
+// WithFeatureTokens makes a Classifier replace URLs and email addresses in texts with the feature
+// tokens of package features before splitting them, so that they add to the same few windows
+// instead of each being new. If keepDomains is set, their domains are kept as well, so that
+// domains that only show up in spam or ham can still be learned. Texts have to be classified with
+// the same setting they were trained with.
+func WithFeatureTokens(keepDomains bool) Option {
+	return func(c *Classifier) {
+		c.featureTokens = true
+		c.featureDomains = keepDomains
+	}
+}
+
+// WithDecayBefore makes a Classifier decay the counts of each window by the given rate, between 0
+// and 1, in all databases before training it. Recent training then outweighs older training of
+// the same windows, like a learning rate, so that the classifier adapts faster when the texts it
+// sees change. Counts are rounded down, and untraining a text doesn't undo the decay. All
+// databases have to be ScalableDBs.
+func WithDecayBefore(rate float64) Option {
+	return func(c *Classifier) {
+		c.decay = rate
+	}
+}
+
+// WithMinTokens makes a Classifier label texts that have fewer than n windows with label instead
+// of labeling them by their score. Without enough windows, the score of a text says little: one
+// without any windows scores 0.5 and would be labeled as "unsure". Passing InsufficientData as
+// label makes such texts stand out, passing "ham" lets them through.
+func WithMinTokens(n int, label string) Option {
+	return func(c *Classifier) {
+		c.minTokens = n
+		c.insufficientLabel = label
+	}
+}
+
+// WithWordShingles makes a Classifier split texts into runs of n consecutive words instead of
+// windows of bytes, see ntuple.ShingleReader. Shingles don't match across word boundaries, so a
+// trained word doesn't make longer words that contain it look alike. The window size passed to
+// New is ignored then.
+func WithWordShingles(n int) Option {
+	return func(c *Classifier) {
+		c.shingles = n
+	}
+}
+
+// WithShouting makes a Classifier that splits texts into word shingles add the token
+// features.Shouting for each word in upper case, since shingles are in lower case and would lose
+// that words were shouted otherwise. It has no effect on windows, which keep the case of texts.
+func WithShouting() Option {
+	return func(c *Classifier) {
+		c.shouting = true
+	}
+}
+
+// WithMaxDocumentFrequency makes a Classifier skip windows whose total count is above fraction
+// times the number of trained documents when classifying, like stop words. Windows that show up
+// in nearly every text have likelihoods close to the ratio of spam and ham that was trained, and
+// only add noise. Since a window that shows up several times in a text is counted each time, and
+// texts are counted with their learn factors, this is an approximation of the document
+// frequency. Texts that were trained before documents were counted don't count, so databases
+// that were trained before have to be trained from scratch.
+func WithMaxDocumentFrequency(fraction float64) Option {
+	return func(c *Classifier) {
+		c.maxDocFreq = fraction
+	}
 }
 
-func New(dbTotal, dbHam, dbSpam DB, thresholdUnsure, thresholdSpam float64, windowSize int) *Classifier {
-	return &Classifier{
+// WithDocumentCounter makes a Classifier count the texts it is trained with in documents instead
+// of in memory, for example to persist the counts along with the databases.
+func WithDocumentCounter(documents DocumentCounter) Option {
+	return func(c *Classifier) {
+		c.documents = documents
+	}
+}
+
+// WithClassPrior makes a Classifier start the η of each text from the logarithm of the ratio of
+// ham and spam documents it was trained with, instead of 0, so that a text without known windows
+// is labeled by how common spam and ham are. The prior is only applied once both spam and ham
+// have been trained.
+func WithClassPrior() Option {
+	return func(c *Classifier) {
+		c.classPrior = true
+	}
+}
+
+// New returns a Classifier that uses the given databases. It panics if the sigmoid passed with
+// WithSigmoid or the bands passed with WithLabels are not valid, if WithMinTokens is passed an
+// empty label, if WithTrainingWeights is passed a weight of 0, if WithDecayBefore is passed a
+// rate outside of [0, 1) or databases that can't be scaled or if WithMaxDocumentFrequency is
+// passed a fraction outside of [0, 1].
+func New(dbTotal, dbHam, dbSpam DB, thresholdUnsure, thresholdSpam float64, windowSize int, opts ...Option) *Classifier {
+	c := &Classifier{
 		dbTotal: dbTotal,
 		dbSpam:  dbSpam,
 		dbHam:   dbHam,
@@ -97,10 +365,93 @@ func New(dbTotal, dbHam, dbSpam DB, thresholdUnsure, thresholdSpam float64, wind
 		thresholdSpam:   thresholdSpam,
 
 		windowSize: windowSize,
+
+		hamWeight:  1,
+		spamWeight: 1,
+
+		sigmoid: DefaultSigmoid,
+
+		documents: &MemoryDocuments{},
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	err := c.sigmoid.Validate()
+	if err != nil {
+		panic(err)
+	}
+
+	if c.bands == nil {
+		c.bands = DefaultBands(thresholdUnsure, thresholdSpam)
+	} else if err := ValidateBands(c.bands); err != nil {
+		panic(err)
+	}
+
+	if c.minTokens > 0 && c.insufficientLabel == "" {
+		panic("no label for texts with too few windows")
+	}
+
+	if c.hamWeight == 0 || c.spamWeight == 0 {
+		panic("training weights must be at least 1")
+	}
+
+	if c.decay < 0 || c.decay >= 1 {
+		panic("decay rate must be at least 0 and below 1")
+	}
+
+	if c.maxDocFreq < 0 || c.maxDocFreq > 1 {
+		panic("maximum document frequency must be between 0 and 1")
 	}
+
+	if c.decay > 0 {
+		for _, db := range []DB{c.dbTotal, c.dbSpam, c.dbHam} {
+			if _, ok := db.(ScalableDB); !ok {
+				panic("decaying training needs databases that can be scaled")
+			}
+		}
+	}
+
+	if len(c.tokenKey) > 0 {
+		c.dbTotal = &keyedDB{db: c.dbTotal, key: c.tokenKey}
+		c.dbSpam = &keyedDB{db: c.dbSpam, key: c.tokenKey}
+		c.dbHam = &keyedDB{db: c.dbHam, key: c.tokenKey}
+	}
+
+	return c
+}
+
+// Sigmoid returns the sigmoid that c uses.
+func (c *Classifier) Sigmoid() Sigmoid {
+	return c.sigmoid
+}
+
+// Thresholds returns the thresholds for "unsure" and "spam" that were passed to New. Unless c was
+// created with WithLabels, messages with scores above them are labeled accordingly.
+func (c *Classifier) Thresholds() (unsure, spam float64) {
+	return c.thresholdUnsure, c.thresholdSpam
+}
+
+// WindowSize returns the length of the windows that c splits texts into, or 0 if c splits them
+// into word shingles.
+func (c *Classifier) WindowSize() int {
+	if c.shingles > 0 {
+		return 0
+	}
+
+	return c.windowSize
 }
 
-func (c *Classifier) getWord(word []byte) (Word, error) {
+// Labels returns the bands that c labels messages with.
+func (c *Classifier) Labels() []LabelBand {
+	return append([]LabelBand(nil), c.bands...)
+}
+
+// LookupWord returns the counts that c has stored for word. Only words that are exactly as long
+// as the windows of c have been trained, or, with word shingles, lower case runs of words that
+// are joined by single spaces and features.Shouting.
+func (c *Classifier) LookupWord(word []byte) (Word, error) {
 	w := Word{
 		Text:  word,
 		Total: c.dbTotal.Score(word),
@@ -111,12 +462,196 @@ func (c *Classifier) getWord(word []byte) (Word, error) {
 	return w, nil
 }
 
+// getWords looks up the counts of all words with one batched lookup per database.
+func (c *Classifier) getWords(words [][]byte) []Word {
+	total := scoreMany(c.dbTotal, words)
+	spam := scoreMany(c.dbSpam, words)
+	ham := scoreMany(c.dbHam, words)
+
+	result := make([]Word, len(words))
+	for i, w := range words {
+		result[i] = Word{
+			Text:  w,
+			Total: total[i],
+			Spam:  spam[i],
+			Ham:   ham[i],
+		}
+	}
+
+	return result
+}
+
 func (c *Classifier) Train(in io.Reader, spam bool, learnFactor uint64) error {
-	buf := make([]byte, c.windowSize)
-	reader := ntuple.New(in)
+	err := c.eachWindow(in, learnFactor, func(w []byte, factor uint64) error {
+		return c.trainWord(w, spam, factor)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.countDocument(spam, learnFactor, false)
+
+	return nil
+}
+
+// countDocument counts a text that was trained as spam or ham with learnFactor, or uncounts it if
+// it was untrained.
+func (c *Classifier) countDocument(spam bool, learnFactor uint64, untrain bool) {
+	if untrain {
+		c.documents.RemoveDocuments(spam, learnFactor*c.weight(spam))
+	} else {
+		c.documents.AddDocuments(spam, learnFactor*c.weight(spam))
+	}
+}
+
+// Documents returns the number of texts that c has been trained with as spam and as ham, each
+// counted with its learn factor and training weight like the windows of the text.
+func (c *Classifier) Documents() (spam, ham uint64) {
+	return c.documents.Documents()
+}
+
+// TrainBatch trains all texts received from msgs as spam or ham with the given learn factor, with
+// the given number of workers training texts in parallel. The databases of c have to be safe for
+// concurrent use. TrainBatch returns once msgs is closed and all texts are trained, or when ctx
+// is canceled. If training a text fails, the remaining texts are not trained, and the first
+// error is returned.
+func (c *Classifier) TrainBatch(ctx context.Context, msgs <-chan io.Reader, spam bool, factor uint64, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Canceled on the first error, to stop the other workers
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-workerCtx.Done():
+					return
+				case msg, ok := <-msgs:
+					if !ok {
+						return
+					}
+
+					err := c.Train(msg, spam, factor)
+					if err != nil {
+						once.Do(func() {
+							firstErr = errors.Wrap(err, "training message")
+							cancel()
+						})
+
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return ctx.Err()
+}
+
+// TrainSegments trains the segments of a text as spam or ham with the given learn factor. Each
+// segment is trained like a text of its own, with the zone of the segment prepended to its
+// windows. The weights of the segments only apply to classification and are ignored.
+func (c *Classifier) TrainSegments(segments []Segment, spam bool, learnFactor uint64) error {
+	for _, seg := range segments {
+		zone := seg.Zone
+
+		err := c.eachWindow(seg.Text, learnFactor, func(w []byte, factor uint64) error {
+			return c.trainWord(zoned(zone, w), spam, factor)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.countDocument(spam, learnFactor, false)
+
+	return nil
+}
+
+// UntrainSegments undoes TrainSegments.
+func (c *Classifier) UntrainSegments(segments []Segment, spam bool, learnFactor uint64) error {
+	for _, seg := range segments {
+		zone := seg.Zone
+
+		err := c.eachWindow(seg.Text, learnFactor, func(w []byte, factor uint64) error {
+			return c.untrainWord(zoned(zone, w), spam, factor)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.countDocument(spam, learnFactor, true)
+
+	return nil
+}
+
+// Untrain undoes training the text in as spam or ham with the given learn factor, for example
+// because it was trained with the wrong label.
+func (c *Classifier) Untrain(in io.Reader, spam bool, learnFactor uint64) error {
+	err := c.eachWindow(in, learnFactor, func(w []byte, factor uint64) error {
+		return c.untrainWord(w, spam, factor)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.countDocument(spam, learnFactor, true)
+
+	return nil
+}
+
+// eachWindow calls fn for each window of the text in, along with the factor it is trained with.
+// Unless c normalizes the length of texts, that is learnFactor for every window. Otherwise, the
+// text contributes learnFactor*c.normalize in total, which is spread as evenly over its windows
+// as integer counts allow. Windows of long texts then get a factor of 0 and are skipped. If c
+// dedups windows, repeated windows are skipped before that.
+func (c *Classifier) eachWindow(in io.Reader, learnFactor uint64, fn func([]byte, uint64) error) error {
+	next := c.tokens(in)
+
+	if c.normalize == 0 && !c.dedup {
+		for {
+			buf, err := next()
+			if err != nil && errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = fn(buf, learnFactor)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var windows [][]byte
+
+	seen := make(map[string]struct{})
 
 	for {
-		err := reader.Next(buf)
+		buf, err := next()
 		if err != nil && errors.Is(err, io.EOF) {
 			break
 		}
@@ -124,7 +659,42 @@ func (c *Classifier) Train(in io.Reader, spam bool, learnFactor uint64) error {
 			return err
 		}
 
-		err = c.trainWord(buf, spam, learnFactor)
+		if c.dedup {
+			if _, ok := seen[string(buf)]; ok {
+				continue
+			}
+
+			seen[string(buf)] = struct{}{}
+		}
+
+		windows = append(windows, buf)
+	}
+
+	if c.normalize == 0 {
+		for _, w := range windows {
+			err := fn(w, learnFactor)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Window i gets the difference between the shares of the first i+1 and the first i
+	// windows, so that the factors add up to the budget exactly.
+	budget := learnFactor * c.normalize
+	n := uint64(len(windows))
+
+	for i, w := range windows {
+		i := uint64(i)
+
+		factor := (i+1)*budget/n - i*budget/n
+		if factor == 0 {
+			continue
+		}
+
+		err := fn(w, factor)
 		if err != nil {
 			return err
 		}
@@ -133,8 +703,92 @@ func (c *Classifier) Train(in io.Reader, spam bool, learnFactor uint64) error {
 	return nil
 }
 
+// tokens returns a function that returns the next token of in on each call, either a window or a
+// word shingle. Each token is freshly allocated, so callers may keep it. The function returns
+// io.EOF once in is exhausted. If c uses feature tokens, in is read completely first.
+func (c *Classifier) tokens(in io.Reader) func() ([]byte, error) {
+	if c.featureTokens {
+		text, err := ioutil.ReadAll(in)
+		if err != nil {
+			return func() ([]byte, error) {
+				return nil, err
+			}
+		}
+
+		in = bytes.NewReader(features.Replace(text, c.featureDomains))
+	}
+
+	if c.shingles > 0 {
+		r := ntuple.NewShingles(in, c.shingles)
+		if c.shouting {
+			r.MarkShouting([]byte(features.Shouting))
+		}
+
+		return r.Next
+	}
+
+	reader := ntuple.New(in)
+
+	return func() ([]byte, error) {
+		buf := make([]byte, c.windowSize)
+
+		err := reader.Next(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	}
+}
+
+// Text returns the text of in that c takes tokens from, i.e. with URLs and email addresses
+// replaced if c uses feature tokens.
+func (c *Classifier) Text(in io.Reader) ([]byte, error) {
+	text, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading text")
+	}
+
+	if c.featureTokens {
+		text = features.Replace(text, c.featureDomains)
+	}
+
+	return text, nil
+}
+
+// weight returns the weight of training spam or ham, see WithTrainingWeights.
+func (c *Classifier) weight(spam bool) uint64 {
+	if spam {
+		return c.spamWeight
+	}
+
+	return c.hamWeight
+}
+
+// untrainWord undoes trainWord.
+func (c *Classifier) untrainWord(word []byte, spam bool, factor uint64) error {
+	factor *= c.weight(spam)
+
+	c.dbTotal.Remove(word, factor)
+	if spam {
+		c.dbSpam.Remove(word, factor)
+	} else {
+		c.dbHam.Remove(word, factor)
+	}
+
+	return nil
+}
+
 // trainWord classifies the given word as spam or not spam, training c for future recognition.
 func (c *Classifier) trainWord(word []byte, spam bool, factor uint64) error {
+	factor *= c.weight(spam)
+
+	if c.decay > 0 {
+		for _, db := range []DB{c.dbTotal, c.dbSpam, c.dbHam} {
+			db.(ScalableDB).Scale(word, 1-c.decay)
+		}
+	}
+
 	c.dbTotal.Add(word, factor)
 	if spam {
 		c.dbSpam.Add(word, factor)
@@ -145,54 +799,310 @@ func (c *Classifier) trainWord(word []byte, spam bool, factor uint64) error {
 	return nil
 }
 
-func sigmoid(x float64) float64 {
-	if x < 0 || x > 1 {
-		panic(fmt.Sprintf("x out of [0, 1]: %f", x))
+// A Sigmoid maps the ham and spam likelihoods of words to values that are strictly above 0 and
+// strictly below 1, so that their logarithms are finite. Its parameters shape how strongly the
+// likelihoods are pushed towards the extremes, which affects how much single words can sway the
+// result.
+//
+// Caveat: with a Max below 1 or a Midpoint above 0.5, the mapped value of 0.5 is below 0.5, so
+// the mapped likelihoods on their own lean towards ham. The original hard-coded sigmoid was
+// documented as biasing the classifier towards ham for that reason. η doesn't inherit the lean,
+// though: it only adds up the differences of the logarithms of the mapped ham and spam
+// likelihoods, so Max cancels out, a word with equal likelihoods contributes nothing, and
+// swapping the likelihoods of a word flips the sign of its contribution without changing its
+// size, whatever the parameters. Anything that uses mapped likelihoods individually has to
+// account for the lean itself.
+type Sigmoid struct {
+	// K is the steepness of the sigmoid. Larger values produce more extreme scores per word.
+	K float64
+
+	// Midpoint is the likelihood that is mapped to Max/2
+	Midpoint float64
+
+	// Max is the upper bound of the mapped values
+	Max float64
+}
+
+// DefaultSigmoid is the sigmoid that classifiers use unless New is called with WithSigmoid.
+var DefaultSigmoid = Sigmoid{K: 5, Midpoint: 0.5, Max: 1}
+
+// Validate returns an error if s would map likelihoods to values outside of (0, 1), or to values
+// whose logarithm is not finite.
+func (s Sigmoid) Validate() error {
+	if !(s.K > 0 && s.K <= 100) {
+		return errors.Errorf("sigmoid steepness %v out of (0, 100]", s.K)
+	}
+
+	if !(s.Midpoint >= 0 && s.Midpoint <= 1) {
+		return errors.Errorf("sigmoid midpoint %v out of [0, 1]", s.Midpoint)
+	}
+
+	if !(s.Max > 0 && s.Max <= 1) {
+		return errors.Errorf("sigmoid maximum %v out of (0, 1]", s.Max)
+	}
+
+	return nil
+}
+
+// apply maps the likelihood x. Values outside of [0, 1], which can only come from rounding errors
+// or a corrupt database, are clamped, since classifying a message should never crash the server.
+// NaN is treated like an unknown likelihood of 0.5.
+func (s Sigmoid) apply(x float64) float64 {
+	switch {
+	case math.IsNaN(x):
+		x = 0.5
+	case x < 0:
+		x = 0
+	case x > 1:
+		x = 1
 	}
 
-	midpoint := 0.5
-	max := 1.0
-	k := 5.0
+	return s.Max / (1.0 + math.Exp(-s.K*(x-s.Midpoint)))
+}
 
-	return max / (1.0 + math.Exp(-k*(x-midpoint)))
+// A LabelBand labels messages with a score above Threshold with Label, unless the score is also
+// above the threshold of the next band.
+type LabelBand struct {
+	Threshold float64
+	Label     string
+}
+
+// DefaultBands returns the bands that label messages as "ham", as "unsure" if their score is
+// above thresholdUnsure and as "spam" if it is above thresholdSpam.
+func DefaultBands(thresholdUnsure, thresholdSpam float64) []LabelBand {
+	return []LabelBand{
+		{Threshold: 0, Label: "ham"},
+		{Threshold: thresholdUnsure, Label: "unsure"},
+		{Threshold: thresholdSpam, Label: "spam"},
+	}
+}
+
+// ValidateBands returns an error if bands can't label all scores unambiguously: there has to be
+// at least one band, the first one has to start at 0, thresholds have to increase strictly and
+// stay below 1, and every band needs a label.
+func ValidateBands(bands []LabelBand) error {
+	if len(bands) == 0 {
+		return errors.New("no label bands")
+	}
+
+	if bands[0].Threshold != 0 {
+		return errors.Errorf("first label band %q starts at %v instead of 0", bands[0].Label, bands[0].Threshold)
+	}
+
+	for i, b := range bands {
+		if b.Label == "" {
+			return errors.Errorf("label band %d at %v has no label", i, b.Threshold)
+		}
+
+		if !(b.Threshold < 1) {
+			return errors.Errorf("label band %q starts at %v, which is not below 1", b.Label, b.Threshold)
+		}
+
+		if i > 0 && !(b.Threshold > bands[i-1].Threshold) {
+			return errors.Errorf("label band %q at %v doesn't start above %q at %v", b.Label, b.Threshold, bands[i-1].Label, bands[i-1].Threshold)
+		}
+	}
+
+	return nil
+}
+
+// label returns the label of the band that score falls into.
+func (c *Classifier) label(score float64) string {
+	return LabelFor(c.bands, score)
+}
+
+// Relabel returns the label of res according to bands instead of the label bands of c. Texts
+// with too few windows keep their label, see WithMinTokens. bands must be valid, see
+// ValidateBands.
+func (c *Classifier) Relabel(res Result, bands []LabelBand) string {
+	if res.Tokens < c.minTokens {
+		return res.Label
+	}
+
+	return LabelFor(bands, res.Score)
+}
+
+// LabelFor returns the label of the last band in bands whose threshold score is above, or the
+// label of the first band if there is none. bands must be valid, see ValidateBands.
+func LabelFor(bands []LabelBand, score float64) string {
+	label := bands[0].Label
+
+	for _, b := range bands[1:] {
+		if score > b.Threshold {
+			label = b.Label
+		}
+	}
+
+	return label
 }
 
 type Result struct {
 	Label string
-	Score float64
-	Eta   float64
-	Min   float64
-	Max   float64
+	Score float64 // probability that the message is spam
+
+	// HamScore is the probability that the message is ham. It is 1-Score, but computed on its
+	// own so that it doesn't lose precision when Score is close to 1.
+	HamScore float64
+
+	Eta float64
+	Min float64
+	Max float64
+
+	// Tokens is the number of windows that were scored
+	Tokens int
+
+	// Components holds the results of the members of a MetaClassifier, in order
+	Components []Result
 }
 
 func (c Result) String() string {
-	return fmt.Sprintf("label=%q, score=%.6f, η=%.3f [%.4f, %.4f]", c.Label, c.Score, c.Eta, c.Min, c.Max)
+	return fmt.Sprintf("label=%q, score=%.6f, ham=%.6f, η=%.3f [%.4f, %.4f]", c.Label, c.Score, c.HamScore, c.Eta, c.Min, c.Max)
+}
+
+// Certainty returns which way c leans and how certain it is about that, regardless of the
+// thresholds: "spam" and Score if the message is more likely spam, "ham" and HamScore if it is
+// more likely ham, or "neutral" and 0.5 if it is neither.
+func (c Result) Certainty() (string, float64) {
+	switch {
+	case c.Score > c.HamScore:
+		return "spam", c.Score
+	case c.HamScore > c.Score:
+		return "ham", c.HamScore
+	default:
+		return "neutral", 0.5
+	}
+}
+
+// A Segment is a piece of text that is tokenized on its own and whose contribution to the
+// classification result is multiplied by Weight.
+type Segment struct {
+	Text   io.Reader
+	Weight float64
+
+	// Zone, if not empty, is prepended to each window of the segment, so that windows from
+	// different parts of a text, like "H:" for headers and "B:" for the body, are counted
+	// separately.
+	Zone string
+}
+
+// zoned returns w prefixed with zone.
+func zoned(zone string, w []byte) []byte {
+	if zone == "" {
+		return w
+	}
+
+	return append([]byte(zone), w...)
 }
 
 // Classify classifies the given text and returns a label along with a "certainty" value for that label.
 func (c *Classifier) Classify(text io.Reader, verbose io.Writer) (Result, error) {
-	reader := ntuple.New(text)
+	return c.ClassifySegments([]Segment{{Text: text, Weight: 1}}, verbose)
+}
 
-	buf := make([]byte, c.windowSize)
+// ClassifySegments works like Classify, but takes a number of independently tokenized segments
+// of a text, each of which contributes to the result according to its weight.
+func (c *Classifier) ClassifySegments(segments []Segment, verbose io.Writer) (Result, error) {
+	if verbose == nil {
+		return c.ClassifyTraced(segments, nil)
+	}
 
-	var eta float64
+	result, err := c.ClassifyTraced(segments, verboseTrace(verbose))
+	if err != nil {
+		return Result{}, err
+	}
 
-	min := math.Inf(1)
-	max := math.Inf(-1)
+	fmt.Fprintln(verbose, "final η:", result.Eta, "min η:", result.Min, "max η:", result.Max)
+
+	return result, nil
+}
+
+// ClassifyTraced works like ClassifySegments, but instead of writing details about the
+// classification to a writer, it calls trace with a record for each window that is scored, in
+// order. trace may be nil.
+func (c *Classifier) ClassifyTraced(segments []Segment, trace func(TraceRecord)) (Result, error) {
+	result := Result{
+		Min: math.Inf(1),
+		Max: math.Inf(-1),
+	}
+
+	spamDocs, hamDocs := c.Documents()
+
+	if c.classPrior && spamDocs > 0 && hamDocs > 0 {
+		result.Eta = math.Log(float64(hamDocs) / float64(spamDocs))
+	}
+
+	// Windows with a total count above maxTotal are skipped, see WithMaxDocumentFrequency
+	var maxTotal float64
+	if c.maxDocFreq > 0 {
+		maxTotal = c.maxDocFreq * float64(spamDocs+hamDocs)
+	}
+
+	for _, seg := range segments {
+		err := c.classifySegment(seg, maxTotal, trace, &result)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	result.Score = 1.0 / (1.0 + math.Exp(result.Eta))
+	if math.IsNaN(result.Score) || math.IsInf(result.Score, 0) {
+		return Result{}, errors.Errorf("bad score %f for η %f", result.Score, result.Eta)
+	}
+
+	result.HamScore = 1.0 / (1.0 + math.Exp(-result.Eta))
+
+	result.Label = c.label(result.Score)
+	if result.Tokens < c.minTokens {
+		result.Label = c.insufficientLabel
+	}
+
+	return result, nil
+}
+
+// classifySegment adds the weighted contribution of seg to the η of result, updating its minimum
+// and maximum along the way. Windows with a total count above maxTotal are skipped, unless it is
+// 0. If trace is not nil, it is called for each window that isn't skipped.
+func (c *Classifier) classifySegment(seg Segment, maxTotal float64, trace func(TraceRecord), result *Result) error {
+	next := c.tokens(seg.Text)
+
+	// Collect the unique windows of the segment first, so that their counts can be looked up
+	// in one go.
+	var (
+		windows [][]byte
+		seq     []int
+	)
+
+	seen := make(map[string]int)
 
 	for {
-		err := reader.Next(buf)
+		buf, err := next()
 		if err != nil && errors.Is(err, io.EOF) {
 			break
 		}
 		if err != nil {
-			log.Println("reading input:", err)
+			logger.Errorf("reading input: %s", err)
 			break
 		}
 
-		word, err := c.getWord(buf)
-		if err != nil {
-			return Result{}, errors.Wrap(err, "getting word counts")
+		buf = zoned(seg.Zone, buf)
+
+		idx, ok := seen[string(buf)]
+		if !ok {
+			idx = len(windows)
+			seen[string(buf)] = idx
+			windows = append(windows, buf)
+		}
+
+		seq = append(seq, idx)
+	}
+
+	words := c.getWords(windows)
+
+	for _, idx := range seq {
+		word := words[idx]
+
+		if maxTotal > 0 && float64(word.Total) > maxTotal {
+			continue
 		}
 
 		pSpam := word.SpamLikelihood()
@@ -200,63 +1110,55 @@ func (c *Classifier) Classify(text io.Reader, verbose io.Writer) (Result, error)
 
 		// Pass scores through a tuned sigmoid so that they stay strictly above 0 and
 		// strictly below 1. This makes calculating with the inverse a bit easier, at
-		// the expense of never returning an absolute verdict, and slightly biasing
-		// towards detecting stuff as ham, since sigmoid(0.5) < 0.5.
+		// the expense of never returning an absolute verdict. See Sigmoid for why this
+		// doesn't bias the result towards ham.
 
-		l1 := math.Log(sigmoid(pHam))
-		l2 := math.Log(sigmoid(pSpam))
+		l1 := math.Log(c.sigmoid.apply(pHam))
+		l2 := math.Log(c.sigmoid.apply(pSpam))
 
 		if math.IsNaN(l1) || math.IsInf(l1, 0) {
-			panic(fmt.Sprintf("l1: %f %f", l1, pHam))
+			return errors.Errorf("bad l1 %f for %s: ham likelihood %f", l1, word, pHam)
 		}
 
 		if math.IsNaN(l2) || math.IsInf(l2, 0) {
-			panic(fmt.Sprintf("l2: %f %f", l2, pSpam))
+			return errors.Errorf("bad l2 %f for %s: spam likelihood %f", l2, word, pSpam)
 		}
 
-		eta += l1 - l2
+		result.Eta += seg.Weight * (l1 - l2)
+		result.Tokens++
 
-		if min > eta {
-			min = eta
+		if result.Min > result.Eta {
+			result.Min = result.Eta
 		}
 
-		if max < eta {
-			max = eta
+		if result.Max < result.Eta {
+			result.Max = result.Eta
 		}
 
-		if math.IsNaN(eta) || math.IsInf(eta, 0) {
-			panic(fmt.Sprintf("eta: %f", eta))
+		if math.IsNaN(result.Eta) || math.IsInf(result.Eta, 0) {
+			return errors.Errorf("bad η %f after %s: l1 %f, l2 %f, weight %g", result.Eta, word, l1, l2, seg.Weight)
 		}
 
-		if verbose != nil {
-			fmt.Fprintf(verbose, "%s: %f/%f, l:[%f - %f = %f], η:%f, current score:%f\n", word, pHam, pSpam, l1, l2, l1-l2, eta, 1.0/(1.0+math.Exp(eta)))
-		}
-	}
+		if trace != nil {
+			trace(TraceRecord{
+				Token:  string(word.Text),
+				Weight: seg.Weight,
 
-	if verbose != nil {
-		fmt.Fprintln(verbose, "final η:", eta, "min η:", min, "max η:", max)
-	}
+				Total: word.Total,
+				Ham:   word.Ham,
+				Spam:  word.Spam,
 
-	score := 1.0 / (1.0 + math.Exp(eta))
-	if math.IsNaN(score) || math.IsInf(score, 0) {
-		panic(fmt.Sprintf("score: %f", score))
-	}
+				HamLikelihood:  pHam,
+				SpamLikelihood: pSpam,
 
-	result := Result{
-		Score: score,
-		Label: "ham",
-		Eta:   eta,
-		Max:   max,
-		Min:   min,
-	}
+				L1: l1,
+				L2: l2,
 
-	if result.Score > c.thresholdUnsure {
-		result.Label = "unsure"
-	}
-
-	if result.Score > c.thresholdSpam {
-		result.Label = "spam"
+				Eta:   result.Eta,
+				Score: 1.0 / (1.0 + math.Exp(result.Eta)),
+			})
+		}
 	}
 
-	return result, nil
+	return nil
 }
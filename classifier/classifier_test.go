@@ -3,11 +3,16 @@ package classifier
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"mailfilter/bloom"
+	"mailfilter/features"
 	"math"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -86,6 +91,17 @@ func (t *testDB) Remove(w []byte, factor uint64) {
 	}
 }
 
+func (t *testDB) Scale(w []byte, factor float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.m == nil {
+		t.m = make(map[string]uint64)
+	}
+
+	t.m[string(w)] = uint64(float64(t.m[string(w)]) * factor)
+}
+
 func (t *testDB) Score(w []byte) uint64 {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -126,6 +142,54 @@ func TestClassifier_TrainSimple(t *testing.T) {
 	t.Logf("classifier: %#v", c)
 }
 
+func TestClassifier_Untrain(t *testing.T) {
+	dbTotal := &testDB{}
+	dbSpam := &testDB{}
+	dbHam := &testDB{}
+
+	c := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize)
+
+	err := c.Train(bytes.NewBufferString("this is ham"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	snapshot := func() [3]map[string]uint64 {
+		var s [3]map[string]uint64
+		for i, db := range []*testDB{dbTotal, dbSpam, dbHam} {
+			s[i] = make(map[string]uint64)
+			for k, v := range db.m {
+				if v != 0 {
+					s[i][k] = v
+				}
+			}
+		}
+
+		return s
+	}
+
+	baseline := snapshot()
+
+	// Accidentally train a ham message as spam, then undo it
+	err = c.Train(bytes.NewBufferString("this is also ham"), true, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fmt.Sprint(baseline) == fmt.Sprint(snapshot()) {
+		t.Fatalf("training didn't change the databases")
+	}
+
+	err = c.Untrain(bytes.NewBufferString("this is also ham"), true, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fmt.Sprint(baseline) != fmt.Sprint(snapshot()) {
+		t.Errorf("databases didn't return to baseline:\nwant: %v\nhave: %v", baseline, snapshot())
+	}
+}
+
 func TestClassifier_Train(t *testing.T) {
 	// First, test training
 	words := []struct {
@@ -201,7 +265,7 @@ func TestClassifier_Train(t *testing.T) {
 
 	// Verify that the recorded spamminess is correct
 	for i, w := range words {
-		word, err := c.getWord([]byte(w.word))
+		word, err := c.LookupWord([]byte(w.word))
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
@@ -334,7 +398,7 @@ func TestSigmoid(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("%f", tc.x), func(t *testing.T) {
-			s := sigmoid(tc.x)
+			s := DefaultSigmoid.apply(tc.x)
 
 			if s <= 0 {
 				t.Errorf("sigmoid too low for %f: %f", tc.x, s)
@@ -347,6 +411,965 @@ func TestSigmoid(t *testing.T) {
 	}
 }
 
+func TestSigmoid_OutOfRange(t *testing.T) {
+	testCases := []struct {
+		x    float64
+		want float64
+	}{
+		{-1e-9, DefaultSigmoid.apply(0)},
+		{1 + 1e-9, DefaultSigmoid.apply(1)},
+		{math.NaN(), DefaultSigmoid.apply(0.5)},
+	}
+
+	for _, tc := range testCases {
+		s := DefaultSigmoid.apply(tc.x)
+
+		if s <= 0 || s >= 1 {
+			t.Errorf("sigmoid out of (0, 1) for %g: %f", tc.x, s)
+		}
+
+		if s != tc.want {
+			t.Errorf("expected %f for %g, got %f", tc.want, tc.x, s)
+		}
+	}
+}
+
+func TestSigmoid_HamBias(t *testing.T) {
+	s := Sigmoid{K: 5, Midpoint: 0.7, Max: 0.8}
+
+	if s.apply(0.5) >= 0.5 {
+		t.Fatalf("expected %+v to map 0.5 below 0.5, got %f", s, s.apply(0.5))
+	}
+
+	// The mapped likelihoods lean towards ham, but the scores don't
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithSigmoid(s))
+
+	for _, tc := range []struct {
+		text string
+		spam bool
+	}{{"cheap pills", true}, {"lunch today", false}, {"see you", true}, {"see you", false}} {
+		err := c.Train(bytes.NewBufferString(tc.text), tc.spam, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	res, err := c.Classify(bytes.NewBufferString("see you"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Score != 0.5 {
+		t.Errorf("expected words trained as spam and ham alike to score 0.5, got %s", res)
+	}
+
+	spam, err := c.Classify(bytes.NewBufferString("cheap pills"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ham, err := c.Classify(bytes.NewBufferString("lunch today"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if math.Abs(spam.Score+ham.Score-1) > 1e-9 {
+		t.Errorf("expected spam and ham trained alike to score symmetrically, got %s and %s", spam, ham)
+	}
+}
+
+func TestClassifier_SigmoidSteepness(t *testing.T) {
+	dbTotal := &testDB{}
+	dbSpam := &testDB{}
+	dbHam := &testDB{}
+
+	gentle := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize)
+	steep := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize, WithSigmoid(Sigmoid{K: 10, Midpoint: 0.5, Max: 1}))
+
+	err := gentle.Train(bytes.NewBufferString("cheap pills"), true, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = gentle.Train(bytes.NewBufferString("cheap lunch"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, text := range []string{"cheap pills", "cheap lunch"} {
+		g, err := gentle.Classify(bytes.NewBufferString(text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		s, err := steep.Classify(bytes.NewBufferString(text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if math.Abs(s.Eta) <= math.Abs(g.Eta) {
+			t.Errorf("%q: expected larger k to produce a more extreme η, got %f for k=5 and %f for k=10", text, g.Eta, s.Eta)
+		}
+	}
+}
+
+func TestSigmoid_Validate(t *testing.T) {
+	if err := DefaultSigmoid.Validate(); err != nil {
+		t.Errorf("unexpected error for default sigmoid: %s", err)
+	}
+
+	for _, s := range []Sigmoid{
+		{K: 0, Midpoint: 0.5, Max: 1},
+		{K: 1000, Midpoint: 0.5, Max: 1},
+		{K: 5, Midpoint: -1, Max: 1},
+		{K: 5, Midpoint: 0.5, Max: 0},
+		{K: 5, Midpoint: 0.5, Max: 2},
+		{K: math.NaN(), Midpoint: 0.5, Max: 1},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("expected error for %+v", s)
+		}
+	}
+}
+
+func TestClassifier_BadValues(t *testing.T) {
+	// A sigmoid this steep rounds to exactly 0 for likelihoods of 0, which New refuses, so
+	// it is set directly to get the logarithms to blow up.
+	steep := Sigmoid{K: 2000, Midpoint: 0.5, Max: 1}
+
+	testCases := []struct {
+		name    string
+		spam    bool
+		sigmoid Sigmoid
+		weight  float64
+		want    string
+	}{
+		{"l1", true, steep, 1, "bad l1"},
+		{"l2", false, steep, 1, "bad l2"},
+		{"eta", true, DefaultSigmoid, math.MaxFloat64, "bad η"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize)
+
+			err := c.Train(bytes.NewBufferString("cheap pills"), tc.spam, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			c.sigmoid = tc.sigmoid
+
+			_, err = c.ClassifySegments([]Segment{{Text: bytes.NewBufferString("cheap pills"), Weight: tc.weight}}, nil)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			if !strings.Contains(err.Error(), tc.want) || !strings.Contains(err.Error(), `"chea"`) {
+				t.Errorf("expected %q and the offending word in the error, got %q", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestClassifier_LabelBands(t *testing.T) {
+	bands := []LabelBand{
+		{Threshold: 0, Label: "clean"},
+		{Threshold: 0.4, Label: "suspect"},
+		{Threshold: 0.6, Label: "likely-spam"},
+		{Threshold: 0.9, Label: "definitely-spam"},
+	}
+
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithLabels(bands))
+
+	testCases := []struct {
+		score float64
+		want  string
+	}{
+		{0, "clean"},
+		{0.2, "clean"},
+		{0.4, "clean"},
+		{0.41, "suspect"},
+		{0.6, "suspect"},
+		{0.75, "likely-spam"},
+		{0.9, "likely-spam"},
+		{0.95, "definitely-spam"},
+		{1, "definitely-spam"},
+	}
+
+	for _, tc := range testCases {
+		if got := c.label(tc.score); got != tc.want {
+			t.Errorf("expected %q for score %v, got %q", tc.want, tc.score, got)
+		}
+	}
+
+	// An unknown text scores 0.5
+	res, err := c.Classify(bytes.NewBufferString("never seen before"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "suspect" {
+		t.Errorf("expected unknown text to be labeled suspect, got %s", res)
+	}
+}
+
+func TestResult_Certainty(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize)
+
+	err := c.Train(strings.NewReader("cheap pills online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = c.Train(strings.NewReader("lunch tomorrow"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		text       string
+		expectLean string
+	}{
+		{"cheap pills", "spam"},
+		{"lunch tomorrow", "ham"},
+		{"never seen before", "neutral"},
+	}
+
+	for _, tc := range testCases {
+		res, err := c.Classify(strings.NewReader(tc.text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if math.Abs(res.Score+res.HamScore-1) > 1e-9 {
+			t.Errorf("expected scores of %q to add up to 1, got %s", tc.text, res)
+		}
+
+		lean, certainty := res.Certainty()
+		if lean != tc.expectLean {
+			t.Errorf("expected %q to lean %s, got %s with %s", tc.text, tc.expectLean, lean, res)
+		}
+
+		if want := math.Max(res.Score, res.HamScore); certainty != want {
+			t.Errorf("expected certainty %v for %q, got %v", want, tc.text, certainty)
+		}
+
+		if !strings.Contains(res.String(), fmt.Sprintf("ham=%.6f", res.HamScore)) {
+			t.Errorf("expected %q to contain the ham score", res)
+		}
+	}
+}
+
+func TestClassifier_MinTokens(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithMinTokens(3, InsufficientData))
+
+	err := c.Train(strings.NewReader("cheap pills online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testCases := []struct {
+		name         string
+		text         string
+		expectTokens int
+		expectLabel  string
+	}{
+		{"empty", "", 0, InsufficientData},
+		{"shorter than a window", "che", 0, InsufficientData},
+		{"too few windows", "cheap", 2, InsufficientData},
+		{"enough windows", "cheap pills", 8, "spam"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := c.Classify(strings.NewReader(tc.text), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if res.Tokens != tc.expectTokens || res.Label != tc.expectLabel {
+				t.Errorf("expected %d tokens and label %q, got %d tokens and %s", tc.expectTokens, tc.expectLabel, res.Tokens, res)
+			}
+
+			relabeled := c.Relabel(res, DefaultBands(0.1, 0.2))
+			if tc.expectLabel == InsufficientData && relabeled != InsufficientData {
+				t.Errorf("expected relabeling not to change label %q, got %q", res.Label, relabeled)
+			}
+		})
+	}
+
+	// Without a minimum, texts without windows are labeled by their score of 0.5
+	res, err := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize).Classify(strings.NewReader(""), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "unsure" || res.Score != 0.5 {
+		t.Errorf("expected an empty text to be unsure, got %s", res)
+	}
+}
+
+func TestClassifier_TrainingWeights(t *testing.T) {
+	const borderline = "cheap pills for lunch"
+
+	score := func(opts ...Option) float64 {
+		dbTotal := &testDB{}
+
+		c := New(dbTotal, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, opts...)
+
+		err := c.Train(strings.NewReader("cheap pills online"), true, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		err = c.Train(strings.NewReader("cheap lunch with friends"), false, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		res, err := c.Classify(strings.NewReader(borderline), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// Untraining with the same weights removes everything again
+		err = c.Untrain(strings.NewReader("cheap pills online"), true, 1)
+		if err == nil {
+			err = c.Untrain(strings.NewReader("cheap lunch with friends"), false, 1)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for w, count := range dbTotal.m {
+			if count != 0 {
+				t.Errorf("expected %q to be untrained, got count %d", w, count)
+			}
+		}
+
+		return res.Score
+	}
+
+	even := score()
+	cautious := score(WithTrainingWeights(3, 1))
+	eager := score(WithTrainingWeights(1, 3))
+
+	if !(cautious < even && even < eager) {
+		t.Errorf("expected higher ham weight to lower the score of %q, got %f with ham weight 3, %f with even weights and %f with spam weight 3", borderline, cautious, even, eager)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a weight of 0 to panic")
+		}
+	}()
+
+	New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithTrainingWeights(0, 1))
+}
+
+func TestClassifier_Zones(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize)
+
+	segment := func(zone string) []Segment {
+		return []Segment{{Text: strings.NewReader("free gift"), Weight: 1, Zone: zone}}
+	}
+
+	err := c.TrainSegments(segment("H:"), true, 1)
+	if err == nil {
+		err = c.TrainSegments(segment("B:"), false, 1)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tc := range []struct {
+		zone        string
+		expectLabel string
+	}{
+		{"H:", "spam"},
+		{"B:", "ham"},
+		{"", "unsure"},
+	} {
+		w, err := c.LookupWord([]byte(tc.zone + "free"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if tc.zone != "" && w.Total != 1 {
+			t.Errorf("expected %q to be trained once in zone %q, got %s", "free", tc.zone, w)
+		}
+
+		res, err := c.ClassifySegments(segment(tc.zone), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if res.Label != tc.expectLabel {
+			t.Errorf("expected %s in zone %q, got %s", tc.expectLabel, tc.zone, res)
+		}
+	}
+
+	err = c.UntrainSegments(segment("H:"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w, _ := c.LookupWord([]byte("H:free")); w.Total != 0 {
+		t.Errorf("expected untraining to remove the header zone, got %s", w)
+	}
+}
+
+func TestClassifier_FeatureTokens(t *testing.T) {
+	label := func(opts ...Option) string {
+		c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, opts...)
+
+		for _, text := range []string{"bob@qwxv.biz", "ann@plmk.biz"} {
+			err := c.Train(strings.NewReader(text), true, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		res, err := c.Classify(strings.NewReader("kim@zzyy.info"), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return res.Label
+	}
+
+	// None of the windows of the new address have been seen before
+	if got := label(); got != "unsure" {
+		t.Errorf("expected unseen address to be unsure without feature tokens, got %s", got)
+	}
+
+	for _, keepDomains := range []bool{false, true} {
+		if got := label(WithFeatureTokens(keepDomains)); got != "spam" {
+			t.Errorf("expected unseen address to be spam with feature tokens (keepDomains %v), got %s", keepDomains, got)
+		}
+	}
+}
+
+func TestClassifier_TextFeatureTokens(t *testing.T) {
+	const text = "mail bob@example.com today"
+
+	testCases := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, text},
+		{[]Option{WithFeatureTokens(false)}, "mail __EMAIL__ today"},
+		{[]Option{WithFeatureTokens(true)}, "mail __EMAIL__ example.com today"},
+	}
+
+	for _, tc := range testCases {
+		c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, tc.opts...)
+
+		got, err := c.Text(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if string(got) != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestClassifier_DecayBefore(t *testing.T) {
+	const text = "cheap lunch offers"
+
+	score := func(opts ...Option) float64 {
+		c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, opts...)
+
+		// A lot of old ham, then a little recent spam with the same text
+		err := c.Train(strings.NewReader(text), false, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			err = c.Train(strings.NewReader(text), true, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		res, err := c.Classify(strings.NewReader(text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return res.Score
+	}
+
+	plain := score()
+	decayed := score(WithDecayBefore(0.5))
+
+	if decayed <= plain {
+		t.Errorf("expected decay to make recent spam count more, got %f with decay and %f without", decayed, plain)
+	}
+
+	testCases := []struct {
+		name string
+		db   DB
+		rate float64
+	}{
+		{"rate too high", &testDB{}, 1},
+		{"negative rate", &testDB{}, -0.1},
+		{"not scalable", struct{ DB }{&testDB{}}, 0.5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected New to panic")
+				}
+			}()
+
+			New(tc.db, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithDecayBefore(tc.rate))
+		})
+	}
+}
+
+func TestClassifier_WordShingles(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        []Option
+		train       string
+		text        string
+		expectSpam  bool
+		expectWords []string
+	}{
+		{"windows match inside words", nil, "pills", "spillstop", true, nil},
+		{"shingles keep words apart", []Option{WithWordShingles(1)}, "pills", "spillstop", false, []string{"pills"}},
+		{"shingles match words", []Option{WithWordShingles(1)}, "pills", "Pills!", true, []string{"pills"}},
+		{"shingles keep word order", []Option{WithWordShingles(2)}, "cheap pills", "pills cheap", false, []string{"cheap pills"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbTotal := &testDB{}
+
+			c := New(dbTotal, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, tc.opts...)
+
+			err := c.Train(strings.NewReader(tc.train), true, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if tc.expectWords != nil {
+				var words []string
+				for w := range dbTotal.m {
+					words = append(words, w)
+				}
+
+				if !reflect.DeepEqual(words, tc.expectWords) {
+					t.Errorf("expected words %q to be trained, got %q", tc.expectWords, words)
+				}
+			}
+
+			res, err := c.Classify(strings.NewReader(tc.text), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if tc.expectSpam && res.Label != "spam" {
+				t.Errorf("expected %q to be spam, got %s", tc.text, res)
+			}
+
+			if !tc.expectSpam && res.Score != 0.5 {
+				t.Errorf("expected %q to be unknown, got %s", tc.text, res)
+			}
+		})
+	}
+}
+
+func TestClassifier_Shouting(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithWordShingles(1), WithShouting())
+
+	err := c.Train(strings.NewReader("BUY NOW"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w, err := c.LookupWord([]byte(features.Shouting))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w.Spam != 2 {
+		t.Errorf("expected the shouting token once for each word in upper case, got %+v", w)
+	}
+
+	// Words are still matched regardless of case, and shouting unrelated words looks like spam
+	for _, text := range []string{"buy now", "FREE OFFER"} {
+		res, err := c.Classify(strings.NewReader(text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if res.Label != "spam" {
+			t.Errorf("expected %q to be spam, got %s", text, res)
+		}
+	}
+}
+
+func TestClassifier_MaxDocumentFrequency(t *testing.T) {
+	// Every text is signed "regards", but more spam than ham was trained, so the signature looks
+	// like spam on its own.
+	train := func(c *Classifier) {
+		for i, text := range []string{
+			"cheap pills regards", "cheap loans regards", "cheap watches regards",
+			"cheap pills regards", "lunch at noon regards",
+		} {
+			err := c.Train(strings.NewReader(text), i < 4, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+
+	classify := func(c *Classifier, text string) Result {
+		res, err := c.Classify(strings.NewReader(text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return res
+	}
+
+	const text = "see you soon, regards regards regards regards"
+
+	plain := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithWordShingles(1))
+	train(plain)
+
+	if res := classify(plain, text); res.Label != "spam" {
+		t.Fatalf("expected the signature to sway %q to spam without a cap, got %s", text, res)
+	}
+
+	capped := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithWordShingles(1), WithMaxDocumentFrequency(0.8))
+	train(capped)
+
+	// Only the unknown words are left
+	res := classify(capped, text)
+	if res.Score != 0.5 || res.Tokens != 3 {
+		t.Errorf("expected the signature to be skipped in %q, got %s with %d tokens", text, res, res.Tokens)
+	}
+
+	// Words below the cap still count
+	if res := classify(capped, "cheap pills, regards"); res.Label != "spam" || res.Tokens != 2 {
+		t.Errorf("expected the other words to be classified, got %s with %d tokens", res, res.Tokens)
+	}
+
+}
+
+func TestClassifier_Documents(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithTrainingWeights(1, 2))
+
+	expect := func(spam, ham uint64) {
+		t.Helper()
+
+		if s, h := c.Documents(); s != spam || h != ham {
+			t.Errorf("expected %d spam and %d ham documents, got %d and %d", spam, ham, s, h)
+		}
+	}
+
+	expect(0, 0)
+
+	for _, spam := range []bool{true, true, false} {
+		err := c.Train(strings.NewReader("cheap pills"), spam, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	expect(4, 1)
+
+	// Texts count with their learn factors, whatever their number of segments
+	err := c.TrainSegments([]Segment{{Text: strings.NewReader("a"), Weight: 1}, {Text: strings.NewReader("b"), Weight: 1}}, false, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expect(4, 4)
+
+	err = c.Untrain(strings.NewReader("cheap pills"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expect(2, 4)
+
+	err = c.UntrainSegments([]Segment{{Text: strings.NewReader("a"), Weight: 1}}, false, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expect(2, 1)
+}
+
+func TestClassifier_DocumentCounter(t *testing.T) {
+	dbTotal, dbHam, dbSpam := &testDB{}, &testDB{}, &testDB{}
+
+	documents := &MemoryDocuments{}
+	documents.Set(10, 20)
+
+	c := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize, WithDocumentCounter(documents))
+
+	err := c.Train(strings.NewReader("cheap pills"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s, h := documents.Documents(); s != 11 || h != 20 {
+		t.Errorf("expected the counter to count the document, got %d spam and %d ham", s, h)
+	}
+
+	// Only windows of the text end up in the databases
+	for _, db := range []*testDB{dbTotal, dbHam, dbSpam} {
+		for k := range db.m {
+			if len(k) != windowSize {
+				t.Errorf("unexpected key %q in database", k)
+			}
+		}
+	}
+
+	documents.RemoveDocuments(false, 30)
+
+	if s, h := c.Documents(); s != 11 || h != 0 {
+		t.Errorf("expected removing to stop at 0, got %d spam and %d ham", s, h)
+	}
+}
+
+func TestClassifier_ClassPrior(t *testing.T) {
+	for _, prior := range []bool{false, true} {
+		var opts []Option
+		if prior {
+			opts = append(opts, WithClassPrior())
+		}
+
+		c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, opts...)
+
+		// Three times as much spam as ham
+		for i, text := range []string{"cheap pills", "cheap loans", "cheap watches", "lunch at noon"} {
+			err := c.Train(strings.NewReader(text), i < 3, 1)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		res, err := c.Classify(strings.NewReader("qqqqqq"), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		want := 0.5
+		if prior {
+			want = 0.75
+		}
+
+		if math.Abs(res.Score-want) > 1e-9 {
+			t.Errorf("expected an unknown text to score %v with prior %v, got %s", want, prior, res)
+		}
+	}
+}
+
+func TestValidateBands(t *testing.T) {
+	if err := ValidateBands(DefaultBands(0.3, 0.7)); err != nil {
+		t.Errorf("unexpected error for default bands: %s", err)
+	}
+
+	for _, bands := range [][]LabelBand{
+		nil,
+		{{Threshold: 0.1, Label: "ham"}},
+		{{Threshold: 0, Label: ""}},
+		{{Threshold: 0, Label: "ham"}, {Threshold: 0.7, Label: "unsure"}, {Threshold: 0.3, Label: "spam"}},
+		{{Threshold: 0, Label: "ham"}, {Threshold: 0.5, Label: "unsure"}, {Threshold: 0.5, Label: "spam"}},
+		{{Threshold: 0, Label: "ham"}, {Threshold: 1, Label: "spam"}},
+		{{Threshold: 0, Label: "ham"}, {Threshold: math.NaN(), Label: "spam"}},
+	} {
+		if err := ValidateBands(bands); err == nil {
+			t.Errorf("expected error for %+v", bands)
+		}
+	}
+}
+
+func TestClassifier_NormalizedTraining(t *testing.T) {
+	// sum adds up the counts of all windows
+	sum := func(db *testDB) uint64 {
+		var total uint64
+		for _, v := range db.m {
+			total += v
+		}
+
+		return total
+	}
+
+	long := strings.Repeat("the quick brown fox jumps over the lazy dog. ", 50)
+	short := "cheap pills"
+
+	for _, normalize := range []uint64{0, 20} {
+		dbTotal, dbHam, dbSpam := &testDB{}, &testDB{}, &testDB{}
+		c := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize, WithNormalizedTraining(normalize))
+
+		err := c.Train(bytes.NewBufferString(long), false, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for i := 0; i < 10; i++ {
+			err := c.Train(bytes.NewBufferString(short), true, 2)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		ham, spam := sum(dbHam), sum(dbSpam)
+
+		if normalize == 0 {
+			if ham <= spam {
+				t.Errorf("expected one long message to outweigh ten short ones without normalization, got %d for ham and %d for spam", ham, spam)
+			}
+
+			continue
+		}
+
+		if ham != 2*normalize || spam != 10*2*normalize {
+			t.Errorf("expected each message to contribute %d, got %d for ham and %d for spam", 2*normalize, ham, spam)
+		}
+
+		// Untraining removes exactly what training added
+		err = c.Untrain(bytes.NewBufferString(long), false, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if sum(dbHam) != 0 {
+			t.Errorf("expected no ham counts after untraining, got %d", sum(dbHam))
+		}
+	}
+}
+
+func TestClassifier_DedupedTraining(t *testing.T) {
+	repeated := strings.Repeat("buy bitcoin ", 100)
+
+	for _, dedup := range []bool{false, true} {
+		var opts []Option
+		if dedup {
+			opts = append(opts, WithDedupedTraining())
+		}
+
+		dbTotal, dbHam, dbSpam := &testDB{}, &testDB{}, &testDB{}
+		c := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize, opts...)
+
+		err := c.Train(bytes.NewBufferString(repeated), true, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		err = c.Train(bytes.NewBufferString("bitcoin prices are down again"), false, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		spam := dbSpam.Score([]byte("bitc"))
+
+		switch {
+		case dedup && spam != 1:
+			t.Errorf("expected repeated window to count once, got %d", spam)
+		case !dedup && spam != 100:
+			t.Errorf("expected repeated window to count 100 times, got %d", spam)
+		}
+
+		if ham := dbHam.Score([]byte("bitc")); ham != 1 {
+			t.Errorf("expected ham count of 1, got %d", ham)
+		}
+
+		// With dedup, the repeated phrase is as much spam as it is ham
+		w, err := c.LookupWord([]byte("bitc"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if dedup && w.SpamLikelihood() != 0.5 {
+			t.Errorf("expected spam likelihood of 0.5 with dedup, got %s", w)
+		}
+	}
+}
+
+func TestClassifier_TrainBatch(t *testing.T) {
+	texts := make([]string, 200)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("message number %d about cheap pills", i)
+	}
+
+	serialTotal, serialHam, serialSpam := &testDB{}, &testDB{}, &testDB{}
+	serial := New(serialTotal, serialHam, serialSpam, 0.3, 0.7, windowSize)
+
+	for _, text := range texts {
+		err := serial.Train(bytes.NewBufferString(text), true, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	dbTotal, dbHam, dbSpam := &testDB{}, &testDB{}, &testDB{}
+	c := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize)
+
+	msgs := make(chan io.Reader)
+	go func() {
+		defer close(msgs)
+
+		for _, text := range texts {
+			msgs <- bytes.NewBufferString(text)
+		}
+	}()
+
+	err := c.TrainBatch(context.Background(), msgs, true, 2, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(dbSpam.m, serialSpam.m) || !reflect.DeepEqual(dbTotal.m, serialTotal.m) {
+		t.Errorf("expected parallel training to produce the same counts as serial training")
+	}
+
+	if len(dbHam.m) != 0 {
+		t.Errorf("expected no ham counts, got %v", dbHam.m)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("broken")
+}
+
+func TestClassifier_TrainBatchErrors(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize)
+
+	msgs := make(chan io.Reader, 3)
+	msgs <- bytes.NewBufferString("fine")
+	msgs <- failingReader{}
+
+	// Nobody closes msgs, so the workers only stop because of the error
+	err := c.TrainBatch(context.Background(), msgs, true, 1, 4)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the error of the broken message, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = c.TrainBatch(ctx, make(chan io.Reader), true, 1, 4)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	err := os.RemoveAll("words.db")
 	if err != nil {
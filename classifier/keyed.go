@@ -0,0 +1,62 @@
+package classifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// keyedTokenSize is the number of bytes of the HMAC of a window that is stored instead of it.
+// 16 bytes are plenty to keep distinct windows apart.
+const keyedTokenSize = 16
+
+// WithTokenKey makes a Classifier store a keyed hash (HMAC-SHA256, truncated) of each window in
+// its databases instead of the window itself. Without the key, the databases can't be checked for
+// whether some text was trained, so they leak less about the messages they were trained with.
+// Databases have to be used with the key they were trained with, since other keys map windows
+// to unrelated tokens.
+func WithTokenKey(key []byte) Option {
+	return func(c *Classifier) {
+		c.tokenKey = append([]byte(nil), key...)
+	}
+}
+
+// keyedDB is a DB that stores the keyed hashes of the sequences passed to it in another DB.
+type keyedDB struct {
+	db  DB
+	key []byte
+}
+
+var _ BatchDB = (*keyedDB)(nil)
+
+func (k *keyedDB) token(w []byte) []byte {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write(w)
+
+	return mac.Sum(nil)[:keyedTokenSize]
+}
+
+func (k *keyedDB) Add(w []byte, factor uint64) {
+	k.db.Add(k.token(w), factor)
+}
+
+func (k *keyedDB) Remove(w []byte, factor uint64) {
+	k.db.Remove(k.token(w), factor)
+}
+
+// Scale scales the keyed hash of w in the underlying DB, which has to be a ScalableDB.
+func (k *keyedDB) Scale(w []byte, factor float64) {
+	k.db.(ScalableDB).Scale(k.token(w), factor)
+}
+
+func (k *keyedDB) Score(w []byte) uint64 {
+	return k.db.Score(k.token(w))
+}
+
+func (k *keyedDB) ScoreMany(words [][]byte) []uint64 {
+	tokens := make([][]byte, len(words))
+	for i, w := range words {
+		tokens[i] = k.token(w)
+	}
+
+	return scoreMany(k.db, tokens)
+}
@@ -0,0 +1,63 @@
+package classifier
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassifier_TokenKey(t *testing.T) {
+	const text = "cheap pills online"
+
+	dbTotal, dbHam, dbSpam := &testDB{}, &testDB{}, &testDB{}
+
+	c := New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize, WithTokenKey([]byte("secret")))
+
+	err := c.Train(strings.NewReader(text), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, db := range []*testDB{dbTotal, dbSpam} {
+		if len(db.m) == 0 {
+			t.Fatalf("expected training to store tokens")
+		}
+
+		for token := range db.m {
+			if len(token) != keyedTokenSize || strings.Contains(text, token) {
+				t.Errorf("expected only hashed tokens to be stored, got %q", token)
+			}
+		}
+	}
+
+	res, err := c.Classify(strings.NewReader("cheap pills"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "spam" {
+		t.Errorf("expected trained text to be spam with the key, got %s", res)
+	}
+
+	word, err := c.LookupWord([]byte("chea"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if word.Total != 1 || word.Spam != 1 {
+		t.Errorf("expected word to be looked up with the key, got %s", word)
+	}
+
+	for name, other := range map[string]*Classifier{
+		"no key":    New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize),
+		"other key": New(dbTotal, dbHam, dbSpam, 0.3, 0.7, windowSize, WithTokenKey([]byte("guess"))),
+	} {
+		res, err := other.Classify(strings.NewReader("cheap pills"), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if res.Score != 0.5 {
+			t.Errorf("expected trained text to be unknown with %s, got %s", name, res)
+		}
+	}
+}
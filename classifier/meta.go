@@ -0,0 +1,240 @@
+package classifier
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// A Member is one of the classifiers that a MetaClassifier combines, along with the weight of its
+// results.
+type Member struct {
+	Classifier *Classifier
+	Weight     float64
+}
+
+// A MetaClassifier combines the results of several classifiers, for example one that splits texts
+// into windows of bytes and one that splits them into word shingles. The score of a text is the
+// average of the scores of the members, weighted by their weights and by how certain each of
+// them is: a member that scores a text close to 0.5 barely counts, one that scores it close to 0
+// or 1 counts fully. So a member that is sure about a text can overrule one that is undecided.
+type MetaClassifier struct {
+	members []Member
+	bands   []LabelBand
+}
+
+// NewMeta returns a MetaClassifier that combines members and labels texts according to bands. It
+// panics if there are no members, if a weight is not above 0 or if bands are not valid, see
+// ValidateBands.
+func NewMeta(bands []LabelBand, members ...Member) *MetaClassifier {
+	if len(members) == 0 {
+		panic("no classifiers to combine")
+	}
+
+	for i, m := range members {
+		if !(m.Weight > 0) {
+			panic(fmt.Sprintf("weight %v of classifier %d is not above 0", m.Weight, i))
+		}
+	}
+
+	err := ValidateBands(bands)
+	if err != nil {
+		panic(err)
+	}
+
+	return &MetaClassifier{
+		members: append([]Member(nil), members...),
+		bands:   append([]LabelBand(nil), bands...),
+	}
+}
+
+// Train trains the text in as spam or ham with all members.
+func (m *MetaClassifier) Train(in io.Reader, spam bool, learnFactor uint64) error {
+	return m.each(in, func(c *Classifier, text io.Reader) error {
+		return c.Train(text, spam, learnFactor)
+	})
+}
+
+// Untrain undoes training the text in as spam or ham with all members.
+func (m *MetaClassifier) Untrain(in io.Reader, spam bool, learnFactor uint64) error {
+	return m.each(in, func(c *Classifier, text io.Reader) error {
+		return c.Untrain(text, spam, learnFactor)
+	})
+}
+
+// TrainSegments trains the segments of a text as spam or ham with all members, see
+// Classifier.TrainSegments.
+func (m *MetaClassifier) TrainSegments(segments []Segment, spam bool, learnFactor uint64) error {
+	return m.eachSegments(segments, func(c *Classifier, segs []Segment) error {
+		return c.TrainSegments(segs, spam, learnFactor)
+	})
+}
+
+// UntrainSegments undoes TrainSegments.
+func (m *MetaClassifier) UntrainSegments(segments []Segment, spam bool, learnFactor uint64) error {
+	return m.eachSegments(segments, func(c *Classifier, segs []Segment) error {
+		return c.UntrainSegments(segs, spam, learnFactor)
+	})
+}
+
+// eachSegments reads the texts of segments and calls fn with each member and a copy of the
+// segments that reads them again.
+func (m *MetaClassifier) eachSegments(segments []Segment, fn func(*Classifier, []Segment) error) error {
+	texts, err := readSegments(segments)
+	if err != nil {
+		return err
+	}
+
+	for i, member := range m.members {
+		err := fn(member.Classifier, copySegments(segments, texts))
+		if err != nil {
+			return errors.Wrapf(err, "classifier %d", i)
+		}
+	}
+
+	return nil
+}
+
+// readSegments reads the texts of all segments.
+func readSegments(segments []Segment) ([][]byte, error) {
+	texts := make([][]byte, len(segments))
+	for i, seg := range segments {
+		var err error
+
+		texts[i], err = ioutil.ReadAll(seg.Text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading segment %d", i)
+		}
+	}
+
+	return texts, nil
+}
+
+// copySegments returns copies of segments that read texts instead of their original texts.
+func copySegments(segments []Segment, texts [][]byte) []Segment {
+	segs := make([]Segment, len(segments))
+	for i, seg := range segments {
+		segs[i] = Segment{Text: bytes.NewReader(texts[i]), Weight: seg.Weight, Zone: seg.Zone}
+	}
+
+	return segs
+}
+
+// each reads in and calls fn with each member and a reader of the text.
+func (m *MetaClassifier) each(in io.Reader, fn func(*Classifier, io.Reader) error) error {
+	text, err := ioutil.ReadAll(in)
+	if err != nil {
+		return errors.Wrap(err, "reading text")
+	}
+
+	for i, member := range m.members {
+		err := fn(member.Classifier, bytes.NewReader(text))
+		if err != nil {
+			return errors.Wrapf(err, "classifier %d", i)
+		}
+	}
+
+	return nil
+}
+
+// Classify classifies the given text with all members and combines their results.
+func (m *MetaClassifier) Classify(text io.Reader, verbose io.Writer) (Result, error) {
+	return m.ClassifySegments([]Segment{{Text: text, Weight: 1}}, verbose)
+}
+
+// ClassifySegments works like Classify, but takes a number of independently tokenized segments
+// of a text, see Classifier.ClassifySegments. The results of the members are returned as the
+// Components of the result, in order. The η of the result corresponds to the combined score,
+// its minimum and maximum span those of all members. If none of the members saw enough windows,
+// see WithMinTokens, the text is labeled with the insufficient label of the first member that
+// requires a minimum.
+func (m *MetaClassifier) ClassifySegments(segments []Segment, verbose io.Writer) (Result, error) {
+	texts, err := readSegments(segments)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{
+		Min: math.Inf(1),
+		Max: math.Inf(-1),
+	}
+
+	var score, hamScore, total float64
+
+	enough := false
+	insufficientLabel := ""
+
+	for i, member := range m.members {
+		if verbose != nil {
+			fmt.Fprintf(verbose, "classifier %d, weight %v:\n", i, member.Weight)
+		}
+
+		res, err := member.Classifier.ClassifySegments(copySegments(segments, texts), verbose)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "classifier %d", i)
+		}
+
+		result.Components = append(result.Components, res)
+		result.Min = math.Min(result.Min, res.Min)
+		result.Max = math.Max(result.Max, res.Max)
+
+		if res.Tokens > result.Tokens {
+			result.Tokens = res.Tokens
+		}
+
+		if res.Tokens >= member.Classifier.minTokens {
+			enough = true
+		} else if insufficientLabel == "" {
+			insufficientLabel = member.Classifier.insufficientLabel
+		}
+
+		w := member.Weight * math.Abs(res.Score-res.HamScore)
+
+		score += w * res.Score
+		hamScore += w * res.HamScore
+		total += w
+	}
+
+	if total == 0 {
+		// None of the members leans either way
+		result.Score, result.HamScore = 0.5, 0.5
+	} else {
+		result.Score, result.HamScore = score/total, hamScore/total
+	}
+
+	// The scores of the members can underflow to 0, keep η finite anyway
+	result.Eta = math.Log(clampScore(result.HamScore) / clampScore(result.Score))
+	if math.IsNaN(result.Eta) || math.IsInf(result.Eta, 0) {
+		return Result{}, errors.Errorf("bad η %f for score %f and ham score %f", result.Eta, result.Score, result.HamScore)
+	}
+
+	result.Label = LabelFor(m.bands, result.Score)
+	if !enough {
+		result.Label = insufficientLabel
+	}
+
+	if verbose != nil {
+		fmt.Fprintln(verbose, "combined score:", result.Score)
+	}
+
+	return result, nil
+}
+
+// clampScore returns score, but at least the smallest float64 above 0 and at most 1, so that its
+// logarithm is finite.
+func clampScore(score float64) float64 {
+	switch {
+	case math.IsNaN(score):
+		return 0.5
+	case score < math.SmallestNonzeroFloat64:
+		return math.SmallestNonzeroFloat64
+	case score > 1:
+		return 1
+	}
+
+	return score
+}
@@ -0,0 +1,123 @@
+package classifier
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMetaClassifier(t *testing.T) {
+	windows := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize)
+	shingles := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithWordShingles(1))
+
+	meta := NewMeta(DefaultBands(0.3, 0.7), Member{windows, 1}, Member{shingles, 1})
+
+	// Spam about "pills" makes windows of unrelated words like "spillover" look like spam, while
+	// the shingles only learn the whole words.
+	for _, text := range []string{"cheap pills", "pills online", "buy pills now"} {
+		err := meta.Train(strings.NewReader(text), true, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// A little ham makes the windows less certain about "pill"
+	err := windows.Train(strings.NewReader("a pill"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, text := range []string{"the spillover report", "report on the spillover"} {
+		err := shingles.Train(strings.NewReader(text), false, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	const text = "the spillover report"
+
+	res, err := meta.Classify(strings.NewReader(text), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(res.Components) != 2 {
+		t.Fatalf("expected results of both classifiers, got %+v", res.Components)
+	}
+
+	if res.Components[0].Label != "spam" || res.Components[1].Label != "ham" {
+		t.Fatalf("expected windows to label %q as spam and shingles as ham, got %s and %s", text, res.Components[0], res.Components[1])
+	}
+
+	if res.Label != "ham" {
+		t.Errorf("expected the more certain classifier to win, got %s", res)
+	}
+
+	if res.Score+res.HamScore < 0.999 || res.Score+res.HamScore > 1.001 {
+		t.Errorf("expected scores to add up to 1, got %s", res)
+	}
+
+	var verbose bytes.Buffer
+
+	verboseRes, err := meta.Classify(strings.NewReader(text), &verbose)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if verboseRes.Score != res.Score || !strings.Contains(verbose.String(), "classifier 1, weight 1:") {
+		t.Errorf("expected verbose output for each classifier and the same result, got %s:\n%s", verboseRes, verbose.String())
+	}
+
+	// With enough weight, the windows win after all
+	res, err = NewMeta(DefaultBands(0.3, 0.7), Member{windows, 1000}, Member{shingles, 1}).Classify(strings.NewReader(text), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "spam" {
+		t.Errorf("expected heavily weighted windows to win, got %s", res)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a weight of 0 to panic")
+		}
+	}()
+
+	NewMeta(DefaultBands(0.3, 0.7), Member{windows, 0})
+}
+
+func TestMetaClassifier_MinTokens(t *testing.T) {
+	windows := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithMinTokens(5, InsufficientData))
+	shingles := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize, WithWordShingles(1), WithMinTokens(5, InsufficientData))
+
+	meta := NewMeta(DefaultBands(0.3, 0.7), Member{windows, 1}, Member{shingles, 1})
+
+	res, err := meta.Classify(strings.NewReader("hi"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != InsufficientData {
+		t.Errorf("expected a short text to be labeled %q, got %s", InsufficientData, res)
+	}
+
+	res, err = meta.Classify(strings.NewReader("a text that is long enough to be classified"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label == InsufficientData {
+		t.Errorf("expected a long text to be classified, got %s", res)
+	}
+}
+
+func TestClampScore(t *testing.T) {
+	for _, score := range []float64{0, -1, 1, 2, math.NaN(), 0.5, math.SmallestNonzeroFloat64} {
+		l := math.Log(clampScore(score))
+		if math.IsNaN(l) || math.IsInf(l, 0) || l > 0 {
+			t.Errorf("expected a finite logarithm of at most 0 for %v, got %f", score, l)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package classifier
+
+import (
+	"fmt"
+	"io"
+)
+
+// A TraceRecord describes how one window of a text contributed to its classification, see
+// ClassifyTraced.
+type TraceRecord struct {
+	Token  string  `json:"token"`
+	Weight float64 `json:"weight"` // of the segment that the window is in
+
+	// Counts of the window in all messages, ham and spam
+	Total uint64 `json:"total"`
+	Ham   uint64 `json:"ham"`
+	Spam  uint64 `json:"spam"`
+
+	HamLikelihood  float64 `json:"ham_likelihood"`
+	SpamLikelihood float64 `json:"spam_likelihood"`
+
+	// Logarithms of the likelihoods after passing them through the sigmoid
+	L1 float64 `json:"l1"`
+	L2 float64 `json:"l2"`
+
+	// η and the spam score of the text up to and including the window
+	Eta   float64 `json:"eta"`
+	Score float64 `json:"score"`
+}
+
+// word returns the counts of r as a Word.
+func (r TraceRecord) word() Word {
+	return Word{
+		Text:  []byte(r.Token),
+		Total: r.Total,
+		Ham:   r.Ham,
+		Spam:  r.Spam,
+	}
+}
+
+// verboseTrace returns a function that writes a line for each record passed to it to w.
+func verboseTrace(w io.Writer) func(TraceRecord) {
+	return func(r TraceRecord) {
+		fmt.Fprintf(w, "%s: %f/%f, l:[%f - %f = %f], η:%f, current score:%f\n", r.word(), r.HamLikelihood, r.SpamLikelihood, r.L1, r.L2, r.L1-r.L2, r.Eta, r.Score)
+	}
+}
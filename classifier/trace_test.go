@@ -0,0 +1,62 @@
+package classifier
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClassifier_ClassifyTraced(t *testing.T) {
+	c := New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, windowSize)
+
+	err := c.Train(strings.NewReader("cheap pills online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	segments := func() []Segment {
+		return []Segment{
+			{Text: strings.NewReader("cheap"), Weight: 2},
+			{Text: strings.NewReader("pills pills at noon"), Weight: 1},
+		}
+	}
+
+	var trace []TraceRecord
+
+	res, err := c.ClassifyTraced(segments(), func(r TraceRecord) {
+		trace = append(trace, r)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(trace) != res.Tokens {
+		t.Fatalf("expected one record for each of the %d scored windows, got %d", res.Tokens, len(trace))
+	}
+
+	if trace[0].Token != "chea" || trace[0].Weight != 2 || trace[0].Spam != 1 {
+		t.Errorf("expected first record to be the spam window \"chea\" of the first segment, got %+v", trace[0])
+	}
+
+	if last := trace[len(trace)-1]; last.Eta != res.Eta || last.Score != res.Score {
+		t.Errorf("expected last record to end at η %f and score %f, got %+v", res.Eta, res.Score, last)
+	}
+
+	// The verbose output has one line for each record, followed by the final η
+	var verbose bytes.Buffer
+
+	verboseRes, err := c.ClassifySegments(segments(), &verbose)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(verboseRes, res) {
+		t.Errorf("expected tracing not to change the result %s, got %s", res, verboseRes)
+	}
+
+	lines := strings.Split(strings.TrimSpace(verbose.String()), "\n")
+	if len(lines) != len(trace)+1 || !strings.HasPrefix(lines[len(lines)-1], "final η:") {
+		t.Errorf("expected %d lines of verbose output, got %q", len(trace)+1, lines)
+	}
+}
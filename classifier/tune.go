@@ -0,0 +1,146 @@
+package classifier
+
+import (
+	"math"
+	"sort"
+)
+
+// A LabeledScore is the score a classifier assigned to a message whose true class is known.
+type LabeledScore struct {
+	Score float64
+	Spam  bool
+}
+
+// An Objective rates a threshold by the number of true positives, false positives, false
+// negatives and true negatives it produces when detecting spam. Higher is better.
+type Objective func(truePos, falsePos, falseNeg, trueNeg int) float64
+
+// PenalizedF1 returns an Objective that computes the F1 score for detecting spam, minus the
+// false positive rate multiplied by penalty. Since flagging ham as spam is much more annoying
+// than letting some spam through, a positive penalty moves the threshold towards higher scores.
+func PenalizedF1(penalty float64) Objective {
+	return func(truePos, falsePos, falseNeg, trueNeg int) float64 {
+		if truePos == 0 {
+			return -penalty * rate(falsePos, trueNeg)
+		}
+
+		precision := float64(truePos) / float64(truePos+falsePos)
+		recall := float64(truePos) / float64(truePos+falseNeg)
+		f1 := 2 * precision * recall / (precision + recall)
+
+		return f1 - penalty*rate(falsePos, trueNeg)
+	}
+}
+
+func rate(n, rest int) float64 {
+	if n+rest == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(n+rest)
+}
+
+// DefaultFalsePositivePenalty is the false positive penalty used by TuneThresholds.
+const DefaultFalsePositivePenalty = 1.0
+
+// TuneThresholds picks thresholds for "unsure" and "spam" for the given scores of a labeled
+// validation set, which must not be empty. It uses PenalizedF1 with DefaultFalsePositivePenalty
+// as the objective.
+func TuneThresholds(scores []LabeledScore) (unsure, spam float64) {
+	return TuneThresholdsFor(scores, PenalizedF1(DefaultFalsePositivePenalty))
+}
+
+// TuneThresholdsFor picks thresholds for "unsure" and "spam" for the given scores of a labeled
+// validation set, which must not be empty. The spam threshold maximizes objective. The unsure
+// threshold maximizes the plain F1 score, which doesn't care about false positives, so messages
+// that would be spam if false positives didn't matter end up as "unsure".
+func TuneThresholdsFor(scores []LabeledScore, objective Objective) (unsure, spam float64) {
+	candidates, counts := sweep(scores)
+
+	spamIdx := best(candidates, counts, objective, len(candidates)-1)
+	unsureIdx := best(candidates, counts, PenalizedF1(0), spamIdx)
+
+	spam = candidates[spamIdx]
+	unsure = candidates[unsureIdx]
+
+	if unsure >= spam {
+		// Leave at least a narrow band for unsure results
+		if unsureIdx > 0 {
+			unsure = candidates[unsureIdx-1]
+		} else {
+			unsure = spam / 2
+		}
+	}
+
+	return unsure, spam
+}
+
+// confusion holds the number of true positives, false positives, false negatives and true
+// negatives for a threshold.
+type confusion [4]int
+
+// sweep returns the candidate thresholds for scores in ascending order, along with the
+// confusion counts for each of them. Messages with a score above a threshold count as spam.
+func sweep(scores []LabeledScore) ([]float64, []confusion) {
+	sorted := make([]LabeledScore, len(scores))
+	copy(sorted, scores)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Score < sorted[j].Score
+	})
+
+	var totalSpam, totalHam int
+	for _, s := range sorted {
+		if s.Spam {
+			totalSpam++
+		} else {
+			totalHam++
+		}
+	}
+
+	// The first candidate classifies everything as spam
+	candidates := []float64{0}
+	counts := []confusion{{totalSpam, totalHam, 0, 0}}
+
+	var belowSpam, belowHam int
+	for i, s := range sorted {
+		if s.Spam {
+			belowSpam++
+		} else {
+			belowHam++
+		}
+
+		if i+1 < len(sorted) && sorted[i+1].Score == s.Score {
+			// Can't put a threshold between equal scores
+			continue
+		}
+
+		threshold := 1.0
+		if i+1 < len(sorted) {
+			threshold = (s.Score + sorted[i+1].Score) / 2
+		}
+
+		candidates = append(candidates, threshold)
+		counts = append(counts, confusion{totalSpam - belowSpam, totalHam - belowHam, belowSpam, belowHam})
+	}
+
+	return candidates, counts
+}
+
+// best returns the index of the candidate threshold up to and including index max that
+// maximizes objective. Ties are resolved in favor of the higher threshold.
+func best(candidates []float64, counts []confusion, objective Objective, max int) int {
+	bestIdx := 0
+	bestValue := math.Inf(-1)
+
+	for i := 0; i <= max && i < len(candidates); i++ {
+		c := counts[i]
+
+		v := objective(c[0], c[1], c[2], c[3])
+		if v >= bestValue {
+			bestIdx = i
+			bestValue = v
+		}
+	}
+
+	return bestIdx
+}
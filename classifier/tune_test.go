@@ -0,0 +1,81 @@
+package classifier
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// bimodalScores returns n scores each for ham and spam, normally distributed around 0.2 and
+// 0.8 respectively.
+func bimodalScores(n int) []LabeledScore {
+	rnd := rand.New(rand.NewSource(1))
+
+	clamp := func(x float64) float64 {
+		if x < 0 {
+			return 0
+		}
+
+		if x > 1 {
+			return 1
+		}
+
+		return x
+	}
+
+	var scores []LabeledScore
+	for i := 0; i < n; i++ {
+		scores = append(scores,
+			LabeledScore{Score: clamp(0.2 + 0.15*rnd.NormFloat64()), Spam: false},
+			LabeledScore{Score: clamp(0.8 + 0.15*rnd.NormFloat64()), Spam: true},
+		)
+	}
+
+	return scores
+}
+
+func TestTuneThresholds(t *testing.T) {
+	scores := bimodalScores(1000)
+
+	unsure, spam := TuneThresholds(scores)
+	t.Logf("unsure: %f, spam: %f", unsure, spam)
+
+	if unsure >= spam {
+		t.Errorf("expected unsure threshold %f below spam threshold %f", unsure, spam)
+	}
+
+	if unsure < 0.3 || unsure > 0.6 {
+		t.Errorf("unexpected unsure threshold %f", unsure)
+	}
+
+	if spam < 0.5 || spam > 0.9 {
+		t.Errorf("unexpected spam threshold %f", spam)
+	}
+
+	// A higher penalty for false positives should never lower the spam threshold
+	_, strictSpam := TuneThresholdsFor(scores, PenalizedF1(10))
+	t.Logf("strict spam: %f", strictSpam)
+
+	if strictSpam < spam {
+		t.Errorf("expected stricter spam threshold than %f, got %f", spam, strictSpam)
+	}
+}
+
+func TestTuneThresholds_Separable(t *testing.T) {
+	scores := []LabeledScore{
+		{0.1, false},
+		{0.2, false},
+		{0.8, true},
+		{0.9, true},
+	}
+
+	unsure, spam := TuneThresholds(scores)
+	t.Logf("unsure: %f, spam: %f", unsure, spam)
+
+	if spam <= 0.2 || spam >= 0.8 {
+		t.Errorf("expected spam threshold to separate ham and spam, got %f", spam)
+	}
+
+	if unsure >= spam {
+		t.Errorf("expected unsure threshold %f below spam threshold %f", unsure, spam)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// A trainedSet remembers which messages were trained most recently, so that retries and
+// overlapping jobs don't train the same message twice. It holds at most size keys and forgets
+// the least recently trained ones first. It is safe for concurrent use.
+type trainedSet struct {
+	mu sync.Mutex
+
+	size  int
+	order *list.List // of string keys, most recently trained first
+	keys  map[string]*list.Element
+}
+
+func newTrainedSet(size int) *trainedSet {
+	return &trainedSet{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element, size),
+	}
+}
+
+// add records key as trained. It returns false if key was already recorded, in which case the
+// message shouldn't be trained again.
+func (t *trainedSet) add(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.keys[key]; ok {
+		t.order.MoveToFront(e)
+		return false
+	}
+
+	if t.order.Len() >= t.size {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.keys, oldest.Value.(string))
+	}
+
+	t.keys[key] = t.order.PushFront(key)
+
+	return true
+}
+
+// remove forgets key, so that the message can be trained again.
+func (t *trainedSet) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.keys[key]; ok {
+		t.order.Remove(e)
+		delete(t.keys, key)
+	}
+}
+
+// trainingKey identifies training the email in raw as spam or ham. Messages are identified by
+// their Message-ID, or by a hash of their content if they don't have one. The class is part of
+// the key, so that a message that was trained with the wrong label can be trained again with the
+// right one.
+func trainingKey(raw []byte, spam bool) string {
+	class := "ham"
+	if spam {
+		class = "spam"
+	}
+
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if id := strings.TrimSpace(m.Header.Get("Message-Id")); id != "" {
+			return class + " " + id
+		}
+	}
+
+	sum := sha256.Sum256(raw)
+
+	return class + " sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTrainedSet(t *testing.T) {
+	set := newTrainedSet(2)
+
+	for _, key := range []string{"a", "b"} {
+		if !set.add(key) {
+			t.Errorf("expected %q to be new", key)
+		}
+	}
+
+	if set.add("a") {
+		t.Errorf("expected \"a\" to be known")
+	}
+
+	// "b" is the least recently trained key now, and makes room for "c"
+	set.add("c")
+
+	if !set.add("b") {
+		t.Errorf("expected \"b\" to be forgotten")
+	}
+
+	if trainingKey([]byte("hello"), true) == trainingKey([]byte("hello"), false) {
+		t.Errorf("expected the class to be part of the key")
+	}
+}
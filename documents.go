@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/logger"
+)
+
+// documentsFile is the name of the file in the directory of a model that holds the number of
+// messages the model was trained with.
+const documentsFile = "documents"
+
+// A documentFile counts the messages that a classifier was trained with as spam and as ham, see
+// classifier.DocumentCounter, and keeps the counts in a small JSON file next to the filters.
+// Like the filters, it is persisted periodically by Run.
+type documentFile struct {
+	path string
+
+	mu     sync.Mutex
+	counts documentCounts
+	dirty  bool
+}
+
+// openDocumentFile loads the counts stored in the file at path. If the file doesn't exist, no
+// messages have been counted yet.
+func openDocumentFile(path string) (*documentFile, error) {
+	d := &documentFile{path: path}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading document counts")
+	}
+
+	err = json.Unmarshal(buf, &d.counts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing document counts in %s", path)
+	}
+
+	return d, nil
+}
+
+// AddDocuments adds n to the count of spam or ham messages.
+func (d *documentFile) AddDocuments(spam bool, n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if spam {
+		d.counts.Spam += n
+	} else {
+		d.counts.Ham += n
+	}
+
+	d.dirty = true
+}
+
+// RemoveDocuments subtracts n from the count of spam or ham messages, stopping at 0.
+func (d *documentFile) RemoveDocuments(spam bool, n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := &d.counts.Ham
+	if spam {
+		count = &d.counts.Spam
+	}
+
+	if *count < n {
+		*count = 0
+	} else {
+		*count -= n
+	}
+
+	d.dirty = true
+}
+
+// Documents returns the number of spam and ham messages.
+func (d *documentFile) Documents() (spam, ham uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.counts.Spam, d.counts.Ham
+}
+
+// persist writes the counts to the file of d if they changed, replacing the previous contents
+// atomically.
+func (d *documentFile) persist() error {
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return nil
+	}
+
+	buf, err := json.Marshal(d.counts)
+	d.dirty = false
+	d.mu.Unlock()
+
+	if err == nil {
+		err = d.write(buf)
+	}
+	if err != nil {
+		// Try again next time
+		d.mu.Lock()
+		d.dirty = true
+		d.mu.Unlock()
+	}
+
+	return err
+}
+
+func (d *documentFile) write(buf []byte) error {
+	fh, err := ioutil.TempFile(filepath.Dir(d.path), ".documents-*")
+	if err != nil {
+		return errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	_, err = fh.Write(buf)
+	if err == nil {
+		err = fh.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "writing document counts")
+	}
+
+	return errors.Wrap(os.Rename(fh.Name(), d.path), "renaming temp file")
+}
+
+// Run persists the counts every minute if they changed, and one last time when ctx is canceled.
+func (d *documentFile) Run(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+
+	for {
+		done := false
+
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-tick.C:
+		}
+
+		err := d.persist()
+		if err != nil {
+			logger.Errorf("can't persist document counts to %s: %s", d.path, err)
+		}
+
+		if done {
+			return
+		}
+	}
+}
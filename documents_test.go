@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mailfilter/classifier"
+)
+
+var _ classifier.DocumentCounter = (*documentFile)(nil)
+
+func TestDocumentFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), documentsFile)
+
+	d, err := openDocumentFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c := classifier.New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, 6, classifier.WithDocumentCounter(d))
+
+	for _, spam := range []bool{true, true, false} {
+		err := c.Train(strings.NewReader("cheap pills"), spam, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Persists one last time
+	d.Run(ctx)
+
+	reopened, err := openDocumentFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if spam, ham := reopened.Documents(); spam != 2 || ham != 1 {
+		t.Errorf("expected 2 spam and 1 ham documents after reopening, got %d and %d", spam, ham)
+	}
+
+	reopened.RemoveDocuments(false, 5)
+
+	if _, ham := reopened.Documents(); ham != 0 {
+		t.Errorf("expected removing to stop at 0, got %d", ham)
+	}
+}
+
+func TestDocumentFile_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), documentsFile)
+
+	err := ioutil.WriteFile(path, []byte("not json"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = openDocumentFile(path)
+	if err == nil {
+		t.Errorf("expected error for invalid document counts")
+	}
+}
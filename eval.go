@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/classifier"
+	"mailfilter/logger"
+)
+
+// A sample is a message with a known label that is used to evaluate the classifier.
+type sample struct {
+	path string
+	spam bool
+	fold int
+
+	// result holds the verdict for the sample after it was classified
+	result classifier.Result
+}
+
+// loadSamples returns a sample for each regular file below dir, distributing them
+// round-robin over the given number of folds.
+func loadSamples(dir string, spam bool, folds int) ([]sample, error) {
+	var samples []sample
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		samples = append(samples, sample{
+			path: p,
+			spam: spam,
+			fold: len(samples) % folds,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading samples from %s", dir)
+	}
+
+	return samples, nil
+}
+
+// evaluate runs a cross-validation with the given number of folds over the messages in spamDir
+// and hamDir, and writes a report to out, either as text or as JSON. bands are the label bands of
+// the classifiers returned by newClassifier.
+func evaluate(filter SpamFilter, newClassifier func(dir string) (*classifier.Classifier, error), bands []classifier.LabelBand, spamDir, hamDir string, folds int, asJSON bool, out io.Writer) error {
+	samples, err := validate(filter, newClassifier, spamDir, hamDir, folds)
+	if err != nil {
+		return err
+	}
+
+	report := newEvalReport(samples, folds, bands)
+	if asJSON {
+		return report.WriteJSON(out)
+	}
+
+	return report.WriteText(out)
+}
+
+// tune runs a cross-validation with the given number of folds over the messages in spamDir and
+// hamDir, and writes the thresholds that maximize classifier.PenalizedF1 with the given false
+// positive penalty to out.
+func tune(filter SpamFilter, newClassifier func(dir string) (*classifier.Classifier, error), spamDir, hamDir string, folds int, penalty float64, out io.Writer) error {
+	samples, err := validate(filter, newClassifier, spamDir, hamDir, folds)
+	if err != nil {
+		return err
+	}
+
+	if len(samples) == 0 {
+		return errors.New("no samples to tune thresholds with")
+	}
+
+	scores := make([]classifier.LabeledScore, len(samples))
+	for i, s := range samples {
+		scores[i] = classifier.LabeledScore{
+			Score: s.result.Score,
+			Spam:  s.spam,
+		}
+	}
+
+	unsure, spam := classifier.TuneThresholdsFor(scores, classifier.PenalizedF1(penalty))
+
+	_, err = fmt.Fprintf(out, "-thresholdUnsure=%.4f -thresholdSpam=%.4f\n", unsure, spam)
+
+	return err
+}
+
+// validate loads the samples in spamDir and hamDir and runs a cross-validation with the given
+// number of folds over them.
+func validate(filter SpamFilter, newClassifier func(dir string) (*classifier.Classifier, error), spamDir, hamDir string, folds int) ([]sample, error) {
+	spam, err := loadSamples(spamDir, true, folds)
+	if err != nil {
+		return nil, err
+	}
+
+	ham, err := loadSamples(hamDir, false, folds)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := append(spam, ham...)
+
+	err = crossValidate(filter, newClassifier, samples, folds)
+	if err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// crossValidate runs a k-fold cross-validation over samples. For each fold, a fresh classifier
+// is created by newClassifier in an empty temporary directory, trained on all samples that are
+// not part of the fold and then used to classify the samples in the fold. The results are stored
+// in the samples. filter provides the settings for classifying samples.
+func crossValidate(filter SpamFilter, newClassifier func(dir string) (*classifier.Classifier, error), samples []sample, folds int) error {
+	for fold := 0; fold < folds; fold++ {
+		err := validateFold(filter, newClassifier, samples, fold)
+		if err != nil {
+			return errors.Wrapf(err, "fold %d", fold)
+		}
+	}
+
+	return nil
+}
+
+func validateFold(filter SpamFilter, newClassifier func(dir string) (*classifier.Classifier, error), samples []sample, fold int) error {
+	tmp, err := ioutil.TempDir("", "mailfilter-eval")
+	if err != nil {
+		return errors.Wrap(err, "creating temp dir")
+	}
+	defer os.RemoveAll(tmp)
+
+	filter.c, err = newClassifier(tmp)
+	if err != nil {
+		return errors.Wrap(err, "creating classifier")
+	}
+
+	for _, s := range samples {
+		if s.fold == fold {
+			continue
+		}
+
+		err := trainFile(&filter, s.path, s.spam, 1)
+		if err != nil {
+			logger.Errorf("can't train %s: %s", s.path, err)
+		}
+	}
+
+	for idx := range samples {
+		s := &samples[idx]
+		if s.fold != fold {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", s.path)
+		}
+
+		s.result, err = filter.verdict(raw, ClassifyEmail, nil)
+		if err != nil {
+			return errors.Wrapf(err, "classifying %s", s.path)
+		}
+	}
+
+	return nil
+}
+
+// An EvalReport summarizes the results of an evaluation. Spam is the positive class, and
+// only messages labeled with the label of the last band count as positives.
+type EvalReport struct {
+	Messages int `json:"messages"`
+	Folds    int `json:"folds"`
+
+	// Labels lists the labels that messages were classified as: those of the label bands in
+	// order, followed by any others, like the label for texts with too few windows
+	Labels []string `json:"labels"`
+
+	// Confusion maps the actual class of messages to the labels they were classified as
+	Confusion map[string]map[string]int `json:"confusion"`
+
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+}
+
+func newEvalReport(samples []sample, folds int, bands []classifier.LabelBand) EvalReport {
+	r := EvalReport{
+		Messages: len(samples),
+		Folds:    folds,
+		Confusion: map[string]map[string]int{
+			"ham":  {},
+			"spam": {},
+		},
+	}
+
+	for _, b := range bands {
+		r.addLabel(b.Label)
+	}
+
+	positive := bands[len(bands)-1].Label
+
+	var truePos, falsePos, falseNeg int
+
+	for _, s := range samples {
+		actual := "ham"
+		if s.spam {
+			actual = "spam"
+		}
+
+		r.addLabel(s.result.Label)
+		r.Confusion[actual][s.result.Label]++
+
+		switch {
+		case s.spam && s.result.Label == positive:
+			truePos++
+		case !s.spam && s.result.Label == positive:
+			falsePos++
+		case s.spam:
+			falseNeg++
+		}
+	}
+
+	if truePos+falsePos > 0 {
+		r.Precision = float64(truePos) / float64(truePos+falsePos)
+	}
+
+	if truePos+falseNeg > 0 {
+		r.Recall = float64(truePos) / float64(truePos+falseNeg)
+	}
+
+	if r.Precision+r.Recall > 0 {
+		r.F1 = 2 * r.Precision * r.Recall / (r.Precision + r.Recall)
+	}
+
+	return r
+}
+
+// addLabel adds label to the labels of r, with a count of 0 for both classes, unless r already
+// has it.
+func (r *EvalReport) addLabel(label string) {
+	for _, l := range r.Labels {
+		if l == label {
+			return
+		}
+	}
+
+	r.Labels = append(r.Labels, label)
+
+	for _, counts := range r.Confusion {
+		counts[label] = 0
+	}
+}
+
+// WriteText writes a human readable version of r to w.
+func (r EvalReport) WriteText(w io.Writer) error {
+	// Labels can be longer than the counts
+	width := 8
+	for _, l := range r.Labels {
+		if len(l) > width {
+			width = len(l)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d messages, %d folds\n\n%-8s", r.Messages, r.Folds, "")
+	if err != nil {
+		return err
+	}
+
+	for _, l := range r.Labels {
+		fmt.Fprintf(w, " %*s", width, l)
+	}
+	fmt.Fprintln(w)
+
+	for _, actual := range []string{"ham", "spam"} {
+		fmt.Fprintf(w, "%-8s", actual)
+		for _, l := range r.Labels {
+			fmt.Fprintf(w, " %*d", width, r.Confusion[actual][l])
+		}
+		fmt.Fprintln(w)
+	}
+
+	_, err = fmt.Fprintf(w, "\nprecision: %.4f\nrecall:    %.4f\nF1:        %.4f\n", r.Precision, r.Recall, r.F1)
+
+	return err
+}
+
+// WriteJSON writes r to w as JSON.
+func (r EvalReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mailfilter/classifier"
+)
+
+func writeSamples(t *testing.T, dir string, texts []string) {
+	t.Helper()
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for i, txt := range texts {
+		msg := fmt.Sprintf("Subject: message %d\n\n%s\n", i, txt)
+
+		err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte(msg), 0600)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tmp := t.TempDir()
+
+	writeSamples(t, filepath.Join(tmp, "spam"), []string{
+		"buy cheap bitcoin now",
+		"cheap bitcoin, buy now",
+		"buy now: cheap bitcoin",
+		"now buy cheap bitcoin",
+	})
+
+	writeSamples(t, filepath.Join(tmp, "ham"), []string{
+		"see you at lunch tomorrow",
+		"lunch tomorrow? see you there",
+		"tomorrow at lunch, see you",
+		"see you tomorrow for lunch",
+	})
+
+	newClassifier := func(string) (*classifier.Classifier, error) {
+		return classifier.New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, 6), nil
+	}
+
+	var out bytes.Buffer
+
+	err := evaluate(SpamFilter{}, newClassifier, classifier.DefaultBands(0.3, 0.7), filepath.Join(tmp, "spam"), filepath.Join(tmp, "ham"), 2, true, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var report EvalReport
+
+	err = json.Unmarshal(out.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Logf("report: %+v", report)
+
+	if report.Messages != 8 || report.Folds != 2 {
+		t.Errorf("unexpected number of messages or folds: %+v", report)
+	}
+
+	if report.Confusion["spam"]["spam"] != 4 || report.Confusion["ham"]["ham"] != 4 {
+		t.Errorf("unexpected confusion matrix: %v", report.Confusion)
+	}
+
+	if report.Precision != 1 || report.Recall != 1 || report.F1 != 1 {
+		t.Errorf("expected perfect scores, got %+v", report)
+	}
+
+	out.Reset()
+
+	err = report.WriteText(&out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Logf("text report:\n%s", out.String())
+}
+
+func TestEvaluate_CustomLabels(t *testing.T) {
+	tmp := t.TempDir()
+
+	writeSamples(t, filepath.Join(tmp, "spam"), []string{
+		"buy cheap bitcoin now",
+		"cheap bitcoin, buy now",
+	})
+
+	writeSamples(t, filepath.Join(tmp, "ham"), []string{
+		"see you at lunch tomorrow",
+		"lunch tomorrow? see you there",
+	})
+
+	bands := []classifier.LabelBand{{Threshold: 0, Label: "clean"}, {Threshold: 0.5, Label: "suspect"}, {Threshold: 0.9, Label: "junk"}}
+
+	newClassifier := func(string) (*classifier.Classifier, error) {
+		return classifier.New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, 6, classifier.WithLabels(bands)), nil
+	}
+
+	var out bytes.Buffer
+
+	err := evaluate(SpamFilter{}, newClassifier, bands, filepath.Join(tmp, "spam"), filepath.Join(tmp, "ham"), 2, true, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var report EvalReport
+
+	err = json.Unmarshal(out.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fmt.Sprint(report.Labels) != "[clean suspect junk]" {
+		t.Errorf("expected the labels of the bands, got %v", report.Labels)
+	}
+
+	if report.Confusion["spam"]["junk"] != 2 || report.Confusion["ham"]["clean"] != 2 {
+		t.Errorf("unexpected confusion matrix: %v", report.Confusion)
+	}
+
+	if report.Precision != 1 || report.Recall != 1 {
+		t.Errorf("expected perfect scores, got %+v", report)
+	}
+
+	out.Reset()
+
+	err = report.WriteText(&out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !strings.Contains(out.String(), "junk") {
+		t.Errorf("expected custom labels in text report, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,91 @@
+// Package features replaces URLs and email addresses in texts with fixed feature tokens. Spam is
+// full of URLs and addresses that never recur, and as ngrams each of them only adds noise. As
+// feature tokens, they all add to the same few ngrams instead.
+package features
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// Tokens that URLs and email addresses are replaced with.
+const (
+	URL   = "__URL__"
+	Email = "__EMAIL__"
+)
+
+// Shouting is the token that word shingles add for each word in upper case, see
+// ntuple.ShingleReader.MarkShouting.
+const Shouting = "__SHOUTING__"
+
+// addressRE matches URLs with a scheme or starting with "www.", and email addresses. URLs come
+// first, so that the user info of a URL isn't mistaken for an address, while addresses that
+// start before a "www." match as addresses.
+var addressRE = regexp.MustCompile(`(?i)\b(?:(?:https?|ftp)://|www\.)[^\s<>"'()\[\]{}]+|\b[a-z0-9._%+-]+@[a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,}\b`)
+
+// Replace returns text with URLs replaced by URL and email addresses replaced by Email.
+// Punctuation at the end of a URL is taken to end the sentence around it and is kept. If
+// keepDomains is set, each token is followed by a space and the lower case host name of the URL
+// or the domain of the address, so that the domain can still be learned on its own.
+func Replace(text []byte, keepDomains bool) []byte {
+	return addressRE.ReplaceAllFunc(text, func(match []byte) []byte {
+		m := string(match)
+
+		trimmed := strings.TrimRight(m, ".,;:!?")
+		rest := m[len(trimmed):]
+
+		var token, domain string
+
+		if at := strings.LastIndexByte(trimmed, '@'); at >= 0 && !isURL(trimmed) {
+			token, domain = Email, trimmed[at+1:]
+		} else {
+			token, domain = URL, host(trimmed)
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(token)
+		if keepDomains && domain != "" {
+			b.WriteByte(' ')
+			b.WriteString(strings.ToLower(domain))
+		}
+		b.WriteString(rest)
+
+		return b.Bytes()
+	})
+}
+
+// isURL reports whether the match m of addressRE is a URL rather than an email address.
+func isURL(m string) bool {
+	m = strings.ToLower(m)
+
+	for _, prefix := range []string{"http://", "https://", "ftp://", "www."} {
+		if strings.HasPrefix(m, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// host returns the host name of the URL u, without scheme, user info, port and path.
+func host(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	}
+
+	if i := strings.IndexAny(u, "/?#"); i >= 0 {
+		u = u[:i]
+	}
+
+	if i := strings.LastIndexByte(u, '@'); i >= 0 {
+		u = u[i+1:]
+	}
+
+	if i := strings.LastIndexByte(u, ':'); i >= 0 {
+		u = u[:i]
+	}
+
+	return u
+}
@@ -0,0 +1,69 @@
+package features
+
+import (
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	testCases := []struct {
+		text        string
+		want        string
+		wantDomains string
+	}{
+		{
+			"click http://example.com now",
+			"click __URL__ now",
+			"click __URL__ example.com now",
+		},
+		{
+			"see https://shop.Example.org/deals?id=42&ref=mail#top.",
+			"see __URL__.",
+			"see __URL__ shop.example.org.",
+		},
+		{
+			"HTTPS://user:pw@login.example.net:8443/verify, then",
+			"__URL__, then",
+			"__URL__ login.example.net, then",
+		},
+		{
+			"visit www.cheap-pills.biz!",
+			"visit __URL__!",
+			"visit __URL__ www.cheap-pills.biz!",
+		},
+		{
+			"(ftp://files.example.com/a.zip)",
+			"(__URL__)",
+			"(__URL__ files.example.com)",
+		},
+		{
+			"write to Sales.Team+promo@Example.co.uk.",
+			"write to __EMAIL__.",
+			"write to __EMAIL__ example.co.uk.",
+		},
+		{
+			"<mailto:alice@example.com>",
+			"<mailto:__EMAIL__>",
+			"<mailto:__EMAIL__ example.com>",
+		},
+		{
+			"bob@www.example.com and http://a.example/x",
+			"__EMAIL__ and __URL__",
+			"__EMAIL__ www.example.com and __URL__ a.example",
+		},
+		{
+			"no addresses here, just an @ and example.com",
+			"no addresses here, just an @ and example.com",
+			"no addresses here, just an @ and example.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := string(Replace([]byte(tc.text), false)); got != tc.want {
+			t.Errorf("expected %q for %q, got %q", tc.want, tc.text, got)
+		}
+
+		if got := string(Replace([]byte(tc.text), true)); got != tc.wantDomains {
+			t.Errorf("expected %q for %q with domains, got %q", tc.wantDomains, tc.text, got)
+		}
+	}
+}
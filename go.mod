@@ -6,4 +6,5 @@ require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/pkg/errors v0.9.1
 	golang.org/x/sys v0.0.0-20200302150141-5c8b2ff67527 // indirect
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
 )
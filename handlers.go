@@ -1,18 +1,155 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+
+	"mailfilter/bloom"
+	"mailfilter/classifier"
+	"mailfilter/logger"
+	"mailfilter/mbox"
 )
 
+// requireToken returns a handler that only passes requests on to h if they carry token in an
+// "Authorization: Bearer" header, and answers all others with 401. If token is empty, it returns
+// h unchanged.
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		got := strings.TrimPrefix(auth, "Bearer ")
+
+		if got == auth || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mailfilter"`)
+			code := http.StatusUnauthorized
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// rateLimited returns a handler that passes requests on to h as long as limiter allows, and
+// answers all others with 429 and a Retry-After header. If limiter is nil, it returns h
+// unchanged.
+func rateLimited(limiter *rate.Limiter, h http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow() {
+			// Find out when the next request would be allowed, without using that slot up
+			res := limiter.Reserve()
+			delay := res.Delay()
+			res.Cancel()
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			code := http.StatusTooManyRequests
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// errorReader passes reads on to r and remembers the first error other than io.EOF that r
+// returns.
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+
+	return n, err
+}
+
+// readBody reads the body of r, decompressing it if it was sent with "Content-Encoding: gzip".
+// If the body can't be read, it answers the request with an error and returns false: 400 if the
+// body isn't valid gzip, 415 for other encodings and 500 if reading the body failed.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body := &errorReader{r: r.Body}
+
+	var (
+		raw []byte
+		err error
+	)
+
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		raw, err = ioutil.ReadAll(body)
+	case "gzip", "x-gzip":
+		var zr *gzip.Reader
+
+		zr, err = gzip.NewReader(body)
+		if err == nil {
+			raw, err = ioutil.ReadAll(zr)
+		}
+	default:
+		code := http.StatusUnsupportedMediaType
+		http.Error(w, fmt.Sprintf("unsupported content encoding %q", enc), code)
+		return nil, false
+	}
+
+	if err == nil {
+		return raw, true
+	}
+
+	if body.err != nil {
+		logger.Errorf("can't read request body: %s", body.err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+body.err.Error(), code)
+		return nil, false
+	}
+
+	http.Error(w, fmt.Sprintf("malformed gzip body: %s", err), http.StatusBadRequest)
+	return nil, false
+}
+
 func (s *SpamFilter) trainingHandler(w http.ResponseWriter, r *http.Request) {
+	s.handleTraining(w, r, false)
+}
+
+// untrainingHandler undoes training a message, taking the same parameters as trainingHandler.
+func (s *SpamFilter) untrainingHandler(w http.ResponseWriter, r *http.Request) {
+	s.handleTraining(w, r, true)
+}
+
+func (s *SpamFilter) handleTraining(w http.ResponseWriter, r *http.Request, untrain bool) {
 	// Params:
 	// - learn as: spam/ham
 	// - learn factor: int, how hard to learn
-	// Read from r.Body, train, persist after training
+	// - separator: line between concatenated messages, see splitMessages
+	// Read from r.Body, train (or untrain), persist after training
 	defer r.Body.Close()
 
 	if r.Method != http.MethodPost {
@@ -21,6 +158,12 @@ func (s *SpamFilter) trainingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
 	args := r.URL.Query()
 
 	trainAs := args.Get("as")
@@ -31,34 +174,96 @@ func (s *SpamFilter) trainingHandler(w http.ResponseWriter, r *http.Request) {
 	switch trainAs {
 	case "spam", "ham":
 	default:
-		panic(trainAs) // TODO: Handle properly
+		code := http.StatusBadRequest
+		http.Error(w, http.StatusText(code)+": as must be spam or ham", code)
+		return
 	}
 
 	learnFactorArg := args.Get("factor")
 	if learnFactorArg == "" {
 		learnFactorArg = "1"
 	}
-	learnFactor, err := strconv.Atoi(learnFactorArg)
-	if err != nil {
-		panic(err) // TODO: Handle properly
+	learnFactor, err := strconv.ParseUint(learnFactorArg, 10, 64)
+	if err != nil || learnFactor < 1 || (s.maxFactor > 0 && learnFactor > s.maxFactor) {
+		code := http.StatusBadRequest
+		msg := "factor must be a number of at least 1"
+		if s.maxFactor > 0 {
+			msg = fmt.Sprintf("factor must be a number between 1 and %d", s.maxFactor)
+		}
+		http.Error(w, http.StatusText(code)+": "+msg, code)
+		return
+	}
+
+	verb, train, counter := "train", s.train, trainedMessages
+	if untrain {
+		verb, train, counter = "untrain", s.untrain, untrainedMessages
 	}
 
 	start := time.Now()
 	defer func() {
-		log.Printf("training done as %q in %s, persisting", trainAs, time.Since(start))
+		logger.Debugf("%s done as %q in %s, persisting", verb, trainAs, time.Since(start))
 	}()
 
-	log.Println("factor:", learnFactor, "trainAs:", trainAs)
+	logger.Debugf("factor: %d %sAs: %s", learnFactor, verb, trainAs)
 
-	err = s.c.Train(r.Body, trainAs == "spam", uint64(learnFactor))
+	raw, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	msgs, err := splitMessages(raw, args.Get("separator"))
 	if err != nil {
-		log.Printf("can't train message as %s: %s", trainAs, err)
-		code := http.StatusInternalServerError
-		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Fprintln(w, "took", time.Since(start).String(), "to train", r.ContentLength, "bytes as", trainAs, "with factor", learnFactor)
+	skipped := 0
+
+	for i, msg := range msgs {
+		var key string
+
+		if s.trained != nil {
+			key = trainingKey(msg, trainAs == "spam")
+
+			if untrain {
+				s.trained.remove(key)
+			} else if !s.trained.add(key) {
+				logger.Debugf("skipping %s, it was trained recently", key)
+				skipped++
+				continue
+			}
+		}
+
+		err = train(msg, trainAs == "spam", learnFactor)
+		if err != nil {
+			if s.trained != nil && !untrain {
+				// Let retries train the message
+				s.trained.remove(key)
+			}
+
+			logger.Errorf("can't %s message %d of %d as %s: %s", verb, i+1, len(msgs), trainAs, err)
+			code := http.StatusInternalServerError
+			http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+			return
+		}
+
+		counter.Inc(trainAs)
+	}
+
+	if len(msgs) == 1 {
+		if skipped > 0 {
+			fmt.Fprintln(w, "skipped message, it was trained as", trainAs, "recently")
+			return
+		}
+
+		fmt.Fprintln(w, "took", time.Since(start).String(), "to", verb, len(raw), "bytes as", trainAs, "with factor", learnFactor)
+		return
+	}
+
+	fmt.Fprintln(w, "took", time.Since(start).String(), "to", verb, len(msgs)-skipped, "messages in", len(raw), "bytes as", trainAs, "with factor", learnFactor)
+	if skipped > 0 {
+		fmt.Fprintln(w, "skipped", skipped, "messages that were trained as", trainAs, "recently")
+	}
 }
 
 func (s *SpamFilter) classifyHandler(w http.ResponseWriter, r *http.Request) {
@@ -72,28 +277,850 @@ func (s *SpamFilter) classifyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
 	args := r.URL.Query()
 
-	var mode ClassifyMode
+	if args.Get("mode") == "debug-text" {
+		s.debugText(w, r)
+		return
+	}
+
+	mode, err := requestMode(args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if mode == ClassifyPlain {
+		classifyRequests.Inc("plain")
+	} else {
+		classifyRequests.Inc("email")
+	}
+
+	verbose := mode == ClassifyPlain && args.Get("verbose") == "true"
+
+	bands, err := s.requestBands(args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	raw, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	_, err = s.annotate(raw, w, mode, bands, verbose)
+	if err != nil {
+		logger.Errorf("can't classify message: %s", err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+		return
+	}
+}
+
+// debugText writes the segments of the email in the request body as the classifier sees them,
+// decoded and with the headers it ignores removed, instead of classifying it. Each segment is
+// preceded by a line with its weight and zone.
+func (s *SpamFilter) debugText(w http.ResponseWriter, r *http.Request) {
+	raw, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	c := s.classifierFor(raw, ClassifyEmail)
+
+	var out bytes.Buffer
+
+	for i, seg := range s.segments(raw, ClassifyEmail) {
+		text, err := c.Text(seg.Text)
+		if err != nil {
+			logger.Errorf("can't read segment %d of message: %s", i, err)
+			code := http.StatusInternalServerError
+			http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+			return
+		}
+
+		fmt.Fprintf(&out, "--- segment %d, weight %v", i, seg.Weight)
+		if seg.Zone != "" {
+			fmt.Fprintf(&out, ", zone %s", seg.Zone)
+		}
+		fmt.Fprintf(&out, " ---\n%s\n", text)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	_, err := out.WriteTo(w)
+	if err != nil {
+		logger.Errorf("can't write message text: %s", err)
+	}
+}
+
+// requestMode returns the classification mode requested by the mode parameter in args, which
+// defaults to email.
+func requestMode(args url.Values) (ClassifyMode, error) {
 	switch args.Get("mode") {
 	case "", "email":
-		mode = ClassifyEmail
+		return ClassifyEmail, nil
 	case "plain":
-		mode = ClassifyPlain
+		return ClassifyPlain, nil
 	default:
-		http.Error(w, fmt.Sprintf("unexpected mode %q", args.Get("mode")), http.StatusBadRequest)
+		return 0, errors.Errorf("unexpected mode %q", args.Get("mode"))
+	}
+}
+
+// subjectClassification is the classification of a subject line, as served by
+// subjectClassifyHandler.
+type subjectClassification struct {
+	Label    string  `json:"label"`
+	Score    float64 `json:"score"`
+	HamScore float64 `json:"ham_score"`
+}
+
+// subjectClassifyHandler classifies the subject line in the request body as plain text and
+// returns the result as JSON, so that mail clients can check a message before fetching all of
+// it. Surrounding white space is ignored, and rules are not consulted since they match on whole
+// messages.
+func (s *SpamFilter) subjectClassifyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
 		return
 	}
 
-	verbose := mode == ClassifyPlain && args.Get("verbose") == "true"
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	classifyRequests.Inc("subject")
+
+	raw, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := s.verdict(bytes.TrimSpace(raw), ClassifyPlain, nil)
+	if err != nil {
+		logger.Errorf("can't classify subject: %s", err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(subjectClassification{
+		Label:    res.Label,
+		Score:    res.Score,
+		HamScore: res.HamScore,
+	})
+	if err != nil {
+		logger.Errorf("can't write subject classification: %s", err)
+	}
+}
+
+// debugClassification is the classification of a message along with how each of its windows
+// contributed to it, as served by debugClassifyHandler.
+type debugClassification struct {
+	Label    string                   `json:"label"`
+	Score    float64                  `json:"score"`
+	HamScore float64                  `json:"ham_score"`
+	Eta      float64                  `json:"eta"`
+	Tokens   int                      `json:"tokens"`
+	Trace    []classifier.TraceRecord `json:"trace"`
+}
+
+// debugClassifyHandler classifies a message like classifyHandler, but instead of annotating it,
+// it returns the result as JSON along with a record for each scored window. Rules are not
+// consulted, so that the trace shows what the classifier makes of the message.
+func (s *SpamFilter) debugClassifyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	mode, err := requestMode(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	raw, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	trace := []classifier.TraceRecord{}
+
+	res, err := s.classifierFor(raw, mode).ClassifyTraced(s.segments(raw, mode), func(rec classifier.TraceRecord) {
+		trace = append(trace, rec)
+	})
+	if err != nil {
+		logger.Errorf("can't classify message: %s", err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(debugClassification{
+		Label:    res.Label,
+		Score:    res.Score,
+		HamScore: res.HamScore,
+		Eta:      res.Eta,
+		Tokens:   res.Tokens,
+		Trace:    trace,
+	})
+	if err != nil {
+		logger.Errorf("can't write classification trace: %s", err)
+	}
+}
+
+// requestBands returns the label bands of the classifier with the thresholds for "unsure" and
+// "spam" replaced by the thresholdUnsure and thresholdSpam parameters in args, so that they can
+// be tried out without restarting the server. It returns nil if neither parameter is set.
+func (s *SpamFilter) requestBands(args url.Values) ([]classifier.LabelBand, error) {
+	if args.Get("thresholdUnsure") == "" && args.Get("thresholdSpam") == "" {
+		return nil, nil
+	}
+
+	bands := s.c.Labels()
+	if len(bands) != 3 {
+		return nil, errors.Errorf("thresholds can't be overridden with %d label bands", len(bands))
+	}
+
+	for i, name := range []string{"thresholdUnsure", "thresholdSpam"} {
+		arg := args.Get(name)
+		if arg == "" {
+			continue
+		}
+
+		threshold, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", name)
+		}
+
+		bands[i+1].Threshold = threshold
+	}
+
+	if bands[1].Threshold >= bands[2].Threshold {
+		return nil, errors.Errorf("threshold for %q (%v) must be lower than threshold for %q (%v)",
+			bands[1].Label, bands[1].Threshold, bands[2].Label, bands[2].Threshold)
+	}
+
+	err := classifier.ValidateBands(bands)
+	if err != nil {
+		return nil, err
+	}
+
+	return bands, nil
+}
+
+// batchResult is the classification of one message of a batch, as served by
+// batchClassifyHandler. If the message couldn't be classified, Error is set instead of Label.
+type batchResult struct {
+	Index    int     `json:"index"`
+	Label    string  `json:"label,omitempty"`
+	Score    float64 `json:"score"`
+	HamScore float64 `json:"ham_score"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// batchClassifyHandler classifies many messages in one request. They are read from a multipart
+// body, one message per part, or from an mbox for any other content type. The response is a JSON
+// array with the result for each message, which is written as the messages are classified.
+// Messages that can't be classified get an error in their result, but don't abort the batch.
+func (s *SpamFilter) batchClassifyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	var next func() (io.Reader, error)
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		next = func() (io.Reader, error) {
+			return mr.NextPart()
+		}
+	} else {
+		next = mbox.NewReader(r.Body).Next
+	}
+
+	classifyRequests.Inc("batch")
+
+	w.Header().Set("Content-Type", "application/json")
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	// write adds res to the response and sends it on to the client right away
+	write := func(res batchResult) error {
+		if res.Index > 0 {
+			_, err := fmt.Fprint(w, ",")
+			if err != nil {
+				return err
+			}
+		}
+
+		err := enc.Encode(res)
+		if err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		return nil
+	}
+
+	_, err = fmt.Fprint(w, "[")
+	if err != nil {
+		logger.Errorf("can't write batch results: %s", err)
+		return
+	}
+
+	for i := 0; ; i++ {
+		msg, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		res := batchResult{Index: i}
+
+		if err != nil {
+			// The rest of the batch can't be read, report that as the last result
+			logger.Errorf("can't read message %d of batch: %s", i, err)
+			res.Error = err.Error()
+
+			err = write(res)
+			if err != nil {
+				logger.Errorf("can't write batch results: %s", err)
+				return
+			}
+
+			break
+		}
+
+		var label classifier.Result
+
+		raw, err := ioutil.ReadAll(msg)
+		if err == nil {
+			label, _, err = s.judge(raw, ClassifyEmail, nil, nil)
+		}
+
+		if err != nil {
+			logger.Errorf("can't classify message %d of batch: %s", i, err)
+			res.Error = err.Error()
+		} else {
+			res.Label, res.Score, res.HamScore = label.Label, label.Score, label.HamScore
+		}
 
-	err := s.classify(r.Body, w, mode, verbose)
+		err = write(res)
+		if err != nil {
+			logger.Errorf("can't write batch results: %s", err)
+			return
+		}
+	}
+
+	_, err = fmt.Fprintln(w, "]")
+	if err != nil {
+		logger.Errorf("can't write batch results: %s", err)
+	}
+}
+
+// errPathNotAllowed is returned for paths outside of the directory that files may be classified
+// from.
+var errPathNotAllowed = errors.New("path is outside of -classifyDir")
+
+// resolveDir returns the absolute path of the directory dir, with symlinks resolved.
+func resolveDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return "", errors.Errorf("%s is not a directory", dir)
+	}
+
+	return dir, nil
+}
+
+// classifyPath resolves p, which is either absolute or relative to s.classifyDir, to the file it
+// names. Symlinks are resolved before checking that the file is below s.classifyDir, so that
+// neither ".." nor links can escape it. It returns errPathNotAllowed for files outside of
+// s.classifyDir.
+func (s *SpamFilter) classifyPath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(s.classifyDir, p)
+	}
+
+	p, err := filepath.EvalSymlinks(filepath.Clean(p))
 	if err != nil {
-		log.Println("can't classify message:", err)
+		return "", err
+	}
+
+	rel, err := filepath.Rel(s.classifyDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errPathNotAllowed
+	}
+
+	return p, nil
+}
+
+// pathRequest is the body of a request to pathClassifyHandler.
+type pathRequest struct {
+	Path string `json:"path"`
+}
+
+// pathClassification is the classification of a file, as served by pathClassifyHandler.
+type pathClassification struct {
+	Path     string  `json:"path"`
+	Label    string  `json:"label"`
+	Score    float64 `json:"score"`
+	HamScore float64 `json:"ham_score"`
+}
+
+// pathClassifyHandler classifies a file on the server, whose path is passed in a JSON body, and
+// returns the result as JSON. This saves uploading large files that are on the server already.
+// Only files below s.classifyDir can be classified, if it is empty the handler answers 404.
+func (s *SpamFilter) pathClassifyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if s.classifyDir == "" {
+		code := http.StatusNotFound
+		http.Error(w, http.StatusText(code)+": classifying files is disabled", code)
+		return
+	}
+
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	mode, err := requestMode(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req pathRequest
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "can't parse request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Path == "" {
+		http.Error(w, "no path given", http.StatusBadRequest)
+		return
+	}
+
+	path, err := s.classifyPath(req.Path)
+	if errors.Is(err, errPathNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("no such file: %s", req.Path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Errorf("can't resolve %s: %s", req.Path, err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err == nil && !info.Mode().IsRegular() {
+		http.Error(w, fmt.Sprintf("not a regular file: %s", req.Path), http.StatusBadRequest)
+		return
+	}
+
+	classifyRequests.Inc("path")
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Errorf("can't read %s: %s", path, err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	label, _, err := s.judge(raw, mode, nil, nil)
+	if err != nil {
+		logger.Errorf("can't classify %s: %s", path, err)
 		code := http.StatusInternalServerError
 		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(pathClassification{
+		Path:     path,
+		Label:    label.Label,
+		Score:    label.Score,
+		HamScore: label.HamScore,
+	})
+	if err != nil {
+		logger.Errorf("can't write classification of %s: %s", path, err)
+	}
+}
+
+// healthHandler reports that the server is running.
+func (s *SpamFilter) healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler reports whether the server is ready to train and classify messages.
+func (s *SpamFilter) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	fmt.Fprintln(w, "ready")
+}
+
+// versionHandler reports the build information of the running server as JSON.
+func (s *SpamFilter) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(getBuildInfo())
+	if err != nil {
+		logger.Errorf("can't write version: %s", err)
+	}
+}
+
+// filterStats is a point-in-time snapshot of the configuration and databases of a SpamFilter.
+type filterStats struct {
+	Uptime float64 `json:"uptime_seconds"`
+
+	Thresholds struct {
+		Unsure float64 `json:"unsure"`
+		Spam   float64 `json:"spam"`
+	} `json:"thresholds"`
+
+	Sigmoid struct {
+		K        float64 `json:"k"`
+		Midpoint float64 `json:"midpoint"`
+		Max      float64 `json:"max"`
+	} `json:"sigmoid"`
+
+	Labels []labelBand `json:"labels"`
+
+	// Languages lists the languages that have their own classifier
+	Languages []string `json:"languages,omitempty"`
+
+	// Documents holds the number of messages that each classifier was trained with, by the
+	// language of the classifier or "default"
+	Documents map[string]documentCounts `json:"documents"`
+
+	DBs map[string]dbStats `json:"dbs"`
+}
+
+// documentCounts are the approximate numbers of messages trained as spam and ham, each counted
+// with its learn factor, see classifier.Classifier.Documents.
+type documentCounts struct {
+	Spam uint64 `json:"spam"`
+	Ham  uint64 `json:"ham"`
+}
+
+type labelBand struct {
+	Threshold float64 `json:"threshold"`
+	Label     string  `json:"label"`
+}
+
+type dbStats struct {
+	Load  float64 `json:"load"`
+	Max   uint32  `json:"max"`
+	Dirty bool    `json:"dirty"` // has changes that haven't been persisted yet
+}
+
+// statsHandler reports the thresholds, sigmoid and label bands of the classifier, the state of
+// all databases and the uptime of the process as JSON. Computing the database statistics scans
+// all filters, so this is meant for humans, not for frequent polling.
+func (s *SpamFilter) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	var st filterStats
+
+	st.Uptime = time.Since(s.started).Seconds()
+	st.Thresholds.Unsure, st.Thresholds.Spam = s.c.Thresholds()
+
+	sigmoid := s.c.Sigmoid()
+	st.Sigmoid.K, st.Sigmoid.Midpoint, st.Sigmoid.Max = sigmoid.K, sigmoid.Midpoint, sigmoid.Max
+
+	for _, b := range s.c.Labels() {
+		st.Labels = append(st.Labels, labelBand{Threshold: b.Threshold, Label: b.Label})
+	}
+
+	st.Documents = make(map[string]documentCounts, len(s.models)+1)
+
+	var dc documentCounts
+	dc.Spam, dc.Ham = s.c.Documents()
+	st.Documents["default"] = dc
+
+	for l, c := range s.models {
+		st.Languages = append(st.Languages, l)
+
+		dc.Spam, dc.Ham = c.Documents()
+		st.Documents[l] = dc
+	}
+	sort.Strings(st.Languages)
+
+	st.DBs = make(map[string]dbStats, len(s.dbs))
+	for name, db := range s.dbs {
+		bs := db.Stats()
+		st.DBs[name] = dbStats{Load: bs.Load, Max: bs.Max, Dirty: db.Dirty()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(st)
+	if err != nil {
+		logger.Errorf("can't write stats: %s", err)
+	}
+}
+
+// requestDB returns the database named by the db parameter of r, see statsHandler for the
+// names. If there is none, it answers the request with 400 and returns false.
+func (s *SpamFilter) requestDB(w http.ResponseWriter, r *http.Request) (*bloom.DB, string, bool) {
+	name := r.URL.Query().Get("db")
+
+	db, ok := s.dbs[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no database %q", name), http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	return db, name, true
+}
+
+// backupHandler streams a snapshot of the database named by the db parameter, in the format it
+// is persisted in. It can be restored with restoreHandler.
+func (s *SpamFilter) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	db, name, ok := s.requestDB(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ReplaceAll(name, "/", "-")))
+
+	err := db.Backup(w)
+	if err != nil {
+		logger.Errorf("can't write backup of %s: %s", name, err)
+	}
+}
+
+// restoreHandler replaces the database named by the db parameter with the backup in the request
+// body, as written by backupHandler, and persists it. The backup is either the whole body or the
+// first part of a multipart form. Backups of filters with other dimensions are rejected.
+func (s *SpamFilter) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	db, name, ok := s.requestDB(w, r)
+	if !ok {
+		return
+	}
+
+	raw, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var backup io.Reader = bytes.NewReader(raw)
+
+	// Backups can also be uploaded as the first part of a form, like curl -F does
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		part, err := multipart.NewReader(backup, params["boundary"]).NextPart()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("malformed upload: %s", err), http.StatusBadRequest)
+			return
+		}
+		defer part.Close()
+
+		backup = part
+	}
+
+	err = db.Restore(backup)
+	if errors.Is(err, bloom.ErrInvalidFilter) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Errorf("can't restore %s: %s", name, err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+		return
+	}
+
+	logger.Infof("restored %s from a backup", name)
+
+	fmt.Fprintln(w, "restored", name)
+}
+
+// wordStats holds the stored counts of a single window, as served by wordHandler.
+type wordStats struct {
+	Word           string  `json:"word"`
+	Total          uint64  `json:"total"`
+	Ham            uint64  `json:"ham"`
+	Spam           uint64  `json:"spam"`
+	SpamLikelihood float64 `json:"spam_likelihood"`
+}
+
+// wordHandler reports the counts stored for the window passed in the "w" parameter as JSON,
+// which helps with finding out why a message is classified the way it is. The window has to be
+// exactly as long as the windows messages are split into. With the "lang" parameter, the model
+// of that language is used instead of the default one.
+func (s *SpamFilter) wordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if !s.isReady() {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code)+": databases are still loading", code)
+		return
+	}
+
+	args := r.URL.Query()
+
+	c := s.c
+	if l := args.Get("lang"); l != "" {
+		var ok bool
+
+		c, ok = s.models[l]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no model for language %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	text := args.Get("w")
+	if size := c.WindowSize(); size > 0 && len(text) != size {
+		http.Error(w, fmt.Sprintf("word %q is not %d bytes long", text, size), http.StatusBadRequest)
+		return
+	}
+
+	// With -zones, words of email are stored with the prefix of their zone
+	var zone string
+
+	switch args.Get("zone") {
+	case "":
+	case "header":
+		zone = headerZone
+	case "body":
+		zone = bodyZone
+	default:
+		http.Error(w, fmt.Sprintf("unknown zone %q", args.Get("zone")), http.StatusBadRequest)
+		return
+	}
+
+	word, err := c.LookupWord([]byte(zone + text))
+	if err != nil {
+		logger.Errorf("can't look up word %q: %s", text, err)
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(wordStats{
+		Word:           text,
+		Total:          word.Total,
+		Ham:            word.Ham,
+		Spam:           word.Spam,
+		SpamLikelihood: word.SpamLikelihood(),
+	})
+	if err != nil {
+		logger.Errorf("can't write word stats: %s", err)
+	}
 }
 
 func (s *SpamFilter) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,1072 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"mailfilter/bloom"
+)
+
+func TestHandlers_NotReady(t *testing.T) {
+	s := &SpamFilter{}
+
+	testCases := []struct {
+		handler    http.HandlerFunc
+		method     string
+		target     string
+		expectCode int
+	}{
+		{s.classifyHandler, http.MethodPost, "/classify", http.StatusServiceUnavailable},
+		{s.batchClassifyHandler, http.MethodPost, "/classify/batch", http.StatusServiceUnavailable},
+		{s.debugClassifyHandler, http.MethodPost, "/debug/classify", http.StatusServiceUnavailable},
+		{s.trainingHandler, http.MethodPost, "/train?as=spam", http.StatusServiceUnavailable},
+		{s.untrainingHandler, http.MethodPost, "/untrain?as=spam", http.StatusServiceUnavailable},
+		{s.readyHandler, http.MethodGet, "/readyz", http.StatusServiceUnavailable},
+		{s.statsHandler, http.MethodGet, "/stats", http.StatusServiceUnavailable},
+		{s.wordHandler, http.MethodGet, "/word?w=bitcoi", http.StatusServiceUnavailable},
+		{s.backupHandler, http.MethodGet, "/backup?db=total", http.StatusServiceUnavailable},
+		{s.restoreHandler, http.MethodPost, "/restore?db=total", http.StatusServiceUnavailable},
+		{s.healthHandler, http.MethodGet, "/healthz", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader("hello there"))
+
+		tc.handler(rec, req)
+
+		if rec.Code != tc.expectCode {
+			t.Errorf("expected status %d for %s, got %d: %s", tc.expectCode, tc.target, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestHandlers_Ready(t *testing.T) {
+	s := newTestFilter()
+
+	rec := httptest.NewRecorder()
+	s.readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlers_Version(t *testing.T) {
+	s := &SpamFilter{}
+
+	rec := httptest.NewRecorder()
+	s.versionHandler(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var info buildInfo
+
+	err := json.Unmarshal(rec.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if info.Version == "" || info.Commit == "" || info.BuildDate == "" || info.GoVersion == "" {
+		t.Errorf("expected all fields to be set, got %+v", info)
+	}
+}
+
+func TestHandlers_TrainUntrain(t *testing.T) {
+	s := newTestFilter()
+
+	for _, target := range []string{"/train?as=spam&factor=2", "/untrain?as=spam&factor=2"} {
+		handler := s.trainingHandler
+		if strings.HasPrefix(target, "/untrain") {
+			handler = s.untrainingHandler
+		}
+
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader("buy cheap bitcoin")))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s: %s", rec.Code, target, rec.Body.String())
+		}
+	}
+
+	res, err := s.c.Classify(strings.NewReader("buy cheap bitcoin"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "unsure" || res.Eta != 0 {
+		t.Errorf("expected untrained text to be unknown, got %s", res)
+	}
+}
+
+func TestHandlers_TrainConcatenated(t *testing.T) {
+	msgs := []string{
+		"Subject: one\n\ncheap bitcoin\n",
+		"Subject: two\n\ncheap pills\n",
+		"Subject: three\n\ncheap loans\n",
+	}
+
+	testCases := []struct {
+		target string
+		body   string
+	}{
+		{"/train?as=spam&separator=--next--", strings.Join(msgs, "--next--\n")},
+		{"/train?as=spam", "From a@example.com Mon Jan  1 00:00:00 2024\n" + strings.Join(msgs, "\nFrom a@example.com Mon Jan  1 00:00:00 2024\n")},
+	}
+
+	for _, tc := range testCases {
+		s := newTestFilter()
+
+		rec := httptest.NewRecorder()
+		s.trainingHandler(rec, httptest.NewRequest(http.MethodPost, tc.target, strings.NewReader(tc.body)))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s: %s", rec.Code, tc.target, rec.Body.String())
+		}
+
+		if !strings.Contains(rec.Body.String(), "train 3 messages") {
+			t.Errorf("expected three messages to be trained for %s, got %q", tc.target, rec.Body.String())
+		}
+
+		// Each message is a training sample of its own, and no ngram spans two of them
+		for word, want := range map[string]uint64{"cheap ": 3, "Subjec": 3, "-next-": 0, "From a": 0} {
+			w, err := s.c.LookupWord([]byte(word))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if w.Spam != want {
+				t.Errorf("expected count %d for %q with %s, got %d", want, word, tc.target, w.Spam)
+			}
+		}
+	}
+}
+
+func TestHandlers_TrainInvalid(t *testing.T) {
+	s := newTestFilter()
+	s.maxFactor = 10
+
+	testCases := []struct {
+		target string
+		code   int
+	}{
+		{"/train?as=spam&factor=-1", http.StatusBadRequest},
+		{"/train?as=spam&factor=0", http.StatusBadRequest},
+		{"/train?as=spam&factor=11", http.StatusBadRequest},
+		{"/train?as=spam&factor=18446744073709551616", http.StatusBadRequest},
+		{"/train?as=spam&factor=lots", http.StatusBadRequest},
+		{"/untrain?as=spam&factor=-1", http.StatusBadRequest},
+		{"/untrain?as=spam&factor=11", http.StatusBadRequest},
+		{"/train?as=foo", http.StatusBadRequest},
+		{"/train?as=foo&factor=1", http.StatusBadRequest},
+		{"/untrain?as=foo", http.StatusBadRequest},
+		{"/train?as=spam&factor=10", http.StatusOK},
+		{"/untrain?as=spam&factor=10", http.StatusOK},
+		{"/train?as=spam", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		handler := s.trainingHandler
+		if strings.HasPrefix(tc.target, "/untrain") {
+			handler = s.untrainingHandler
+		}
+
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, tc.target, strings.NewReader("buy cheap bitcoin")))
+
+		if rec.Code != tc.code {
+			t.Errorf("expected status %d for %s, got %d: %s", tc.code, tc.target, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Only the last request trained anything
+	w, err := s.c.LookupWord([]byte("cheap "))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w.Spam != 1 {
+		t.Errorf("expected rejected requests not to train, got count %d", w.Spam)
+	}
+}
+
+func TestHandlers_TrainDedup(t *testing.T) {
+	s := newTestFilter()
+	s.trained = newTrainedSet(10)
+
+	const msg = "Message-ID: <1234@example.com>\r\nSubject: hi\r\n\r\nbuy cheap bitcoin\r\n"
+
+	train := func(target string) string {
+		handler := s.trainingHandler
+		if strings.HasPrefix(target, "/untrain") {
+			handler = s.untrainingHandler
+		}
+
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(msg)))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s: %s", rec.Code, target, rec.Body.String())
+		}
+
+		return rec.Body.String()
+	}
+
+	count := func() uint64 {
+		w, err := s.c.LookupWord([]byte("cheap "))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return w.Spam
+	}
+
+	train("/train?as=spam")
+	if got := count(); got != 1 {
+		t.Fatalf("expected count 1 after training, got %d", got)
+	}
+
+	if body := train("/train?as=spam"); !strings.Contains(body, "skipped") {
+		t.Errorf("expected response to note the skipped message, got %q", body)
+	}
+
+	if got := count(); got != 1 {
+		t.Errorf("expected count to stay 1 after training the message again, got %d", got)
+	}
+
+	// Untraining makes the message trainable again
+	train("/untrain?as=spam")
+	train("/train?as=spam")
+
+	if got := count(); got != 1 {
+		t.Errorf("expected count 1 after untraining and training again, got %d", got)
+	}
+}
+
+func TestHandlers_Gzip(t *testing.T) {
+	s := newTestFilter()
+
+	gzipped := func(text string) *bytes.Buffer {
+		var buf bytes.Buffer
+
+		zw := gzip.NewWriter(&buf)
+
+		_, err := zw.Write([]byte(text))
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return &buf
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/train?as=spam", gzipped("buy cheap bitcoin"))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	rec := httptest.NewRecorder()
+	s.trainingHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	res, err := s.c.Classify(strings.NewReader("buy cheap bitcoin"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "spam" {
+		t.Errorf("expected gzipped text to be trained as spam, got %s", res)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/classify?mode=plain", gzipped("buy cheap bitcoin"))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	rec = httptest.NewRecorder()
+	s.classifyHandler(rec, req)
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `label="spam"`) {
+		t.Errorf("expected gzipped text to be classified as spam, got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	truncated := gzipped("buy cheap bitcoin").Bytes()
+	truncated = truncated[:len(truncated)-4]
+
+	testCases := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		expectCode int
+	}{
+		{"not gzip", "gzip", []byte("buy cheap bitcoin"), http.StatusBadRequest},
+		{"truncated", "gzip", truncated, http.StatusBadRequest},
+		{"unsupported", "br", []byte("buy cheap bitcoin"), http.StatusUnsupportedMediaType},
+	}
+
+	for _, tc := range testCases {
+		for target, handler := range map[string]http.HandlerFunc{
+			"/train?as=spam":       s.trainingHandler,
+			"/classify?mode=plain": s.classifyHandler,
+		} {
+			req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(tc.body))
+			req.Header.Set("Content-Encoding", tc.encoding)
+
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tc.expectCode {
+				t.Errorf("expected status %d for %s body on %s, got %d: %s", tc.expectCode, tc.name, target, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestHandlers_ClassifyThresholds(t *testing.T) {
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("cheap pills online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = s.c.Train(strings.NewReader("lunch tomorrow at noon"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The message scores about 0.99995, which is spam with the default thresholds
+	testCases := []struct {
+		target      string
+		expectCode  int
+		expectLabel string
+	}{
+		{"/classify?mode=plain", http.StatusOK, "spam"},
+		{"/classify?mode=plain&thresholdUnsure=0.99999&thresholdSpam=0.999999", http.StatusOK, "ham"},
+		{"/classify?mode=plain&thresholdUnsure=0.9999&thresholdSpam=0.99999", http.StatusOK, "unsure"},
+		{"/classify?mode=plain&thresholdSpam=0.2", http.StatusBadRequest, ""},
+		{"/classify?mode=plain&thresholdUnsure=1.5&thresholdSpam=2", http.StatusBadRequest, ""},
+		{"/classify?mode=plain&thresholdUnsure=lots", http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		s.classifyHandler(rec, httptest.NewRequest(http.MethodPost, tc.target, strings.NewReader("cheap pills at noon")))
+
+		if rec.Code != tc.expectCode {
+			t.Errorf("expected status %d for %s, got %d: %s", tc.expectCode, tc.target, rec.Code, rec.Body.String())
+			continue
+		}
+
+		if tc.expectLabel != "" && !strings.Contains(rec.Body.String(), fmt.Sprintf("label=%q", tc.expectLabel)) {
+			t.Errorf("expected label %q for %s, got %s", tc.expectLabel, tc.target, rec.Body.String())
+		}
+	}
+
+	if unsure, spam := s.c.Thresholds(); unsure != 0.3 || spam != 0.7 {
+		t.Errorf("expected thresholds of the classifier to be unchanged, got %v and %v", unsure, spam)
+	}
+}
+
+func TestHandlers_DebugClassify(t *testing.T) {
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("cheap pills online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.debugClassifyHandler(rec, httptest.NewRequest(http.MethodPost, "/debug/classify?mode=plain", strings.NewReader("cheap pills at noon")))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var res debugClassification
+
+	err = json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// "cheap pills at noon" has 14 windows of 6 bytes
+	if res.Tokens != 14 || len(res.Trace) != res.Tokens {
+		t.Fatalf("expected one record for each of the 14 scored windows, got %d tokens and %d records", res.Tokens, len(res.Trace))
+	}
+
+	if res.Trace[0].Token != "cheap " || res.Trace[0].Spam != 1 {
+		t.Errorf("expected first record to be the spam window \"cheap \", got %+v", res.Trace[0])
+	}
+
+	if last := res.Trace[len(res.Trace)-1]; last.Token != "t noon" || last.Eta != res.Eta || last.Score != res.Score {
+		t.Errorf("expected last record to end at η %f and score %f, got %+v", res.Eta, res.Score, last)
+	}
+
+	if res.Label != "spam" {
+		t.Errorf("expected message to be spam, got %+v", res)
+	}
+
+	rec = httptest.NewRecorder()
+	s.debugClassifyHandler(rec, httptest.NewRequest(http.MethodPost, "/debug/classify?mode=fancy", strings.NewReader("cheap pills")))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an unknown mode, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlers_ClassifyDebugText(t *testing.T) {
+	s := newTestFilter()
+	s.excludeHeaders = []string{"Received"}
+
+	// "<p>Buy <b>cheap</b> pills</p>" as base64, next to an attachment
+	const msg = "Received: from mx.example.com\r\n" +
+		"Subject: offer\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PHA+QnV5IDxiPmNoZWFwPC9iPiBwaWxsczwvcD4=\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAECAwQFBgc=\r\n" +
+		"--b--\r\n"
+
+	rec := httptest.NewRecorder()
+	s.classifyHandler(rec, httptest.NewRequest(http.MethodPost, "/classify?mode=debug-text", strings.NewReader(msg)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	body := rec.Body.String()
+
+	for _, want := range []string{"--- segment 0, weight 1 ---\n", "Subject: offer\n", "Buy cheap pills"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the text, got %q", want, body)
+		}
+	}
+
+	for _, unwanted := range []string{"Received", "PHA+", "AAECAwQFBgc=", "<p>"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("expected no %q in the text, got %q", unwanted, body)
+		}
+	}
+
+	// Nothing was classified
+	if w, err := s.c.LookupWord([]byte("cheap ")); err != nil || w.Total != 0 {
+		t.Errorf("expected debug-text not to train, got %+v, %v", w, err)
+	}
+}
+
+func TestHandlers_ClassifySubject(t *testing.T) {
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("cheap pills, best prices online"), true, 1)
+	if err == nil {
+		err = s.c.Train(strings.NewReader("minutes of the meeting on tuesday"), false, 1)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.subjectClassifyHandler(rec, httptest.NewRequest(http.MethodPost, "/classify/subject", strings.NewReader("Cheap pills at best prices\r\n")))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var res subjectClassification
+
+	err = json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "spam" || res.Score <= res.HamScore {
+		t.Errorf("expected spammy subject to be spam, got %+v", res)
+	}
+
+	rec = httptest.NewRecorder()
+	s.subjectClassifyHandler(rec, httptest.NewRequest(http.MethodGet, "/classify/subject", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for GET, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestHandlers_ClassifyPath(t *testing.T) {
+	tmp := t.TempDir()
+
+	root := filepath.Join(tmp, "allowed")
+	err := os.Mkdir(root, 0700)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	write := func(path, content string) {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	write(filepath.Join(root, "spam.txt"), "cheap pills, best prices online")
+	write(filepath.Join(tmp, "secret.txt"), "cheap pills, best prices online")
+
+	err = os.Symlink(filepath.Join(tmp, "secret.txt"), filepath.Join(root, "link.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s := newTestFilter()
+
+	err = s.c.Train(strings.NewReader("cheap pills, best prices online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	classify := func(path string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(pathRequest{Path: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		rec := httptest.NewRecorder()
+		s.pathClassifyHandler(rec, httptest.NewRequest(http.MethodPost, "/classify/path?mode=plain", bytes.NewReader(body)))
+
+		return rec
+	}
+
+	if rec := classify("spam.txt"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d without -classifyDir, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	s.classifyDir, err = resolveDir(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, path := range []string{"spam.txt", filepath.Join(root, "spam.txt"), "sub/../spam.txt"} {
+		rec := classify(path)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s: %s", rec.Code, path, rec.Body.String())
+		}
+
+		var res pathClassification
+
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if res.Label != "spam" || filepath.Base(res.Path) != "spam.txt" {
+			t.Errorf("expected %s to be classified as spam, got %+v", path, res)
+		}
+	}
+
+	testCases := []struct {
+		path string
+		code int
+	}{
+		{"../secret.txt", http.StatusForbidden},
+		{filepath.Join(tmp, "secret.txt"), http.StatusForbidden},
+		{"link.txt", http.StatusForbidden},
+		{"/etc/passwd", http.StatusForbidden},
+		{"missing.txt", http.StatusNotFound},
+		{".", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		rec := classify(tc.path)
+		if rec.Code != tc.code {
+			t.Errorf("expected status %d for %q, got %d: %s", tc.code, tc.path, rec.Code, rec.Body.String())
+		}
+
+		if strings.Contains(rec.Body.String(), "label") {
+			t.Errorf("expected %q not to be classified, got %s", tc.path, rec.Body.String())
+		}
+	}
+}
+
+func TestHandlers_Stats(t *testing.T) {
+	db, err := bloom.NewDB(t.TempDir(), "total")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("hello"), 1)
+
+	s := newTestFilter()
+	s.started = time.Now().Add(-time.Minute)
+	s.dbs = map[string]*bloom.DB{"total": db}
+
+	for _, target := range []string{"/train?as=spam", "/train?as=spam&factor=2", "/train?as=ham"} {
+		rec := httptest.NewRecorder()
+		s.trainingHandler(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader("buy cheap bitcoin")))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s: %s", rec.Code, target, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.statsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var st filterStats
+
+	err = json.Unmarshal(rec.Body.Bytes(), &st)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if st.Uptime < 60 {
+		t.Errorf("expected an uptime of at least a minute, got %fs", st.Uptime)
+	}
+
+	if st.Thresholds.Unsure != 0.3 || st.Thresholds.Spam != 0.7 {
+		t.Errorf("unexpected thresholds %+v", st.Thresholds)
+	}
+
+	if st.Sigmoid.K != 5 || st.Sigmoid.Midpoint != 0.5 || st.Sigmoid.Max != 1 {
+		t.Errorf("unexpected sigmoid %+v", st.Sigmoid)
+	}
+
+	if len(st.Labels) != 3 || st.Labels[2].Label != "spam" || st.Labels[2].Threshold != 0.7 {
+		t.Errorf("unexpected labels %+v", st.Labels)
+	}
+
+	if docs := st.Documents["default"]; docs.Spam != 3 || docs.Ham != 1 {
+		t.Errorf("expected 3 spam and 1 ham documents, got %+v", st.Documents)
+	}
+
+	total, ok := st.DBs["total"]
+	if !ok {
+		t.Fatalf("expected stats for db total, got %+v", st.DBs)
+	}
+
+	if total.Load <= 0 || total.Max != 1 || !total.Dirty {
+		t.Errorf("unexpected stats for db total: %+v", total)
+	}
+}
+
+func TestHandlers_BackupRestore(t *testing.T) {
+	db, err := bloom.NewDB(t.TempDir(), "spam")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("bitcoin"), 3)
+
+	s := newTestFilter()
+	s.dbs = map[string]*bloom.DB{"de/spam": db}
+
+	rec := httptest.NewRecorder()
+	s.backupHandler(rec, httptest.NewRequest(http.MethodGet, "/backup?db=de/spam", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="de-spam"` {
+		t.Errorf("unexpected content disposition %q", cd)
+	}
+
+	backup := rec.Body.Bytes()
+
+	root := t.TempDir()
+
+	fresh, err := bloom.NewDB(root, "spam")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	restored := newTestFilter()
+	restored.dbs = map[string]*bloom.DB{"spam": fresh}
+
+	testCases := []struct {
+		target     string
+		body       []byte
+		expectCode int
+	}{
+		{"/restore?db=ham", backup, http.StatusBadRequest},
+		{"/restore?db=spam", backup[:len(backup)/2], http.StatusBadRequest},
+		{"/restore?db=spam", backup, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		restored.restoreHandler(rec, httptest.NewRequest(http.MethodPost, tc.target, bytes.NewReader(tc.body)))
+
+		if rec.Code != tc.expectCode {
+			t.Errorf("expected status %d for %s with %d bytes, got %d: %s", tc.expectCode, tc.target, len(tc.body), rec.Code, rec.Body.String())
+		}
+	}
+
+	reloaded, err := bloom.NewDB(root, "spam")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, db := range []*bloom.DB{fresh, reloaded} {
+		if s := db.Score([]byte("bitcoin")); s != 3 {
+			t.Errorf("expected restored score 3, got %v", s)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.backupHandler(rec, httptest.NewRequest(http.MethodGet, "/backup?db=nope", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an unknown database, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandlers_RestoreUpload(t *testing.T) {
+	known, err := bloom.NewDB(t.TempDir(), "spam")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	words := map[string]uint64{"bitcoin": 3, "cheap pills": 7, "fnord": 1}
+	for w, n := range words {
+		known.Add([]byte(w), n)
+	}
+
+	var filter bytes.Buffer
+
+	err = known.Backup(&filter)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	upload := func(data []byte) (*bytes.Buffer, string) {
+		var body bytes.Buffer
+
+		mw := multipart.NewWriter(&body)
+
+		fw, err := mw.CreateFormFile("filter", "spam.bak")
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return &body, mw.FormDataContentType()
+	}
+
+	db, err := bloom.NewDB(t.TempDir(), "spam")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	db.Add([]byte("hello"), 2)
+
+	s := newTestFilter()
+	s.dbs = map[string]*bloom.DB{"spam": db}
+
+	// A filter with other dimensions, such as a single row, is rejected
+	body, contentType := upload(filter.Bytes()[:len(filter.Bytes())/16])
+
+	req := httptest.NewRequest(http.MethodPost, "/restore?db=spam", body)
+	req.Header.Set("Content-Type", contentType)
+
+	rec := httptest.NewRecorder()
+	s.restoreHandler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a filter with other dimensions, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	if got := db.Score([]byte("hello")); got != 2 {
+		t.Errorf("expected rejected upload to leave the filter unchanged, got score %v", got)
+	}
+
+	body, contentType = upload(filter.Bytes())
+
+	req = httptest.NewRequest(http.MethodPost, "/restore?db=spam", body)
+	req.Header.Set("Content-Type", contentType)
+
+	rec = httptest.NewRecorder()
+	s.restoreHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for w, n := range words {
+		if got := db.Score([]byte(w)); got != n {
+			t.Errorf("expected score %v for %q after restoring, got %v", n, w, got)
+		}
+	}
+
+	if got := db.Score([]byte("hello")); got != 0 {
+		t.Errorf("expected restoring to replace the old filter, got score %v", got)
+	}
+}
+
+func TestHandlers_Word(t *testing.T) {
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("buy bitcoin"), true, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = s.c.Train(strings.NewReader("bitcoin news"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.wordHandler(rec, httptest.NewRequest(http.MethodGet, "/word?w=bitcoi", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var word wordStats
+
+	err = json.Unmarshal(rec.Body.Bytes(), &word)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if word.Word != "bitcoi" || word.Total != 4 || word.Spam != 3 || word.Ham != 1 || word.SpamLikelihood != 0.75 {
+		t.Errorf("unexpected word stats %+v", word)
+	}
+
+	for _, target := range []string{"/word?w=bit", "/word?w=bitcoi&lang=de"} {
+		rec := httptest.NewRecorder()
+		s.wordHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d: %s", http.StatusBadRequest, target, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestHandlers_ClassifyBatch(t *testing.T) {
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("cheap pills online"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = s.c.Train(strings.NewReader("lunch tomorrow"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	messages := []string{
+		"Subject: offer\n\ncheap pills online\n",
+		"Subject: lunch\n\nlunch tomorrow\n",
+		"Subject: something else\n\nquarterly zebra figures\n",
+	}
+
+	expect := []string{"spam", "ham", "unsure"}
+
+	check := func(t *testing.T, rec *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var results []batchResult
+
+		err := json.Unmarshal(rec.Body.Bytes(), &results)
+		if err != nil {
+			t.Fatalf("unexpected error: %s in %q", err, rec.Body.String())
+		}
+
+		if len(results) != len(expect) {
+			t.Fatalf("expected %d results, got %+v", len(expect), results)
+		}
+
+		for i, res := range results {
+			if res.Index != i || res.Label != expect[i] || res.Error != "" {
+				t.Errorf("expected label %q for message %d, got %+v", expect[i], i, res)
+			}
+		}
+	}
+
+	t.Run("mbox", func(t *testing.T) {
+		var body strings.Builder
+		for _, msg := range messages {
+			body.WriteString("From bob@example.com Thu Jan  1 00:00:00 1970\n" + msg + "\n")
+		}
+
+		rec := httptest.NewRecorder()
+		s.batchClassifyHandler(rec, httptest.NewRequest(http.MethodPost, "/classify/batch", strings.NewReader(body.String())))
+
+		check(t, rec)
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		var body bytes.Buffer
+
+		mw := multipart.NewWriter(&body)
+		for _, msg := range messages {
+			part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			_, err = part.Write([]byte(msg))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		err := mw.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/classify/batch", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		rec := httptest.NewRecorder()
+		s.batchClassifyHandler(rec, req)
+
+		check(t, rec)
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		// A subject that is known spam and weighs this much pushes η out of range
+		s.boostHeaders = []string{"Subject"}
+		s.headerWeight = math.MaxFloat64
+		defer func() { s.boostHeaders, s.headerWeight = nil, 0 }()
+
+		var body strings.Builder
+		for _, msg := range []string{messages[1], "Subject: cheap pills online\n\nhello\n", messages[1]} {
+			body.WriteString("From bob@example.com Thu Jan  1 00:00:00 1970\n" + msg + "\n")
+		}
+
+		rec := httptest.NewRecorder()
+		s.batchClassifyHandler(rec, httptest.NewRequest(http.MethodPost, "/classify/batch", strings.NewReader(body.String())))
+
+		var results []batchResult
+
+		err := json.Unmarshal(rec.Body.Bytes(), &results)
+		if err != nil {
+			t.Fatalf("unexpected error: %s in %q", err, rec.Body.String())
+		}
+
+		if len(results) != 3 || results[0].Error != "" || results[1].Error == "" || results[2].Error != "" {
+			t.Errorf("expected only the second message to fail, got %+v", results)
+		}
+	})
+}
+
+func TestHandlers_RequireToken(t *testing.T) {
+	s := newTestFilter()
+
+	testCases := []struct {
+		name       string
+		token      string
+		auth       string
+		expectCode int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusOK},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"prefix of token", "s3cret", "Bearer s3", http.StatusUnauthorized},
+		{"not a bearer token", "s3cret", "s3cret", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/train?as=ham", strings.NewReader("lunch tomorrow"))
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+
+			rec := httptest.NewRecorder()
+			requireToken(tc.token, s.trainingHandler)(rec, req)
+
+			if rec.Code != tc.expectCode {
+				t.Fatalf("expected status %d, got %d: %s", tc.expectCode, rec.Code, rec.Body.String())
+			}
+
+			if tc.expectCode == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected a WWW-Authenticate header")
+			}
+		})
+	}
+
+	// Rejected requests must not have trained anything
+	word, err := s.c.LookupWord([]byte("lunch "))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if word.Ham != 2 {
+		t.Errorf("expected only the two authorized requests to train, got %s", word)
+	}
+}
+
+func TestHandlers_RateLimited(t *testing.T) {
+	s := newTestFilter()
+
+	handler := rateLimited(rate.NewLimiter(rate.Every(time.Minute), 2), s.trainingHandler)
+
+	var limited int
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/train?as=spam", strings.NewReader("buy bitcoin")))
+
+		switch rec.Code {
+		case http.StatusOK:
+		case http.StatusTooManyRequests:
+			limited++
+
+			if retry := rec.Header().Get("Retry-After"); retry == "" || retry == "0" {
+				t.Errorf("expected a Retry-After header, got %q", retry)
+			}
+		default:
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	if limited != 3 {
+		t.Errorf("expected 3 of 5 requests to be limited, got %d", limited)
+	}
+}
@@ -0,0 +1,141 @@
+// Package lang guesses the language of texts by comparing the ranks of their most frequent
+// character trigrams with those of sample texts in known languages, as described by Cavnar and
+// Trenkle in "N-Gram-Based Text Categorization".
+package lang
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ProfileSize is the number of most frequent trigrams that are compared.
+const ProfileSize = 300
+
+// MinTrigrams is the number of distinct trigrams a text needs to have for its language to be
+// detected.
+const MinTrigrams = 20
+
+// A profile maps the most frequent trigrams of a text to their rank.
+type profile map[string]int
+
+// newProfile returns the profile of text.
+func newProfile(text string) profile {
+	counts := make(map[string]int)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	for _, w := range words {
+		runes := []rune(" " + w + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			counts[string(runes[i:i+3])]++
+		}
+	}
+
+	trigrams := make([]string, 0, len(counts))
+	for t := range counts {
+		trigrams = append(trigrams, t)
+	}
+
+	sort.Slice(trigrams, func(i, j int) bool {
+		a, b := trigrams[i], trigrams[j]
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+
+		return a < b
+	})
+
+	if len(trigrams) > ProfileSize {
+		trigrams = trigrams[:ProfileSize]
+	}
+
+	p := make(profile, len(trigrams))
+	for rank, t := range trigrams {
+		p[t] = rank
+	}
+
+	return p
+}
+
+// distance returns the "out of place" distance between p and the profile of a language. Lower
+// is closer.
+func (p profile) distance(language profile) int {
+	d := 0
+
+	for t, rank := range p {
+		langRank, ok := language[t]
+		if !ok {
+			d += ProfileSize
+			continue
+		}
+
+		if langRank > rank {
+			d += langRank - rank
+		} else {
+			d += rank - langRank
+		}
+	}
+
+	return d
+}
+
+// A Detector guesses the language of texts. The zero value knows no languages.
+type Detector struct {
+	profiles map[string]profile
+}
+
+// Learn sets the profile of the language with the given name to that of sample. The sample
+// should be at least a few paragraphs of typical text.
+func (d *Detector) Learn(name, sample string) {
+	if d.profiles == nil {
+		d.profiles = make(map[string]profile)
+	}
+
+	d.profiles[name] = newProfile(sample)
+}
+
+// Languages returns the names of the languages d knows, in alphabetical order.
+func (d *Detector) Languages() []string {
+	var names []string
+	for name := range d.profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Detect returns the name of the known language that is closest to that of text. ok is false if
+// text is too short to tell, or if d doesn't know any languages.
+func (d *Detector) Detect(text string) (name string, ok bool) {
+	p := newProfile(text)
+	if len(p) < MinTrigrams {
+		return "", false
+	}
+
+	best := -1
+	for _, n := range d.Languages() {
+		dist := p.distance(d.profiles[n])
+		if best < 0 || dist < best {
+			name, best = n, dist
+		}
+	}
+
+	return name, best >= 0
+}
+
+// Default returns a Detector that knows English ("en"), German ("de"), French ("fr") and Spanish
+// ("es").
+func Default() *Detector {
+	d := &Detector{}
+
+	for name, sample := range samples {
+		d.Learn(name, sample)
+	}
+
+	return d
+}
@@ -0,0 +1,40 @@
+package lang
+
+import (
+	"testing"
+)
+
+func TestDetector_Detect(t *testing.T) {
+	d := Default()
+
+	testCases := []struct {
+		text string
+		want string
+	}{
+		{"Congratulations! You have been selected to receive a free gift card. Click the link below to claim your prize before it expires.", "en"},
+		{"Hallo zusammen, ich wollte nur kurz fragen, ob wir uns morgen wie geplant im Büro treffen oder lieber verschieben sollen.", "de"},
+		{"Bonjour à tous, je voulais simplement savoir si nous nous retrouvons toujours demain au bureau comme prévu.", "fr"},
+		{"Hola a todos, solo quería preguntar si seguimos quedando mañana en la oficina como habíamos dicho.", "es"},
+	}
+
+	for _, tc := range testCases {
+		got, ok := d.Detect(tc.text)
+		if !ok || got != tc.want {
+			t.Errorf("%q: expected %q, got %q (ok=%t)", tc.text, tc.want, got, ok)
+		}
+	}
+}
+
+func TestDetector_TooShort(t *testing.T) {
+	d := Default()
+
+	_, ok := d.Detect("hi")
+	if ok {
+		t.Errorf("expected no language for a very short text")
+	}
+
+	_, ok = (&Detector{}).Detect("This is a long enough text, but the detector doesn't know any language.")
+	if ok {
+		t.Errorf("expected no language from an empty detector")
+	}
+}
@@ -0,0 +1,62 @@
+package lang
+
+// samples holds a few paragraphs of everyday text for each language that Default knows.
+var samples = map[string]string{
+	"en": `Thank you for your message. I have been thinking about what you said last week, and
+I believe that we should meet again before the end of the month to talk about the next steps.
+There are still a few questions that we need to answer, and it would be good if everyone
+could join the meeting. Please let me know which day works best for you and your team.
+The weather has been very nice here, so we spent most of the weekend outside with the children.
+We went to the lake on Saturday and had dinner with some friends in the evening. On Sunday it
+was raining, and we stayed at home and read books. I hope that you are doing well and that the
+new house is everything you wanted it to be. If you need any help with the move, just give me
+a call. I would be happy to come over and carry some boxes. Our company is growing quickly,
+and we are looking for people who want to work with us on interesting projects. This is an
+opportunity to learn something new every day, and the salary is better than you might think.
+When you have time, you should take a look at the information on our website and send us
+your application. We will get back to you as soon as possible.`,
+
+	"de": `Vielen Dank für Ihre Nachricht. Ich habe noch einmal über das nachgedacht, was Sie
+letzte Woche gesagt haben, und ich glaube, dass wir uns vor dem Ende des Monats noch einmal
+treffen sollten, um über die nächsten Schritte zu sprechen. Es gibt noch einige Fragen, die
+wir beantworten müssen, und es wäre gut, wenn alle an der Besprechung teilnehmen könnten.
+Bitte lassen Sie mich wissen, welcher Tag für Sie und Ihr Team am besten passt. Das Wetter
+war hier sehr schön, deshalb haben wir den größten Teil des Wochenendes mit den Kindern
+draußen verbracht. Am Samstag sind wir zum See gefahren und haben am Abend mit Freunden
+gegessen. Am Sonntag hat es geregnet, und wir sind zu Hause geblieben und haben Bücher
+gelesen. Ich hoffe, dass es dir gut geht und dass das neue Haus so ist, wie du es dir
+gewünscht hast. Wenn du Hilfe beim Umzug brauchst, ruf mich einfach an. Ich komme gerne
+vorbei und trage ein paar Kisten. Unser Unternehmen wächst schnell, und wir suchen Menschen,
+die mit uns an spannenden Projekten arbeiten wollen. Das ist eine Gelegenheit, jeden Tag
+etwas Neues zu lernen, und das Gehalt ist besser, als man vielleicht denkt. Wenn Sie Zeit
+haben, schauen Sie sich die Informationen auf unserer Webseite an und schicken Sie uns Ihre
+Bewerbung. Wir melden uns so schnell wie möglich bei Ihnen.`,
+
+	"fr": `Merci pour votre message. J'ai encore réfléchi à ce que vous avez dit la semaine
+dernière, et je pense que nous devrions nous revoir avant la fin du mois pour parler des
+prochaines étapes. Il reste encore quelques questions auxquelles nous devons répondre, et ce
+serait bien si tout le monde pouvait participer à la réunion. Merci de me dire quel jour vous
+convient le mieux, à vous et à votre équipe. Il a fait très beau ici, alors nous avons passé
+la plus grande partie du week-end dehors avec les enfants. Samedi, nous sommes allés au lac et
+nous avons dîné avec des amis le soir. Dimanche, il pleuvait, et nous sommes restés à la
+maison pour lire des livres. J'espère que tu vas bien et que la nouvelle maison est comme tu
+la voulais. Si tu as besoin d'aide pour le déménagement, appelle-moi. Je viendrai avec plaisir
+porter quelques cartons. Notre entreprise se développe rapidement, et nous cherchons des
+personnes qui veulent travailler avec nous sur des projets intéressants. C'est une occasion
+d'apprendre quelque chose de nouveau chaque jour, et le salaire est meilleur que vous ne le
+pensez. Quand vous aurez le temps, regardez les informations sur notre site et envoyez-nous
+votre candidature. Nous vous répondrons dès que possible.`,
+
+	"es": `Gracias por tu mensaje. He estado pensando en lo que dijiste la semana pasada, y creo
+que deberíamos reunirnos otra vez antes de que termine el mes para hablar de los próximos
+pasos. Todavía quedan algunas preguntas que tenemos que responder, y sería bueno que todos
+pudieran participar en la reunión. Por favor, dime qué día te viene mejor a ti y a tu equipo.
+Aquí ha hecho muy buen tiempo, así que pasamos la mayor parte del fin de semana fuera con los
+niños. El sábado fuimos al lago y por la noche cenamos con unos amigos. El domingo llovía, y
+nos quedamos en casa leyendo libros. Espero que estés bien y que la casa nueva sea todo lo que
+querías. Si necesitas ayuda con la mudanza, llámame. Me encantaría ir a ayudarte a llevar
+algunas cajas. Nuestra empresa está creciendo rápidamente, y buscamos personas que quieran
+trabajar con nosotros en proyectos interesantes. Es una oportunidad para aprender algo nuevo
+cada día, y el sueldo es mejor de lo que piensas. Cuando tengas tiempo, mira la información
+en nuestra página web y envíanos tu solicitud. Te responderemos lo antes posible.`,
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/smtp"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/lmtp"
+	"mailfilter/logger"
+)
+
+// lmtpHandler returns a handler for the LMTP server that classifies each message like classify
+// in email mode and relays the annotated message to the SMTP server at nextHop.
+func (s *SpamFilter) lmtpHandler(nextHop string) lmtp.Handler {
+	return func(from string, to []string, data []byte) []error {
+		if !s.isReady() {
+			return failAll(make([]error, len(to)), errors.New("databases are still loading"))
+		}
+
+		var out bytes.Buffer
+
+		err := s.classify(bytes.NewReader(data), &out, ClassifyEmail, false)
+		if err != nil {
+			return failAll(make([]error, len(to)), errors.Wrap(err, "classifying message"))
+		}
+
+		return relay(nextHop, from, to, out.Bytes())
+	}
+}
+
+// relay sends msg from the sender from to the recipients in to via the SMTP server at nextHop. It
+// returns one error per recipient, which is nil if the next hop accepted the message for that
+// recipient.
+func relay(nextHop, from string, to []string, msg []byte) []error {
+	errs := make([]error, len(to))
+
+	c, err := smtp.Dial(nextHop)
+	if err != nil {
+		return failAll(errs, errors.Wrap(err, "connecting to next hop"))
+	}
+	defer c.Close()
+
+	err = c.Mail(from)
+	if err != nil {
+		return failAll(errs, errors.Wrap(err, "sending sender to next hop"))
+	}
+
+	accepted := 0
+	for i, rcpt := range to {
+		err := c.Rcpt(rcpt)
+		if err != nil {
+			errs[i] = errors.Wrap(err, "next hop rejected recipient")
+			continue
+		}
+
+		accepted++
+	}
+
+	if accepted == 0 {
+		return errs
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return failAll(errs, errors.Wrap(err, "starting data transfer to next hop"))
+	}
+
+	_, err = w.Write(msg)
+	if err != nil {
+		return failAll(errs, errors.Wrap(err, "sending message to next hop"))
+	}
+
+	err = w.Close()
+	if err != nil {
+		return failAll(errs, errors.Wrap(err, "sending message to next hop"))
+	}
+
+	err = c.Quit()
+	if err != nil {
+		// The message has been accepted already
+		logger.Infof("can't close connection to next hop: %s", err)
+	}
+
+	return errs
+}
+
+// failAll sets all errors in errs that are nil to err and returns errs.
+func failAll(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,369 @@
+// Package lmtp implements a minimal LMTP server (RFC 2033), which MTAs can use to hand messages
+// to a local delivery agent.
+package lmtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mailfilter/logger"
+)
+
+// A Handler delivers the message in data from the sender from to the recipients in to. The lines
+// of data end in "\n", with the dot-stuffing of the transfer already removed. It returns
+// one error per recipient, which is nil if the message was delivered to that recipient. Errors
+// that are a *textproto.Error are reported to the client with their code, all others as a
+// temporary failure.
+type Handler func(from string, to []string, data []byte) []error
+
+// A Server accepts LMTP connections and passes the messages it receives to a Handler.
+type Server struct {
+	Handler Handler
+
+	// Hostname is used in the greeting and the response to LHLO
+	Hostname string
+
+	// MaxMessageBytes is the size of the largest message that is accepted. Larger messages are
+	// rejected for all recipients. 0 means no limit.
+	MaxMessageBytes int64
+
+	// Timeout limits how long reading a command or a whole message, and writing a reply, may
+	// take. Connections that exceed it are closed. 0 means no limit.
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// ErrServerClosed is returned by Serve after Close was called.
+var ErrServerClosed = errors.New("lmtp: server closed")
+
+// Serve accepts connections on l and serves each of them in a new goroutine. It always returns a
+// non-nil error and closes l.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		go func() {
+			err := s.serveConn(conn)
+			if err != nil {
+				logger.Errorf("lmtp connection from %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops all listeners that were passed to Serve. Connections that are already established
+// are served until the client closes them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		cerr := l.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname == "" {
+		return "localhost"
+	}
+
+	return s.Hostname
+}
+
+// session holds the state of one LMTP connection.
+type session struct {
+	srv  *Server
+	c    net.Conn
+	conn *textproto.Conn
+
+	from    string
+	hasFrom bool
+	to      []string
+}
+
+func (s *Server) serveConn(c net.Conn) error {
+	conn := textproto.NewConn(c)
+	defer conn.Close()
+
+	sess := &session{srv: s, c: c, conn: conn}
+
+	err := sess.reply(220, s.hostname()+" LMTP mailfilter ready")
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := sess.deadline()
+		if err != nil {
+			return err
+		}
+
+		line, err := conn.ReadLine()
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return fmt.Errorf("reading command: %w", err)
+		}
+		if err != nil {
+			// The client went away without saying QUIT
+			return nil
+		}
+
+		quit, err := sess.handle(line)
+		if err != nil {
+			return err
+		}
+
+		if quit {
+			return nil
+		}
+	}
+}
+
+// deadline sets the deadline for the next command, message or reply, if the server has a timeout.
+func (s *session) deadline() error {
+	if s.srv.Timeout <= 0 {
+		return nil
+	}
+
+	err := s.c.SetDeadline(time.Now().Add(s.srv.Timeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	return nil
+}
+
+func (s *session) reply(code int, lines ...string) error {
+	err := s.deadline()
+	if err != nil {
+		return err
+	}
+
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+
+		err := s.conn.PrintfLine("%d%s%s", code, sep, l)
+		if err != nil {
+			return fmt.Errorf("writing reply: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// reset forgets the current transaction.
+func (s *session) reset() {
+	s.from = ""
+	s.hasFrom = false
+	s.to = nil
+}
+
+// handle handles a command from the client and reports whether the connection should be closed.
+func (s *session) handle(line string) (bool, error) {
+	verb, arg := line, ""
+	if idx := strings.IndexByte(line, ' '); idx >= 0 {
+		verb, arg = line[:idx], strings.TrimSpace(line[idx+1:])
+	}
+
+	switch strings.ToUpper(verb) {
+	case "LHLO":
+		s.reset()
+
+		ext := []string{s.srv.hostname(), "8BITMIME", "PIPELINING"}
+		if s.srv.MaxMessageBytes > 0 {
+			ext = append(ext, "SIZE "+strconv.FormatInt(s.srv.MaxMessageBytes, 10))
+		}
+
+		return false, s.reply(250, ext...)
+	case "HELO", "EHLO":
+		return false, s.reply(500, "This is an LMTP server, use LHLO")
+	case "MAIL":
+		if s.hasFrom {
+			return false, s.reply(503, "Sender already given")
+		}
+
+		addr, ok := parsePath(arg, "FROM:")
+		if !ok {
+			return false, s.reply(501, "Syntax: MAIL FROM:<address>")
+		}
+
+		s.from = addr
+		s.hasFrom = true
+
+		return false, s.reply(250, "OK")
+	case "RCPT":
+		if !s.hasFrom {
+			return false, s.reply(503, "Need MAIL first")
+		}
+
+		addr, ok := parsePath(arg, "TO:")
+		if !ok || addr == "" {
+			return false, s.reply(501, "Syntax: RCPT TO:<address>")
+		}
+
+		s.to = append(s.to, addr)
+
+		return false, s.reply(250, "OK")
+	case "DATA":
+		if len(s.to) == 0 {
+			return false, s.reply(503, "Need RCPT first")
+		}
+
+		return false, s.data()
+	case "RSET":
+		s.reset()
+
+		return false, s.reply(250, "OK")
+	case "NOOP":
+		return false, s.reply(250, "OK")
+	case "QUIT":
+		return true, s.reply(221, "Bye")
+	default:
+		return false, s.reply(502, "Command not implemented")
+	}
+}
+
+// data reads a message and replies with the delivery status for each recipient.
+func (s *session) data() error {
+	defer s.reset()
+
+	err := s.reply(354, "End data with <CR><LF>.<CR><LF>")
+	if err != nil {
+		return err
+	}
+
+	err = s.deadline()
+	if err != nil {
+		return err
+	}
+
+	dot := s.conn.DotReader()
+
+	r := dot
+	if s.srv.MaxMessageBytes > 0 {
+		r = io.LimitReader(dot, s.srv.MaxMessageBytes+1)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading message: %w", err)
+	}
+
+	if s.srv.MaxMessageBytes > 0 && int64(len(data)) > s.srv.MaxMessageBytes {
+		// Skip the rest of the message, so that the next command is read from the right place
+		_, err := io.Copy(ioutil.Discard, dot)
+		if err != nil {
+			return fmt.Errorf("reading message: %w", err)
+		}
+
+		for _, rcpt := range s.to {
+			err := s.reply(552, fmt.Sprintf("<%s>: Message exceeds the maximum size of %d bytes", rcpt, s.srv.MaxMessageBytes))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	errs := s.srv.Handler(s.from, s.to, data)
+
+	for i, rcpt := range s.to {
+		var rcptErr error
+		if i < len(errs) {
+			rcptErr = errs[i]
+		}
+
+		if rcptErr == nil {
+			err = s.reply(250, "OK <"+rcpt+">")
+		} else {
+			code := 451
+
+			var tpErr *textproto.Error
+			if errors.As(rcptErr, &tpErr) {
+				code = tpErr.Code
+			}
+
+			logger.Errorf("can't deliver message to %s: %s", rcpt, rcptErr)
+
+			err = s.reply(code, "<"+rcpt+">: "+strings.ReplaceAll(rcptErr.Error(), "\n", " "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parsePath parses the "FROM:<address>" and "TO:<address>" arguments of MAIL and RCPT. Parameters
+// after the address are ignored.
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+
+	return arg[1:end], true
+}
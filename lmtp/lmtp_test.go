@@ -0,0 +1,215 @@
+package lmtp
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Deliver(t *testing.T) {
+	var (
+		gotFrom string
+		gotTo   []string
+		gotData string
+	)
+
+	s := &Server{
+		Hostname: "mx.example.org",
+		Handler: func(from string, to []string, data []byte) []error {
+			gotFrom, gotTo, gotData = from, to, string(data)
+
+			return []error{
+				nil,
+				&textproto.Error{Code: 550, Msg: "no such user"},
+				errors.New("next hop is down"),
+			}
+		},
+	}
+
+	client, server := net.Pipe()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serveConn(server)
+	}()
+
+	c := textproto.NewConn(client)
+	defer c.Close()
+
+	expect := func(code int) {
+		t.Helper()
+
+		_, _, err := c.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("expected %d: %s", code, err)
+		}
+	}
+
+	cmd := func(code int, format string, args ...interface{}) {
+		t.Helper()
+
+		err := c.PrintfLine(format, args...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expect(code)
+	}
+
+	expect(220)
+	cmd(500, "EHLO client.example.com")
+	cmd(250, "LHLO client.example.com")
+	cmd(503, "RCPT TO:<alice@example.org>")
+	cmd(250, "MAIL FROM:<bob@example.com> BODY=8BITMIME")
+	cmd(250, "RCPT TO:<alice@example.org>")
+	cmd(250, "RCPT TO:<nobody@example.org>")
+	cmd(250, "RCPT TO:<carol@example.org>")
+	cmd(354, "DATA")
+
+	w := c.DotWriter()
+	_, err := w.Write([]byte("Subject: hello\r\n\r\n.leading dot\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	w.Close()
+
+	// One reply per recipient
+	expect(250)
+	expect(550)
+	expect(451)
+
+	cmd(221, "QUIT")
+
+	err = <-errs
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if gotFrom != "bob@example.com" {
+		t.Errorf("unexpected sender %q", gotFrom)
+	}
+
+	if len(gotTo) != 3 || gotTo[0] != "alice@example.org" || gotTo[2] != "carol@example.org" {
+		t.Errorf("unexpected recipients %q", gotTo)
+	}
+
+	if gotData != "Subject: hello\n\n.leading dot\n" {
+		t.Errorf("unexpected message %q", gotData)
+	}
+}
+
+func TestServer_MaxMessageBytes(t *testing.T) {
+	var got []string
+
+	s := &Server{
+		MaxMessageBytes: 100,
+		Handler: func(from string, to []string, data []byte) []error {
+			got = append(got, string(data))
+
+			return nil
+		},
+	}
+
+	client, server := net.Pipe()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serveConn(server)
+	}()
+
+	c := textproto.NewConn(client)
+	defer c.Close()
+
+	cmd := func(code int, format string, args ...interface{}) string {
+		t.Helper()
+
+		err := c.PrintfLine(format, args...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		_, msg, err := c.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("expected %d: %s", code, err)
+		}
+
+		return msg
+	}
+
+	send := func(msg string, codes ...int) {
+		t.Helper()
+
+		cmd(250, "MAIL FROM:<bob@example.com>")
+		cmd(250, "RCPT TO:<alice@example.org>")
+		cmd(250, "RCPT TO:<carol@example.org>")
+		cmd(354, "DATA")
+
+		w := c.DotWriter()
+		w.Write([]byte(msg))
+		w.Close()
+
+		for _, code := range codes {
+			_, _, err := c.ReadResponse(code)
+			if err != nil {
+				t.Fatalf("expected %d: %s", code, err)
+			}
+		}
+	}
+
+	c.ReadResponse(220)
+
+	if ext := cmd(250, "LHLO client.example.com"); !strings.Contains(ext, "SIZE 100") {
+		t.Errorf("expected SIZE extension, got %q", ext)
+	}
+
+	send("Subject: big\r\n\r\n"+strings.Repeat("spam spam spam\r\n", 100), 552, 552)
+	send("Subject: small\r\n\r\nhi\r\n", 250, 250)
+
+	cmd(221, "QUIT")
+
+	err := <-errs
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(got) != 1 || got[0] != "Subject: small\n\nhi\n" {
+		t.Errorf("expected only the small message to be delivered, got %q", got)
+	}
+}
+
+func TestServer_Timeout(t *testing.T) {
+	s := &Server{
+		Timeout: 50 * time.Millisecond,
+		Handler: func(from string, to []string, data []byte) []error {
+			return nil
+		},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serveConn(server)
+	}()
+
+	c := textproto.NewConn(client)
+
+	_, _, err := c.ReadResponse(220)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Never send a command
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("expected an error for a client that doesn't send anything")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection to time out")
+	}
+}
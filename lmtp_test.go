@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"mailfilter/lmtp"
+)
+
+// fakeSMTP is an SMTP server that accepts messages for all recipients except reject, and sends
+// the messages it received to msgs.
+type fakeSMTP struct {
+	reject string
+	msgs   chan string
+}
+
+func (f *fakeSMTP) serve(t *testing.T, l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn := textproto.NewConn(c)
+			defer conn.Close()
+
+			conn.PrintfLine("220 fake ESMTP")
+
+			for {
+				line, err := conn.ReadLine()
+				if err != nil {
+					return
+				}
+
+				switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+				case "RCPT":
+					if strings.Contains(line, "<"+f.reject+">") {
+						conn.PrintfLine("550 no such user")
+						continue
+					}
+
+					conn.PrintfLine("250 OK")
+				case "DATA":
+					conn.PrintfLine("354 go ahead")
+
+					msg, err := ioutil.ReadAll(conn.DotReader())
+					if err != nil {
+						t.Errorf("can't read message: %s", err)
+						return
+					}
+
+					f.msgs <- string(msg)
+
+					conn.PrintfLine("250 OK")
+				case "QUIT":
+					conn.PrintfLine("221 bye")
+					return
+				default:
+					conn.PrintfLine("250 OK")
+				}
+			}
+		}()
+	}
+}
+
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+
+	return l
+}
+
+// deliver delivers msg over LMTP to the server at addr and returns the reply codes for each
+// recipient.
+func deliver(t *testing.T, addr string, to []string, msg string) []int {
+	t.Helper()
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("can't connect: %s", err)
+	}
+	defer c.Close()
+
+	cmd := func(code int, format string, args ...interface{}) {
+		t.Helper()
+
+		id, err := c.Cmd(format, args...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+
+		_, _, err = c.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+	}
+
+	_, _, err = c.ReadResponse(220)
+	if err != nil {
+		t.Fatalf("unexpected greeting: %s", err)
+	}
+
+	cmd(250, "LHLO client.example.com")
+	cmd(250, "MAIL FROM:<bob@example.com>")
+	for _, rcpt := range to {
+		cmd(250, "RCPT TO:<%s>", rcpt)
+	}
+	cmd(354, "DATA")
+
+	w := c.DotWriter()
+	w.Write([]byte(msg))
+	w.Close()
+
+	var codes []int
+	for range to {
+		code, _, _ := c.ReadResponse(0)
+		codes = append(codes, code)
+	}
+
+	return codes
+}
+
+func TestSpamFilter_LMTPRelay(t *testing.T) {
+	backend := &fakeSMTP{reject: "nobody@example.org", msgs: make(chan string, 1)}
+
+	bl := listenLocal(t)
+	defer bl.Close()
+
+	go backend.serve(t, bl)
+
+	s := newTestFilter()
+	srv := &lmtp.Server{Handler: s.lmtpHandler(bl.Addr().String())}
+
+	l := listenLocal(t)
+	defer srv.Close()
+
+	go srv.Serve(l)
+
+	codes := deliver(t, l.Addr().String(), []string{"alice@example.org", "nobody@example.org"}, "Subject: hello\r\n\r\njust checking in\r\n")
+	if len(codes) != 2 || codes[0] != 250 || codes[1] != 550 {
+		t.Errorf("expected codes [250 550], got %v", codes)
+	}
+
+	msg := <-backend.msgs
+
+	header, body := splitHeader(t, msg)
+	if !strings.Contains(header, "\nX-Mailfilter: label=") {
+		t.Errorf("expected relayed message to be classified, got %q", msg)
+	}
+
+	if body != "just checking in\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestSpamFilter_LMTPNextHopDown(t *testing.T) {
+	// Find an address that nothing listens on
+	bl := listenLocal(t)
+	nextHop := bl.Addr().String()
+	bl.Close()
+
+	s := newTestFilter()
+	srv := &lmtp.Server{Handler: s.lmtpHandler(nextHop)}
+
+	l := listenLocal(t)
+	defer srv.Close()
+
+	go srv.Serve(l)
+
+	codes := deliver(t, l.Addr().String(), []string{"alice@example.org", "carol@example.org"}, "Subject: hello\r\n\r\nbody\r\n")
+	if len(codes) != 2 || codes[0] != 451 || codes[1] != 451 {
+		t.Errorf("expected temporary failures, got %v", codes)
+	}
+}
@@ -0,0 +1,78 @@
+// Package logger provides leveled logging on top of the standard log package.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// A Level is the severity of a log message.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("Level(%d)", l)
+	}
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for _, l := range []Level{Debug, Info, Error} {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+var current = int32(Info)
+
+// SetLevel sets the lowest level of messages that are logged.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&current, int32(l))
+}
+
+// Enabled reports whether messages with the given level are logged.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&current)
+}
+
+func output(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+
+	// Skip output and the exported function that called it
+	_ = log.Output(3, l.String()+": "+fmt.Sprintf(format, args...))
+}
+
+// Debugf logs a message at debug level, with arguments handled like fmt.Printf.
+func Debugf(format string, args ...interface{}) {
+	output(Debug, format, args...)
+}
+
+// Infof logs a message at info level, with arguments handled like fmt.Printf.
+func Infof(format string, args ...interface{}) {
+	output(Info, format, args...)
+}
+
+// Errorf logs a message at error level, with arguments handled like fmt.Printf.
+func Errorf(format string, args ...interface{}) {
+	output(Error, format, args...)
+}
@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+
+	out := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer log.SetFlags(flags)
+
+	defer SetLevel(Info)
+
+	testCases := []struct {
+		level Level
+		want  []string
+	}{
+		{Debug, []string{"debug: d", "info: i", "error: e"}},
+		{Info, []string{"info: i", "error: e"}},
+		{Error, []string{"error: e"}},
+	}
+
+	for _, tc := range testCases {
+		buf.Reset()
+		SetLevel(tc.level)
+
+		Debugf("d")
+		Infof("i")
+		Errorf("e")
+
+		have := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if strings.Join(tc.want, "|") != strings.Join(have, "|") {
+			t.Errorf("unexpected output at level %s: want %q, have %q", tc.level, tc.want, have)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "INFO", "Error"} {
+		l, err := ParseLevel(name)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", name, err)
+		}
+
+		if !strings.EqualFold(l.String(), name) {
+			t.Errorf("unexpected level %s for %q", l, name)
+		}
+	}
+
+	_, err := ParseLevel("verbose")
+	if err == nil {
+		t.Errorf("expected error for unknown level")
+	}
+}
@@ -1,7 +1,8 @@
 // Mailfilter is a naive bayesian spam filter. It takes RFC2046-formatted mail on standard input
 // and writes it to standard output, annotated with a spam score.
 //
-// For training, many messages can be concatenated and fed to standard input.
+// For training, many messages can be concatenated and posted to /train, either as an mbox or
+// separated by a line passed as the separator parameter.
 //
 // Diagnostic messages will be written to stderr.
 package main
@@ -13,7 +14,9 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -21,17 +24,341 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 
 	"mailfilter/bloom"
 	"mailfilter/classifier"
+	"mailfilter/lang"
+	"mailfilter/lmtp"
+	"mailfilter/logger"
+	"mailfilter/metrics"
+	"mailfilter/milter"
 )
 
+var _ classifier.BatchDB = (*bloom.DB)(nil)
+
 type SpamFilter struct {
 	c *classifier.Classifier
+
+	// Contents of these headers are tokenized separately when classifying email, and their
+	// contribution to the result is multiplied by headerWeight.
+	boostHeaders []string
+	headerWeight float64
+
+	// If includeHeaders is not empty, only the headers listed in it are fed to the classifier
+	// along with the message text. Headers listed in excludeHeaders never are. Neither applies
+	// to boostHeaders.
+	includeHeaders []string
+	excludeHeaders []string
+
+	// If zones is set, the windows of the headers and of the body of email are prefixed with
+	// headerZone and bodyZone when training and classifying, so that they are counted
+	// separately.
+	zones bool
+
+	// If reclassify is set, messages that already carry a verdict header are classified again
+	// and the old verdict is replaced. Otherwise, they are passed through unchanged.
+	reclassify bool
+
+	// headerStyle selects the verdict headers that are added to email
+	headerStyle HeaderStyle
+
+	// headerName is the name of the header that holds the verdict in the mailfilter style. If it
+	// is empty, verdictHeader is used.
+	headerName string
+
+	// audit records each classification if it is not nil
+	audit *AuditLog
+
+	// detector guesses the language of messages. Messages in a language that has a classifier in
+	// models are classified and trained with that classifier, all others with c.
+	detector *lang.Detector
+	models   map[string]*classifier.Classifier
+
+	// meta, if set, combines c with models that split messages differently. It trains and
+	// classifies the messages that would go to c.
+	meta *classifier.MetaClassifier
+
+	// rules force the verdict for some senders in email mode, before the classifier is consulted
+	rules *Rules
+
+	// dbs holds the databases of all classifiers by name, for statsHandler. It is set before s
+	// becomes ready.
+	dbs map[string]*bloom.DB
+
+	// classifyDir is the directory that /classify/path may read files from, with symlinks
+	// resolved. If it is empty, /classify/path is disabled.
+	classifyDir string
+
+	// maxFactor is the largest learn factor that /train and /untrain accept, 0 for no limit
+	maxFactor uint64
+
+	// trained remembers recently trained messages, so that /train skips them if they are
+	// trained again. It is nil if /train trains every message.
+	trained *trainedSet
+
+	// started is the time the process started
+	started time.Time
+
+	// ready is set to 1 once c is usable, i.e. all databases have been loaded
+	ready int32
+}
+
+// classifierFor returns the classifier for the language of the message in raw.
+func (s *SpamFilter) classifierFor(raw []byte, how ClassifyMode) *classifier.Classifier {
+	if len(s.models) == 0 {
+		return s.c
+	}
+
+	text := raw
+	if how == ClassifyEmail {
+		body, err := extractBody(raw)
+		if err == nil {
+			text = body
+		}
+	}
+
+	name, ok := s.detector.Detect(string(text))
+	if !ok {
+		return s.c
+	}
+
+	c, ok := s.models[name]
+	if !ok {
+		return s.c
+	}
+
+	logger.Debugf("using model for language %q", name)
+
+	return c
+}
+
+// A model trains and classifies messages. It is either a single classifier or a
+// classifier.MetaClassifier.
+type model interface {
+	Train(in io.Reader, spam bool, learnFactor uint64) error
+	TrainSegments(segments []classifier.Segment, spam bool, learnFactor uint64) error
+	UntrainSegments(segments []classifier.Segment, spam bool, learnFactor uint64) error
+	ClassifySegments(segments []classifier.Segment, verbose io.Writer) (classifier.Result, error)
+}
+
+// modelFor returns the model for the message in raw, which is the classifier for its language,
+// or s.meta instead of s.c if it is set.
+func (s *SpamFilter) modelFor(raw []byte, how ClassifyMode) model {
+	c := s.classifierFor(raw, how)
+	if c == s.c && s.meta != nil {
+		return s.meta
+	}
+
+	return c
+}
+
+// train trains the email in raw as spam or ham with the model for its language. The email is
+// split into the same segments it is classified with, so that the ngrams of decoded text are
+// trained rather than those of its transfer encoding.
+func (s *SpamFilter) train(raw []byte, spam bool, factor uint64) error {
+	return s.modelFor(raw, ClassifyEmail).TrainSegments(s.segments(raw, ClassifyEmail), spam, factor)
+}
+
+// untrain undoes training the email in raw as spam or ham with the model for its language.
+func (s *SpamFilter) untrain(raw []byte, spam bool, factor uint64) error {
+	return s.modelFor(raw, ClassifyEmail).UntrainSegments(s.segments(raw, ClassifyEmail), spam, factor)
+}
+
+// setReady marks s as ready to train and classify messages. c must not be changed afterwards.
+func (s *SpamFilter) setReady() {
+	atomic.StoreInt32(&s.ready, 1)
+}
+
+// isReady reports whether s is ready to train and classify messages.
+func (s *SpamFilter) isReady() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// Zones that the windows of email are prefixed with if SpamFilter.zones is set.
+const (
+	headerZone = "H:"
+	bodyZone   = "B:"
+)
+
+// verdictHeader is the default name of the header that holds the classification result.
+const verdictHeader = "X-Mailfilter"
+
+// ValidateHeaderName returns an error if name is not a legal header field name, which consists of
+// printable ASCII characters other than the colon (RFC 5322, section 2.2).
+func ValidateHeaderName(name string) error {
+	if name == "" {
+		return errors.New("empty header name")
+	}
+
+	for _, c := range []byte(name) {
+		if c < '!' || c > '~' || c == ':' {
+			return errors.Errorf("header name %q contains illegal character %q", name, c)
+		}
+	}
+
+	return nil
+}
+
+// verdictHeaderName returns the name of the header that holds the verdict in the mailfilter
+// style.
+func (s *SpamFilter) verdictHeaderName() string {
+	if s.headerName == "" {
+		return verdictHeader
+	}
+
+	return s.headerName
+}
+
+// Names of the headers that SpamAssassin adds to messages. Existing mail setups usually match
+// on "X-Spam-Status: Yes" or "X-Spam-Flag: YES".
+const (
+	spamStatusHeader = "X-Spam-Status"
+	spamFlagHeader   = "X-Spam-Flag"
+)
+
+// spamAssassinRequired is the score above which SpamAssassin considers messages spam by default.
+const spamAssassinRequired = 5.0
+
+// A HeaderStyle selects the headers that hold the verdict for email.
+type HeaderStyle int
+
+const (
+	HeaderMailfilter   HeaderStyle = iota // X-Mailfilter
+	HeaderSpamAssassin                    // X-Spam-Status and X-Spam-Flag, like SpamAssassin
+	HeaderBoth                            // all of the above
+)
+
+// ParseHeaderStyle returns the HeaderStyle with the given name, which is one of "mailfilter",
+// "spamassassin" or "both".
+func ParseHeaderStyle(name string) (HeaderStyle, error) {
+	switch name {
+	case "mailfilter":
+		return HeaderMailfilter, nil
+	case "spamassassin":
+		return HeaderSpamAssassin, nil
+	case "both":
+		return HeaderBoth, nil
+	default:
+		return 0, errors.Errorf("unknown header style %q", name)
+	}
+}
+
+// ParseLabelBands parses a comma separated list of label bands in the form "threshold:label",
+// for example "0:clean,0.3:suspect,0.7:junk". The bands are validated with
+// classifier.ValidateBands.
+func ParseLabelBands(spec string) ([]classifier.LabelBand, error) {
+	var bands []classifier.LabelBand
+
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("label band %q is not in the form threshold:label", field)
+		}
+
+		threshold, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "threshold of label band %q", field)
+		}
+
+		bands = append(bands, classifier.LabelBand{Threshold: threshold, Label: parts[1]})
+	}
+
+	err := classifier.ValidateBands(bands)
+	if err != nil {
+		return nil, err
+	}
+
+	return bands, nil
+}
+
+// names returns the names of the headers that h adds to messages, with verdict as the name of the
+// header of the mailfilter style.
+func (h HeaderStyle) names(verdict string) []string {
+	switch h {
+	case HeaderSpamAssassin:
+		return []string{spamStatusHeader, spamFlagHeader}
+	case HeaderBoth:
+		return []string{verdict, spamStatusHeader, spamFlagHeader}
+	default:
+		return []string{verdict}
+	}
+}
+
+// A headerField is a header field that holds (part of) a verdict.
+type headerField struct {
+	name  string
+	value string
+}
+
+// verdictFields returns the header fields for label in the style selected by s.headerStyle.
+// verdict is the value of the header named by s.headerName.
+func (s *SpamFilter) verdictFields(label classifier.Result, verdict string) []headerField {
+	var fields []headerField
+
+	if s.headerStyle != HeaderSpamAssassin {
+		fields = append(fields, headerField{s.verdictHeaderName(), verdict})
+	}
+
+	if s.headerStyle != HeaderMailfilter {
+		// Messages labeled with the last band are spam. Map the score onto SpamAssassin's scale,
+		// such that the threshold of that band ends up at the score that SpamAssassin requires
+		// for spam.
+		bands := s.c.Labels()
+		top := bands[len(bands)-1]
+
+		thresholdSpam := top.Threshold
+		if thresholdSpam <= 0 {
+			_, thresholdSpam = s.c.Thresholds()
+		}
+
+		score := label.Score / thresholdSpam * spamAssassinRequired
+
+		status := "No"
+		if len(bands) > 1 && label.Label == top.Label {
+			status = "Yes"
+			fields = append(fields, headerField{spamFlagHeader, "YES"})
+		}
+
+		fields = append(fields, headerField{
+			spamStatusHeader,
+			fmt.Sprintf("%s, score=%.1f required=%.1f", status, score, spamAssassinRequired),
+		})
+	}
+
+	return fields
+}
+
+// verdictHeaders returns the header lines for label in the style selected by s.headerStyle,
+// terminated by eol. verdict is the value of the header named by s.headerName.
+func (s *SpamFilter) verdictHeaders(label classifier.Result, verdict, eol string) string {
+	var b strings.Builder
+
+	for _, f := range s.verdictFields(label, verdict) {
+		fmt.Fprintf(&b, "%s: %s%s", f.name, f.value, eol)
+	}
+
+	return b.String()
+}
+
+// alreadyClassified returns the name of a verdict header in the style of s.headerStyle that is
+// present in msg. ok is false if there is none.
+func (s *SpamFilter) alreadyClassified(msg []byte) (name string, ok bool) {
+	for _, name := range s.headerStyle.names(s.verdictHeaderName()) {
+		if hasHeader(msg, name) {
+			return name, true
+		}
+	}
+
+	return "", false
 }
 
 type ClassifyMode int
@@ -44,169 +371,1216 @@ const (
 // classify reads a text from in, asks the given classifier to classify
 // it as either spam or ham and writes it to out. The text is assumed to
 // be a single RFC2046-encoded message, and the verdict is added as a
-// header with the name `X-Mailfilter`.
+// header named by s.headerName (`X-Mailfilter` by default), or as
+// SpamAssassin-style headers, depending on s.headerStyle.
+//
+// In email mode, the parts of MIME multipart messages are decoded and only their textual
+// content is fed to the classifier. The message itself is written back unchanged, apart
+// from existing verdict headers which are replaced if s.reclassify is set. If one of s.rules
+// matches the message, the rule's verdict is used instead of asking the classifier, and the
+// verdict header notes the matching rule.
 func (s *SpamFilter) classify(in io.Reader, out io.Writer, how ClassifyMode, verbose bool) error {
-	var msg bytes.Buffer
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		return errors.Wrap(err, "reading message")
+	}
+
+	_, err = s.annotate(raw, out, how, nil, verbose)
+
+	return err
+}
+
+// pipe classifies the email in in and writes the annotated message to out, for use as a filter
+// in procmail or .forward. Nothing is written to out if the message can't be classified, so
+// that the caller can fall back to delivering the original message.
+func (s *SpamFilter) pipe(in io.Reader, out io.Writer) error {
+	var buf bytes.Buffer
+
+	err := s.classify(in, &buf, ClassifyEmail, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, &buf)
+	if err != nil {
+		return errors.Wrap(err, "writing message")
+	}
+
+	return nil
+}
+
+// ClassifyAndRoute classifies the email in in like classify and writes the annotated message to
+// the writer in routes that matches its label. Messages whose label has no route, as well as
+// messages that are passed through unchanged because they have already been classified, are
+// written to routes[""]. It is an error if there is no writer for a message.
+func (s *SpamFilter) ClassifyAndRoute(in io.Reader, routes map[string]io.Writer) error {
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		return errors.Wrap(err, "reading message")
+	}
+
+	var out bytes.Buffer
+
+	label, err := s.annotate(raw, &out, ClassifyEmail, nil, false)
+	if err != nil {
+		return err
+	}
+
+	w, ok := routes[label]
+	if !ok {
+		w, ok = routes[""]
+	}
+	if !ok {
+		return errors.Errorf("no route for label %q", label)
+	}
+
+	_, err = io.Copy(w, &out)
+	if err != nil {
+		return errors.Wrapf(err, "writing message labeled %q", label)
+	}
 
+	return nil
+}
+
+// annotate does the work of classify for the message in raw. If bands is not nil, the message
+// is labeled with them instead of the label bands of the classifier. It returns the label of
+// the message, or an empty label if it was passed through unchanged.
+func (s *SpamFilter) annotate(raw []byte, out io.Writer, how ClassifyMode, bands []classifier.LabelBand, verbose bool) (string, error) {
 	start := time.Now()
 
+	msg := bytes.NewBuffer(raw)
+
+	if how == ClassifyEmail && !s.reclassify {
+		if name, ok := s.alreadyClassified(raw); ok {
+			logger.Debugf("message already has a %s header, passing it through", name)
+
+			_, err := io.Copy(out, msg)
+			if err != nil {
+				return "", errors.Wrap(err, "writing message")
+			}
+
+			return "", nil
+		}
+	}
+
 	var (
-		label classifier.Result
-		err   error
+		label   classifier.Result
+		verdict string
+		err     error
 
 		// Need to buffer output because we can't write to some outputs while reading input (e.g. http)
 		outBuf bytes.Buffer
 	)
 
 	if verbose {
-		label, err = s.c.Classify(io.TeeReader(in, &msg), &outBuf)
+		label, verdict, err = s.judge(raw, how, bands, &outBuf)
 	} else {
-		label, err = s.c.Classify(io.TeeReader(in, &msg), nil)
+		label, verdict, err = s.judge(raw, how, bands, nil)
 	}
 	if err != nil {
-		return errors.Wrap(err, "classifying")
+		return "", err
 	}
 
-	log.Printf("took %s to classify message as %s", time.Since(start), label)
+	logger.Debugf("took %s to classify message as %s", time.Since(start), label)
 
 	if how == ClassifyPlain {
 		// Just write out the verdict to the output writer
 		if verbose {
 			_, err := io.Copy(out, &outBuf)
 			if err != nil {
-				return errors.Wrap(err, "writing verbose info")
+				return "", errors.Wrap(err, "writing verbose info")
 			}
 		}
 
 		_, err := fmt.Fprintln(out, label)
 		if err != nil {
-			return errors.Wrap(err, "writing verdict")
+			return "", errors.Wrap(err, "writing verdict")
 		}
 
-		return nil
+		return label.Label, nil
 	}
 
-	log.Printf("got %d body bytes", msg.Len())
+	logger.Debugf("got %d body bytes", msg.Len())
 
-	// Write back message, inserting X-Mailfilter header at the bottom of the header block
-	r := bufio.NewReader(&msg)
+	// Write back message, inserting the verdict headers at the bottom of the header block and
+	// dropping verdicts of earlier runs.
+	r := bufio.NewReader(msg)
+	skip := false
 	for {
 		line, err := r.ReadString('\n')
 		if err != nil {
-			return errors.Wrap(err, "reading line")
+			return "", errors.Wrap(err, "reading line")
 		}
 
-		if line == "\n" {
-			// End of header block, insert verdict
-			_, err = fmt.Fprintf(out, "X-Mailfilter: %s\n\n", label)
+		if line == "\n" || line == "\r\n" {
+			// End of header block, insert verdict using the same line ending as the message
+			_, err = fmt.Fprint(out, s.verdictHeaders(label, verdict, line), line)
 			if err != nil {
-				return errors.Wrap(err, "writing verdict")
+				return "", errors.Wrap(err, "writing verdict")
 			}
 
 			break
 		}
 
+		if name, ok := headerFieldName(line); ok {
+			skip = false
+			for _, n := range s.headerStyle.names(s.verdictHeaderName()) {
+				skip = skip || strings.EqualFold(name, n)
+			}
+		}
+
+		if skip {
+			continue
+		}
+
 		_, err = fmt.Fprint(out, line)
 		if err != nil {
-			return errors.Wrap(err, "writing header line")
+			return "", errors.Wrap(err, "writing header line")
 		}
 	}
 
 	// Write rest of the mail
 	_, err = io.Copy(out, r)
 	if err != nil {
-		return errors.Wrap(err, "writing body")
+		return "", errors.Wrap(err, "writing body")
 	}
 
-	return nil
+	return label.Label, nil
 }
 
-func main() {
-	runtime.SetBlockProfileRate(20)
-	runtime.SetMutexProfileFraction(20)
+// judge classifies the message in raw like verdict, unless one of s.rules forces the verdict for
+// it. If bands is not nil, the result is labeled with them instead of the label bands of the
+// classifier. It returns the result and the value of the X-Mailfilter header for it.
+func (s *SpamFilter) judge(raw []byte, how ClassifyMode, bands []classifier.LabelBand, verbose io.Writer) (classifier.Result, string, error) {
+	start := time.Now()
 
-	user, err := user.Current()
+	if how == ClassifyEmail {
+		ruleBands := bands
+		if ruleBands == nil {
+			ruleBands = s.c.Labels()
+		}
+
+		if label, reason, ok := s.rules.Match(raw, ruleBands); ok {
+			logger.Debugf("rule %q forces verdict %q", reason, label.Label)
+
+			classifiedMessages.Inc(label.Label)
+			s.recordAudit(raw, label, reason)
+
+			return label, overrideVerdict(label, reason), nil
+		}
+	}
+
+	label, err := s.verdict(raw, how, verbose)
 	if err != nil {
-		log.Fatalf("can't get current user: %s", err)
+		return classifier.Result{}, "", err
 	}
 
-	if user.HomeDir == "" {
-		log.Fatalf("can't get home directory of user %#v", user)
+	if bands != nil {
+		label.Label = s.c.Relabel(label, bands)
 	}
 
-	listenAddr := flag.String("listenAddr", "127.0.0.1:7999", "Listening address for profiling server")
-	dbPath := flag.String("dbPath", filepath.Join(user.HomeDir, ".flowers"), "path to word database")
+	classifiedMessages.Inc(label.Label)
+	classifyDuration.Observe(time.Since(start).Seconds())
+	s.recordAudit(raw, label, "")
 
-	thresholdUnsure := flag.Float64("thresholdUnsure", 0.3, "Mail with score above this value will be classified as 'unsure'")
-	thresholdSpam := flag.Float64("thresholdSpam", 0.7, "Mail with score above this value will be classified as 'spam'")
+	return label, label.String(), nil
+}
 
-	flag.Parse()
+// recordAudit adds the classification of raw to the audit log, if there is one. override holds the
+// rule that forced the verdict, if any. Failing to write the audit log doesn't fail the
+// classification.
+func (s *SpamFilter) recordAudit(raw []byte, label classifier.Result, override string) {
+	if s.audit == nil {
+		return
+	}
 
-	if *thresholdUnsure >= *thresholdSpam {
-		fmt.Fprintf(flag.CommandLine.Output(), "Threshold for 'unknown' must be lower than threshold for 'spam'\n\n")
-		flag.PrintDefaults()
-		os.Exit(1)
+	err := s.audit.record(newAuditEntry(raw, label, override))
+	if err != nil {
+		logger.Errorf("can't write audit log: %s", err)
 	}
+}
 
-	log.Printf("thresholds: unsure=%f, spam=%f", *thresholdUnsure, *thresholdSpam)
+// verdict classifies the message in raw. If verbose is not nil, details about the
+// classification are written to it.
+func (s *SpamFilter) verdict(raw []byte, how ClassifyMode, verbose io.Writer) (classifier.Result, error) {
+	label, err := s.modelFor(raw, how).ClassifySegments(s.segments(raw, how), verbose)
+	if err != nil {
+		return classifier.Result{}, errors.Wrap(err, "classifying")
+	}
 
-	ctx, done := context.WithCancel(context.Background())
-	defer done()
+	return label, nil
+}
+
+// segments returns the segments of the message in raw that are fed to the classifier. Email
+// that can't be decoded is classified as is.
+func (s *SpamFilter) segments(raw []byte, how ClassifyMode) []classifier.Segment {
+	if how != ClassifyEmail {
+		return []classifier.Segment{{Text: bytes.NewReader(raw), Weight: 1}}
+	}
 
-	dbTotal, err := bloom.NewDB(*dbPath, "total")
+	segments, err := s.emailSegments(raw)
 	if err != nil {
-		log.Fatalf("can't open bloom db: %s", err)
+		logger.Infof("can't decode message, classifying it as is: %s", err)
+		return []classifier.Segment{{Text: bytes.NewReader(raw), Weight: 1}}
 	}
 
-	dbSpam, err := bloom.NewDB(*dbPath, "spam")
+	return segments
+}
+
+// emailSegments splits the email in raw into the segments that are fed to the classifier: the
+// decoded message text with the headers selected by s.includeHeaders and s.excludeHeaders, and
+// the boosted headers, weighted by s.headerWeight. If s.zones is set, the header block and the
+// decoded text are separate segments, and all headers are in headerZone and the text in
+// bodyZone.
+func (s *SpamFilter) emailSegments(raw []byte) ([]classifier.Segment, error) {
+	// Don't let the verdict of an earlier run influence this one
+	exclude := append([]string{s.verdictHeaderName(), spamStatusHeader, spamFlagHeader}, s.boostHeaders...)
+	exclude = append(exclude, s.excludeHeaders...)
+
+	headers, err := headerSegments(raw, s.boostHeaders, s.headerWeight)
 	if err != nil {
-		log.Fatalf("can't open bloom db: %s", err)
+		return nil, err
+	}
+
+	if s.zones {
+		body, err := extractBody(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		var block bytes.Buffer
+		writeHeaderBlock(&block, raw, s.includeHeaders, exclude)
+
+		for i := range headers {
+			headers[i].Zone = headerZone
+		}
+
+		return append(headers,
+			classifier.Segment{Text: &block, Weight: 1, Zone: headerZone},
+			classifier.Segment{Text: bytes.NewReader(body), Weight: 1, Zone: bodyZone}), nil
 	}
 
-	dbHam, err := bloom.NewDB(*dbPath, "ham")
+	text, err := extractText(raw, s.includeHeaders, exclude)
 	if err != nil {
-		log.Fatalf("can't open bloom db: %s", err)
+		return nil, err
 	}
 
-	var wg sync.WaitGroup
+	return append(headers, classifier.Segment{Text: bytes.NewReader(text), Weight: 1}), nil
+}
 
-	wg.Add(3)
+// headerList splits a comma separated list of header names, skipping empty names.
+func headerList(list string) []string {
+	var names []string
 
-	go func() {
-		defer wg.Done()
-		dbTotal.Run(ctx)
-	}()
+	for _, h := range strings.Split(list, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" {
+			names = append(names, h)
+		}
+	}
 
-	go func() {
-		defer wg.Done()
-		dbSpam.Run(ctx)
-	}()
+	return names
+}
 
-	go func() {
-		defer wg.Done()
-		dbHam.Run(ctx)
-	}()
+// parseWeights parses a comma separated list of n weights, each of which has to be above 0.
+func parseWeights(list string, n int) ([]float64, error) {
+	fields := strings.Split(list, ",")
+	if len(fields) != n {
+		return nil, errors.Errorf("expected %d weights, got %d", n, len(fields))
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-	go func() {
-		s := <-sigChan
-		log.Printf("got signal %q, terminating", s)
+	weights := make([]float64, n)
 
-		done()
-	}()
+	for i, f := range fields {
+		w, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing weight %d", i)
+		}
 
-	c := classifier.New(dbTotal, dbHam, dbSpam, *thresholdUnsure, *thresholdSpam, 6)
+		if !(w > 0) {
+			return nil, errors.Errorf("weight %v is not above 0", w)
+		}
 
-	s := SpamFilter{c}
-	http.HandleFunc("/", s.handleIndex)
-	http.HandleFunc("/train", s.trainingHandler)
-	http.HandleFunc("/classify", s.classifyHandler)
+		weights[i] = w
+	}
+
+	return weights, nil
+}
+
+// listenSocket opens a listener for addr, which is either "unix:" followed by the path of a
+// socket, or a TCP address with an optional "tcp:" prefix.
+func listenSocket(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+}
+
+// httpLimits bounds how long the HTTP server waits for clients and how large request headers
+// may get, so that slow or hung clients can't tie up connections forever.
+type httpLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration // for the whole request, including the body
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// newHTTPServer returns an HTTP server for addr that serves requests with handler and applies
+// limits to them.
+func newHTTPServer(addr string, handler http.Handler, limits httpLimits) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+	}
+}
 
-	srv := http.Server{
-		Addr: *listenAddr,
+func main() {
+	runtime.SetBlockProfileRate(20)
+	runtime.SetMutexProfileFraction(20)
+
+	user, err := user.Current()
+	if err != nil {
+		log.Fatalf("can't get current user: %s", err)
+	}
+
+	if user.HomeDir == "" {
+		log.Fatalf("can't get home directory of user %#v", user)
 	}
 
+	listenAddr := flag.String("listenAddr", "127.0.0.1:7999", "Listening address for profiling server")
+	authToken := flag.String("authToken", "", "Require this token in an 'Authorization: Bearer' header for /train, /untrain, /word, /stats, /backup and /restore")
+	authClassify := flag.Bool("authClassify", false, "Also require -authToken for /classify, /classify/batch, /classify/subject and /debug/classify")
+	trainRate := flag.Float64("trainRate", 0, "Accept at most this many requests per second to /train and /untrain on average, 0 for no limit. Requests above the limit get status 429")
+	trainDedup := flag.Int("trainDedup", 0, "Remember the Message-IDs of this many messages trained with /train, and skip them if they are trained as the same class again. 0 trains every message")
+	maxFactor := flag.Uint64("maxFactor", 100, "Reject requests to /train and /untrain with a learn factor above this, 0 for no limit")
+	trainBurst := flag.Int("trainBurst", 10, "Accept this many requests to /train and /untrain at once before -trainRate applies")
+	readHeaderTimeout := flag.Duration("readHeaderTimeout", 10*time.Second, "How long the HTTP server waits for the headers of a request")
+	readTimeout := flag.Duration("readTimeout", 2*time.Minute, "How long the HTTP server waits for a whole request, including its body")
+	writeTimeout := flag.Duration("writeTimeout", 5*time.Minute, "How long the HTTP server takes at most to handle a request and write the response, e.g. for /classify/batch")
+	idleTimeout := flag.Duration("idleTimeout", 2*time.Minute, "How long the HTTP server keeps idle connections open")
+	maxHeaderBytes := flag.Int("maxHeaderBytes", 64<<10, "Largest size of the headers of a request that the HTTP server accepts")
+	classifyDir := flag.String("classifyDir", "", "Allow /classify/path to classify files below this directory on the server. Needs -authToken")
+	milterAddr := flag.String("milterAddr", "", "Also accept messages from an MTA with the milter protocol on this address, 'unix:/path/to/socket' or 'tcp:host:port'")
+	lmtpAddr := flag.String("lmtpAddr", "", "Also accept messages over LMTP on this address, 'unix:/path/to/socket' or 'tcp:host:port', and relay them to -lmtpNextHop")
+	lmtpNextHop := flag.String("lmtpNextHop", "", "SMTP server that messages received with -lmtpAddr are relayed to after classifying them")
+	lmtpMaxMessageBytes := flag.Int64("lmtpMaxMessageBytes", 32<<20, "Reject messages larger than this many bytes that are received with -lmtpAddr, 0 for no limit")
+	lmtpTimeout := flag.Duration("lmtpTimeout", 5*time.Minute, "Close LMTP connections that take longer than this to send a command or a message, or to receive a reply, 0 for no limit")
+	dbPath := flag.String("dbPath", filepath.Join(user.HomeDir, ".flowers"), "path to word database")
+	dbStore := flag.Bool("dbStore", false, "Keep the filters of each model in a single file named 'filters' in -dbPath instead of one file per filter")
+	persistMinCells := flag.Int("persistMinCells", 0, "Only write the word database to disk once this many of its cells changed, or -persistMaxDelay passed since it was last written")
+	persistMaxDelay := flag.Duration("persistMaxDelay", time.Hour, "Write changes to the word database to disk after at most this long, even if fewer than -persistMinCells cells changed")
+	scoreCache := flag.Int("scoreCache", 0, "Remember the scores of this many recently looked up ngrams per filter, until the filter changes. 0 disables the cache")
+	tokenKeyFile := flag.String("tokenKeyFile", "", "Store ngrams hashed with the secret key in this file instead of as they are. The database has to be used with the key it was trained with")
+	hashScheme := flag.String("hashScheme", "fnv", "Hash scheme of the word database, 'fnv' or 'double'. Must match the scheme the database was created with")
+
+	thresholdUnsure := flag.Float64("thresholdUnsure", 0.3, "Mail with score above this value will be classified as 'unsure'")
+	thresholdSpam := flag.Float64("thresholdSpam", 0.7, "Mail with score above this value will be classified as 'spam'")
+	labels := flag.String("labels", "", "Comma separated list of 'threshold:label' bands that replace the labels given by -thresholdUnsure and -thresholdSpam, e.g. '0:clean,0.3:suspect,0.7:junk'. Mail is labeled with the last band whose threshold its score is above")
+
+	minTokens := flag.Int("minTokens", 0, "Label messages with fewer ngrams than this with -insufficientLabel instead of labeling them by their score")
+	insufficientLabel := flag.String("insufficientLabel", classifier.InsufficientData, "Label of messages with fewer ngrams than -minTokens, e.g. 'ham' to let them through")
+
+	sigmoidK := flag.Float64("sigmoidK", classifier.DefaultSigmoid.K, "Steepness of the sigmoid that word likelihoods are passed through. Larger values make single words more decisive")
+	sigmoidMidpoint := flag.Float64("sigmoidMidpoint", classifier.DefaultSigmoid.Midpoint, "Word likelihood at the midpoint of the sigmoid")
+	sigmoidMax := flag.Float64("sigmoidMax", classifier.DefaultSigmoid.Max, "Upper bound of the sigmoid")
+
+	boostHeaders := flag.String("boostHeaders", "", "Comma separated list of headers that are weighted separately when classifying email, e.g. 'Subject,From'")
+	headerWeight := flag.Float64("headerWeight", 2, "Weight of the headers listed in -boostHeaders")
+	includeHeaders := flag.String("includeHeaders", "", "Comma separated list of headers that are classified along with the text of email. Empty includes all headers but those in -excludeHeaders")
+	excludeHeaders := flag.String("excludeHeaders", "Received,DKIM-Signature", "Comma separated list of headers that are never classified along with the text of email")
+	reclassify := flag.Bool("reclassify", false, "Classify mail that already has an X-Mailfilter header again instead of passing it through")
+	headerStyle := flag.String("headerStyle", "mailfilter", "Verdict headers to add to email: 'mailfilter' for X-Mailfilter, 'spamassassin' for X-Spam-Status and X-Spam-Flag, or 'both'")
+	headerName := flag.String("headerName", verdictHeader, "Name of the verdict header of the 'mailfilter' header style")
+	auditPath := flag.String("auditLog", "", "Append a JSON line for each classified message to this file")
+	auditSize := flag.Int64("auditLogSize", 10, "Rotate the file passed with -auditLog when it grows larger than this many megabytes")
+	languagesFlag := flag.String("languages", "", "Comma separated list of languages ('de', 'en', 'es' or 'fr') that get a model of their own. Messages in other languages use the default model")
+	rulesPath := flag.String("rules", "", "File with rules that force the verdict for some senders. Reloaded on SIGHUP")
+
+	checkOnly := flag.Bool("check", false, "Check that the databases in -dbPath can be loaded with -hashScheme and aren't saturated, then exit. Exits with status 1 if any of them is missing or broken")
+	pipe := flag.Bool("pipe", false, "Classify a single message from standard input, write it to standard output and exit")
+
+	maildir := flag.String("trainMaildir", "", "Train all messages in this maildir, then exit")
+	mboxPath := flag.String("trainMbox", "", "Train all messages in this mbox file, then exit")
+	csvPath := flag.String("trainCSV", "", "Train all rows of this CSV file, labeled by -csvLabelColumn, then exit")
+	csvTab := flag.Bool("csvTab", false, "Columns of -trainCSV are separated by tabs instead of commas")
+	csvHeader := flag.Bool("csvHeader", false, "Skip the first row of -trainCSV, which holds the column names")
+	csvLabelColumn := flag.Int("csvLabelColumn", 0, "Column of -trainCSV that holds the label, counted from 0")
+	csvTextColumns := flag.String("csvTextColumns", "1", "Comma separated list of columns of -trainCSV that hold the text, counted from 0")
+	csvSpamLabel := flag.String("csvSpamLabel", "spam", "Label of the rows of -trainCSV that are trained as spam")
+	csvHamLabel := flag.String("csvHamLabel", "ham", "Label of the rows of -trainCSV that are trained as ham. Rows with other labels are skipped")
+	trainAs := flag.String("as", "", "Train messages passed with -trainMaildir or -trainMbox as 'spam' or 'ham'")
+	learnFactor := flag.Uint64("factor", 1, "How hard to learn messages passed with -trainMaildir or -trainMbox")
+	trainProgressPath := flag.String("trainProgress", "", "Record which messages of -trainMbox have been trained in this file, and skip them when training the same mbox again")
+	dedupTraining := flag.Bool("dedupTraining", false, "Train each distinct ngram of a message only once, no matter how often it is repeated")
+	hamWeight := flag.Uint64("hamWeight", 1, "Multiply the learn factor by this when training or untraining ham. Larger values make the filter more cautious about labeling messages as spam")
+	spamWeight := flag.Uint64("spamWeight", 1, "Multiply the learn factor by this when training or untraining spam")
+	decayBefore := flag.Float64("decayBefore", 0, "Decay the counts of each ngram by this rate, between 0 and 1, before training it, so that recent training outweighs older training. 0 disables decay")
+	ensembleShingles := flag.Int("ensembleShingles", 0, "Also train and classify messages with a model of runs of this many words, kept in the directory 'shingles' in -dbPath, and combine it with the ngram model. 0 uses the ngram model alone")
+	ensembleWeights := flag.String("ensembleWeights", "1,1", "Comma separated weights of the ngram model and the word model with -ensembleShingles")
+	zones := flag.Bool("zones", false, "Prefix the ngrams of the headers of email with 'H:' and those of the body with 'B:', so that they are counted separately")
+	featureTokens := flag.Bool("featureTokens", false, "Replace URLs and email addresses with the tokens __URL__ and __EMAIL__ before splitting messages into ngrams")
+	featureDomains := flag.Bool("featureDomains", false, "With -featureTokens, keep the domain of each URL and email address after its token")
+	maxDocFreq := flag.Float64("maxDocFreq", 0, "Skip ngrams that were trained more often than this fraction of the trained messages when classifying, like stop words. Only messages trained since the filter counts messages are counted. 0 disables this")
+	classPrior := flag.Bool("classPrior", false, "Start the score of each message from the ratio of spam and ham messages that were trained, so that messages without known ngrams lean towards the more common class")
+	shouting := flag.Bool("shouting", false, "With -shingles or -ensembleShingles, add the token __SHOUTING__ for each word in upper case, since words are in lower case otherwise")
+	shingles := flag.Int("shingles", 0, "Split messages into runs of this many words instead of ngrams of 6 bytes. 0 uses ngrams")
+	normalizeTraining := flag.Uint64("normalizeTraining", 0, "Train each message as if it had this many ngrams, so that long messages don't outweigh short ones. 0 trains every ngram of a message fully")
+
+	evalSpam := flag.String("evalSpam", "", "Directory with spam messages for evaluating the classifier with -evalHam")
+	evalHam := flag.String("evalHam", "", "Directory with ham messages for evaluating the classifier with -evalSpam")
+	folds := flag.Int("folds", 5, "Number of folds for cross-validation with -evalSpam and -evalHam")
+	evalJSON := flag.Bool("evalJSON", false, "Write the evaluation report as JSON")
+	tuneThresholds := flag.Bool("tune", false, "Recommend thresholds based on a cross-validation with -evalSpam and -evalHam instead of writing a report")
+	tunePenalty := flag.Float64("tunePenalty", classifier.DefaultFalsePositivePenalty, "Penalty for false positives when tuning thresholds with -tune")
+
+	printVersion := flag.Bool("version", false, "Print version information and exit")
+	recommend := flag.Uint64("recommend", 0, "Print the filter dimensions that keep the error rate at -recommendError for this many distinct ngrams, and the error rate of the filters of this build, then exit")
+	recommendError := flag.Float64("recommendError", 0.01, "Error rate to recommend filter dimensions for with -recommend, i.e. the probability that an ngram that was never trained has a count")
+
+	logLevel := flag.String("logLevel", "info", "Only log messages with at least this level: 'debug', 'info' or 'error'")
+
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Println(getBuildInfo())
+		return
+	}
+
+	if *recommend > 0 {
+		if !(*recommendError > 0 && *recommendError < 1) {
+			fmt.Fprintf(flag.CommandLine.Output(), "-recommendError must be above 0 and below 1\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		recommendParams(*recommend, *recommendError, os.Stdout)
+		return
+	}
+
+	level, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	logger.SetLevel(level)
+
+	style, err := ParseHeaderStyle(*headerStyle)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	err = ValidateHeaderName(*headerName)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if style == HeaderBoth && (strings.EqualFold(*headerName, spamStatusHeader) || strings.EqualFold(*headerName, spamFlagHeader)) {
+		fmt.Fprintf(flag.CommandLine.Output(), "-headerName %q clashes with the SpamAssassin headers of -headerStyle both\n\n", *headerName)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var dbOpts []bloom.Option
+
+	scheme := bloom.HashFNV
+
+	switch *hashScheme {
+	case "fnv":
+	case "double":
+		scheme = bloom.HashDouble
+		dbOpts = append(dbOpts, bloom.WithHashScheme(scheme))
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown hash scheme %q\n\n", *hashScheme)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *authClassify && *authToken == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "-authClassify needs -authToken\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *classifyDir != "" && *authToken == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "-classifyDir needs -authToken\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *persistMinCells > 0 {
+		dbOpts = append(dbOpts, bloom.WithLazyPersist(*persistMinCells, *persistMaxDelay))
+	}
+
+	if *scoreCache < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-scoreCache must not be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *scoreCache > 0 {
+		dbOpts = append(dbOpts, bloom.WithScoreCache(*scoreCache))
+	}
+
+	if *thresholdUnsure >= *thresholdSpam {
+		fmt.Fprintf(flag.CommandLine.Output(), "Threshold for 'unknown' must be lower than threshold for 'spam'\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	sigmoid := classifier.Sigmoid{K: *sigmoidK, Midpoint: *sigmoidMidpoint, Max: *sigmoidMax}
+
+	err = sigmoid.Validate()
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	classifierOpts := []classifier.Option{
+		classifier.WithSigmoid(sigmoid),
+		classifier.WithNormalizedTraining(*normalizeTraining),
+	}
+
+	if *dedupTraining {
+		classifierOpts = append(classifierOpts, classifier.WithDedupedTraining())
+	}
+
+	var weights []float64
+
+	if *ensembleShingles != 0 {
+		if *ensembleShingles < 0 || *shingles != 0 {
+			fmt.Fprintf(flag.CommandLine.Output(), "-ensembleShingles must be positive, and can't be combined with -shingles\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		weights, err = parseWeights(*ensembleWeights, 2)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "can't parse -ensembleWeights: %s\n\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if *featureDomains && !*featureTokens {
+		fmt.Fprintf(flag.CommandLine.Output(), "-featureDomains needs -featureTokens\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *featureTokens {
+		classifierOpts = append(classifierOpts, classifier.WithFeatureTokens(*featureDomains))
+	}
+
+	if *hamWeight == 0 || *spamWeight == 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-hamWeight and -spamWeight must be at least 1\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	classifierOpts = append(classifierOpts, classifier.WithTrainingWeights(*hamWeight, *spamWeight))
+
+	if *decayBefore < 0 || *decayBefore >= 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-decayBefore must be at least 0 and below 1\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *decayBefore > 0 {
+		classifierOpts = append(classifierOpts, classifier.WithDecayBefore(*decayBefore))
+	}
+
+	if *shingles < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-shingles must not be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *shingles > 0 {
+		classifierOpts = append(classifierOpts, classifier.WithWordShingles(*shingles))
+	}
+
+	if *maxDocFreq < 0 || *maxDocFreq > 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-maxDocFreq must be between 0 and 1\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *maxDocFreq > 0 {
+		classifierOpts = append(classifierOpts, classifier.WithMaxDocumentFrequency(*maxDocFreq))
+	}
+
+	if *classPrior {
+		classifierOpts = append(classifierOpts, classifier.WithClassPrior())
+	}
+
+	if *shouting {
+		if *shingles == 0 && *ensembleShingles == 0 {
+			fmt.Fprintf(flag.CommandLine.Output(), "-shouting needs -shingles or -ensembleShingles\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		// Windows keep the case of messages, so this only affects word shingles
+		classifierOpts = append(classifierOpts, classifier.WithShouting())
+	}
+
+	if *tokenKeyFile != "" {
+		key, err := ioutil.ReadFile(*tokenKeyFile)
+		if err != nil {
+			log.Fatalf("can't read token key: %s", err)
+		}
+
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			log.Fatalf("token key in %s is empty", *tokenKeyFile)
+		}
+
+		classifierOpts = append(classifierOpts, classifier.WithTokenKey(key))
+	}
+
+	var bands []classifier.LabelBand
+
+	if *labels != "" {
+		bands, err = ParseLabelBands(*labels)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "%s\n\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	labelOpts := []classifier.Option{classifier.WithLabels(bands)}
+
+	if *minTokens > 0 {
+		if *insufficientLabel == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "-minTokens needs -insufficientLabel\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		labelOpts = append(labelOpts, classifier.WithMinTokens(*minTokens, *insufficientLabel))
+	}
+
+	batchTraining := *maildir != "" || *mboxPath != "" || *csvPath != ""
+
+	csvFmt := csvFormat{
+		Comma:       ',',
+		Header:      *csvHeader,
+		LabelColumn: *csvLabelColumn,
+		SpamLabel:   *csvSpamLabel,
+		HamLabel:    *csvHamLabel,
+	}
+
+	if *csvTab {
+		csvFmt.Comma = '\t'
+	}
+
+	if *csvPath != "" {
+		csvFmt.TextColumns, err = parseColumns(*csvTextColumns)
+		if err == nil && *csvLabelColumn < 0 {
+			err = errors.Errorf("bad label column %d", *csvLabelColumn)
+		}
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "%s\n\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if (*maildir != "" || *mboxPath != "") && *trainAs != "spam" && *trainAs != "ham" {
+		fmt.Fprintf(flag.CommandLine.Output(), "-trainMaildir and -trainMbox need -as=spam or -as=ham\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	evaluation := *evalSpam != "" || *evalHam != "" || *tuneThresholds
+
+	if evaluation && (*evalSpam == "" || *evalHam == "" || *folds < 2) {
+		fmt.Fprintf(flag.CommandLine.Output(), "Evaluation needs -evalSpam, -evalHam and at least 2 -folds\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *pipe && (batchTraining || evaluation) {
+		fmt.Fprintf(flag.CommandLine.Output(), "-pipe can't be combined with training or evaluation\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if (*lmtpAddr == "") != (*lmtpNextHop == "") {
+		fmt.Fprintf(flag.CommandLine.Output(), "-lmtpAddr and -lmtpNextHop need to be used together\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *lmtpMaxMessageBytes < 0 || *lmtpTimeout < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-lmtpMaxMessageBytes and -lmtpTimeout must not be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	logger.Infof("thresholds: unsure=%f, spam=%f", *thresholdUnsure, *thresholdSpam)
+
+	s := SpamFilter{
+		started:      time.Now(),
+		headerWeight: *headerWeight,
+		reclassify:   *reclassify,
+		zones:        *zones,
+		headerStyle:  style,
+		headerName:   *headerName,
+		maxFactor:    *maxFactor,
+	}
+
+	if *trainDedup < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "-trainDedup must not be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *trainDedup > 0 {
+		s.trained = newTrainedSet(*trainDedup)
+	}
+
+	if *classifyDir != "" {
+		dir, err := resolveDir(*classifyDir)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "can't use -classifyDir: %s\n\n", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		s.classifyDir = dir
+	}
+
+	s.boostHeaders = headerList(*boostHeaders)
+	s.includeHeaders = headerList(*includeHeaders)
+	s.excludeHeaders = headerList(*excludeHeaders)
+
+	var languages []string
+
+	if *languagesFlag != "" {
+		s.detector = lang.Default()
+		s.models = make(map[string]*classifier.Classifier)
+
+		for _, l := range strings.Split(*languagesFlag, ",") {
+			l = strings.TrimSpace(l)
+
+			known := false
+			for _, k := range s.detector.Languages() {
+				known = known || k == l
+			}
+
+			if !known {
+				fmt.Fprintf(flag.CommandLine.Output(), "Unknown language %q, expected one of %s\n\n", l, strings.Join(s.detector.Languages(), ", "))
+				flag.PrintDefaults()
+				os.Exit(1)
+			}
+
+			languages = append(languages, l)
+		}
+	}
+
+	if *checkOnly {
+		// The same models that loadDBs opens
+		dirs := []string{*dbPath}
+		if *ensembleShingles > 0 {
+			dirs = append(dirs, filepath.Join(*dbPath, "shingles"))
+		}
+
+		for _, l := range languages {
+			dirs = append(dirs, filepath.Join(*dbPath, l))
+		}
+
+		if !checkDBs(dirs, *dbStore, scheme, os.Stdout) {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *rulesPath != "" {
+		s.rules, err = LoadRules(*rulesPath)
+		if err != nil {
+			log.Fatalf("can't load rules: %s", err)
+		}
+
+		logger.Infof("loaded %d rules from %s", s.rules.Len(), *rulesPath)
+	}
+
+	if *auditPath != "" {
+		s.audit, err = OpenAuditLog(*auditPath, *auditSize<<20)
+		if err != nil {
+			log.Fatalf("can't open audit log: %s", err)
+		}
+		defer s.audit.Close()
+	}
+
+	if evaluation {
+		newClassifier := func(dir string) (*classifier.Classifier, error) {
+			var dbs [3]*bloom.DB
+
+			for i, name := range []string{"total", "ham", "spam"} {
+				var err error
+
+				dbs[i], err = bloom.NewDB(dir, name, dbOpts...)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			opts := append(append([]classifier.Option(nil), labelOpts...), classifierOpts...)
+
+			return classifier.New(dbs[0], dbs[1], dbs[2], *thresholdUnsure, *thresholdSpam, 6, opts...), nil
+		}
+
+		evalBands := bands
+		if evalBands == nil {
+			evalBands = classifier.DefaultBands(*thresholdUnsure, *thresholdSpam)
+		}
+
+		if *tuneThresholds {
+			err = tune(s, newClassifier, *evalSpam, *evalHam, *folds, *tunePenalty, os.Stdout)
+		} else {
+			err = evaluate(s, newClassifier, evalBands, *evalSpam, *evalHam, *folds, *evalJSON, os.Stdout)
+		}
+		if err != nil {
+			log.Fatalf("can't evaluate classifier: %s", err)
+		}
+
+		return
+	}
+
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	var wg sync.WaitGroup
+
+	// openModel opens the databases of a classifier in dir, starts persisting them in the
+	// background and returns a classifier that uses them. The databases are added to dbs, with
+	// their names prefixed by prefix.
+	openModel := func(dir, prefix string, dbs map[string]*bloom.DB, extra ...classifier.Option) *classifier.Classifier {
+		var model [3]*bloom.DB
+
+		names := []string{"total", "ham", "spam"}
+
+		if *dbStore {
+			store, err := bloom.OpenStore(filepath.Join(dir, "filters"), names, dbOpts...)
+			if err != nil {
+				log.Fatalf("can't open bloom store: %s", err)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				store.Run(ctx)
+			}()
+
+			for i, name := range names {
+				model[i] = store.DB(name)
+				dbs[prefix+name] = model[i]
+			}
+		} else {
+			for i, name := range names {
+				db, err := bloom.NewDB(dir, name, dbOpts...)
+				if err != nil {
+					log.Fatalf("can't open bloom db: %s", err)
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					db.Run(ctx)
+				}()
+
+				model[i] = db
+				dbs[prefix+name] = db
+			}
+		}
+
+		documents, err := openDocumentFile(filepath.Join(dir, documentsFile))
+		if err != nil {
+			log.Fatalf("can't open document counts: %s", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			documents.Run(ctx)
+		}()
+
+		opts := append(append(append([]classifier.Option(nil), labelOpts...), classifierOpts...), extra...)
+		opts = append(opts, classifier.WithDocumentCounter(documents))
+
+		return classifier.New(model[0], model[1], model[2], *thresholdUnsure, *thresholdSpam, 6, opts...)
+	}
+
+	// loadDBs opens the databases, starts persisting them in the background and sets up the
+	// classifiers.
+	loadDBs := func() {
+		start := time.Now()
+
+		dbs := make(map[string]*bloom.DB)
+
+		s.c = openModel(*dbPath, "", dbs)
+
+		if *ensembleShingles > 0 {
+			words := openModel(filepath.Join(*dbPath, "shingles"), "shingles/", dbs, classifier.WithWordShingles(*ensembleShingles))
+
+			s.meta = classifier.NewMeta(s.c.Labels(),
+				classifier.Member{Classifier: s.c, Weight: weights[0]},
+				classifier.Member{Classifier: words, Weight: weights[1]})
+		}
+
+		for _, l := range languages {
+			s.models[l] = openModel(filepath.Join(*dbPath, l), l+"/", dbs)
+		}
+
+		logger.Infof("took %s to load databases", time.Since(start))
+
+		s.dbs = dbs
+		registerDBMetrics(dbs)
+	}
+
+	// Batch training is stopped before the databases are persisted for the last time, so
+	// that nothing is trained after that.
+	trainCtx, stopTraining := context.WithCancel(context.Background())
+	defer stopTraining()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		s := <-sigChan
+		logger.Infof("got signal %q, terminating", s)
+
+		if batchTraining {
+			stopTraining()
+			return
+		}
+
+		done()
+	}()
+
+	if s.rules != nil {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				err := s.rules.Reload()
+				if err != nil {
+					logger.Errorf("can't reload rules, keeping the old ones: %s", err)
+					continue
+				}
+
+				logger.Infof("reloaded %d rules", s.rules.Len())
+			}
+		}()
+	}
+
+	if batchTraining {
+		loadDBs()
+
+		var progress *trainProgress
+
+		if *trainProgressPath != "" {
+			progress, err = loadTrainProgress(*trainProgressPath)
+			if err != nil {
+				log.Fatalf("can't load training progress: %s", err)
+			}
+		}
+
+		type trainFunc func(context.Context, *SpamFilter, string, bool, uint64) (int, int, error)
+
+		var failures int
+
+		for _, src := range []struct {
+			path  string
+			train trainFunc
+		}{
+			{*maildir, trainMaildir},
+			{*mboxPath, func(ctx context.Context, s *SpamFilter, p string, spam bool, factor uint64) (int, int, error) {
+				return trainMbox(ctx, s, p, spam, factor, progress)
+			}},
+		} {
+			if src.path == "" {
+				continue
+			}
+
+			start := time.Now()
+
+			trained, failed, err := src.train(trainCtx, &s, src.path, *trainAs == "spam", *learnFactor)
+			logger.Infof("took %s to train %d messages from %s as %s, %d failed", time.Since(start), trained, src.path, *trainAs, failed)
+			if err != nil {
+				logger.Errorf("can't train %s: %s", src.path, err)
+				failures++
+			}
+		}
+
+		if *csvPath != "" {
+			err := trainCSVFile(trainCtx, &s, *csvPath, csvFmt, *learnFactor)
+			if err != nil {
+				logger.Errorf("can't train %s: %s", *csvPath, err)
+				failures++
+			}
+		}
+
+		// Persist the databases before exiting, and only then the progress, so that it
+		// doesn't claim messages that aren't in the databases.
+		done()
+		wg.Wait()
+
+		err = progress.save()
+		if err != nil {
+			logger.Errorf("can't save training progress: %s", err)
+			failures++
+		}
+
+		if failures > 0 {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *pipe {
+		loadDBs()
+
+		err := s.pipe(os.Stdin, os.Stdout)
+
+		done()
+		wg.Wait()
+
+		if err != nil {
+			logger.Errorf("can't classify message: %s", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	http.HandleFunc("/", s.handleIndex)
+	classifyToken := ""
+	if *authClassify {
+		classifyToken = *authToken
+	}
+
+	// Training and untraining share a limit, since both change the model
+	var trainLimiter *rate.Limiter
+	if *trainRate > 0 {
+		trainLimiter = rate.NewLimiter(rate.Limit(*trainRate), *trainBurst)
+	}
+
+	http.HandleFunc("/train", requireToken(*authToken, rateLimited(trainLimiter, s.trainingHandler)))
+	http.HandleFunc("/untrain", requireToken(*authToken, rateLimited(trainLimiter, s.untrainingHandler)))
+	http.HandleFunc("/classify", requireToken(classifyToken, s.classifyHandler))
+	http.HandleFunc("/classify/batch", requireToken(classifyToken, s.batchClassifyHandler))
+	http.HandleFunc("/classify/subject", requireToken(classifyToken, s.subjectClassifyHandler))
+	http.HandleFunc("/classify/path", requireToken(*authToken, s.pathClassifyHandler))
+	http.HandleFunc("/debug/classify", requireToken(classifyToken, s.debugClassifyHandler))
+	http.HandleFunc("/healthz", s.healthHandler)
+	http.HandleFunc("/readyz", s.readyHandler)
+	http.HandleFunc("/stats", requireToken(*authToken, s.statsHandler))
+	http.HandleFunc("/word", requireToken(*authToken, s.wordHandler))
+	http.HandleFunc("/version", s.versionHandler)
+	http.HandleFunc("/backup", requireToken(*authToken, s.backupHandler))
+	http.HandleFunc("/restore", requireToken(*authToken, s.restoreHandler))
+	http.Handle("/metrics", metrics.Default)
+
+	// Load the databases in the background, so that health checks can be answered in the
+	// meantime. Until the databases are loaded, requests to train or classify messages fail.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		loadDBs()
+		s.setReady()
+	}()
+
+	if *milterAddr != "" {
+		l, err := listenSocket(*milterAddr)
+		if err != nil {
+			log.Fatalf("can't listen for milter connections: %s", err)
+		}
+
+		msrv := milter.Server{Handler: s.milterHandler}
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			logger.Infof("starting milter server on %s", *milterAddr)
+			err := msrv.Serve(l)
+			logger.Infof("milter server terminated on %s: %s", *milterAddr, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			<-ctx.Done()
+
+			err := msrv.Close()
+			if err != nil {
+				logger.Errorf("shutting down milter server: %s", err)
+			}
+		}()
+	}
+
+	if *lmtpAddr != "" {
+		l, err := listenSocket(*lmtpAddr)
+		if err != nil {
+			log.Fatalf("can't listen for LMTP connections: %s", err)
+		}
+
+		lsrv := lmtp.Server{
+			Handler:         s.lmtpHandler(*lmtpNextHop),
+			MaxMessageBytes: *lmtpMaxMessageBytes,
+			Timeout:         *lmtpTimeout,
+		}
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			logger.Infof("starting LMTP server on %s, relaying to %s", *lmtpAddr, *lmtpNextHop)
+			err := lsrv.Serve(l)
+			logger.Infof("LMTP server terminated on %s: %s", *lmtpAddr, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			<-ctx.Done()
+
+			err := lsrv.Close()
+			if err != nil {
+				logger.Errorf("shutting down LMTP server: %s", err)
+			}
+		}()
+	}
+
+	srv := newHTTPServer(*listenAddr, nil, httpLimits{
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	})
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -218,14 +1592,14 @@ func main() {
 
 		err := srv.Shutdown(shutdownctx)
 		if err != nil {
-			log.Println("shutting down HTTP server:", err)
+			logger.Errorf("shutting down HTTP server: %s", err)
 		}
 	}()
 
-	log.Println("starting http server on", *listenAddr)
+	logger.Infof("starting http server on %s", *listenAddr)
 	err = srv.ListenAndServe()
 	if err != nil {
-		log.Printf("server terminated on %s: %s", *listenAddr, err)
+		logger.Infof("server terminated on %s: %s", *listenAddr, err)
 	}
 
 	wg.Wait()
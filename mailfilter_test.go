@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mailfilter/classifier"
+	"mailfilter/lang"
+)
+
+type testDB struct {
+	mu sync.Mutex
+
+	m map[string]uint64
+}
+
+func (t *testDB) Add(w []byte, factor uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.m == nil {
+		t.m = make(map[string]uint64)
+	}
+
+	t.m[string(w)] += factor
+}
+
+func (t *testDB) Remove(w []byte, factor uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.m == nil {
+		return
+	}
+
+	if t.m[string(w)] < factor {
+		t.m[string(w)] = 0
+	} else {
+		t.m[string(w)] -= factor
+	}
+}
+
+func (t *testDB) Score(w []byte) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.m[string(w)]
+}
+
+func newTestFilter() *SpamFilter {
+	c := classifier.New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, 6)
+
+	s := &SpamFilter{c: c}
+	s.setReady()
+
+	return s
+}
+
+func TestSpamFilter_HeaderWeight(t *testing.T) {
+	const msg = "From: Bob <bob@example.com>\n" +
+		"Subject: cheap pills online, best prices\n" +
+		"\n" +
+		"hello, just checking in about lunch tomorrow\n"
+
+	testCases := []struct {
+		weight      float64
+		expectLabel string
+	}{
+		{0, "ham"},
+		{5, "spam"},
+	}
+
+	for _, tc := range testCases {
+		s := newTestFilter()
+		s.boostHeaders = []string{"Subject", "From"}
+		s.headerWeight = tc.weight
+
+		err := s.c.Train(strings.NewReader("cheap pills online, best prices"), true, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		err = s.c.Train(strings.NewReader("hello, just checking in about lunch"), false, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var out bytes.Buffer
+
+		err = s.classify(strings.NewReader(msg), &out, ClassifyEmail, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		header, _ := splitHeader(t, out.String())
+		if !strings.Contains(header, "X-Mailfilter: label=\""+tc.expectLabel+"\"") {
+			t.Errorf("expected label %q with header weight %v, got %q", tc.expectLabel, tc.weight, header)
+		}
+	}
+}
+
+func TestSpamFilter_TrainDecoded(t *testing.T) {
+	s := newTestFilter()
+	s.excludeHeaders = []string{"Received"}
+
+	// "cheap pills for sale" as base64
+	const msg = "Received: from mx.example.com\r\n" +
+		"Subject: hello\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"Y2hlYXAgcGlsbHMgZm9yIHNhbGU=\r\n"
+
+	err := s.train([]byte(msg), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tc := range []struct {
+		word        string
+		expectTotal uint64
+	}{
+		{"cheap ", 1},
+		{"Y2hlYX", 0},
+		{"Receiv", 0},
+	} {
+		w, err := s.c.LookupWord([]byte(tc.word))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if w.Total != tc.expectTotal {
+			t.Errorf("expected %q to be trained %d times, got %s", tc.word, tc.expectTotal, w)
+		}
+	}
+
+	res, err := s.verdict([]byte("cheap pills for sale"), ClassifyPlain, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "spam" {
+		t.Errorf("expected the decoded text to be spam, got %s", res)
+	}
+
+	err = s.untrain([]byte(msg), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w, _ := s.c.LookupWord([]byte("cheap ")); w.Total != 0 {
+		t.Errorf("expected untraining to remove the decoded words, got %s", w)
+	}
+}
+
+func TestSpamFilter_Zones(t *testing.T) {
+	s := newTestFilter()
+	s.zones = true
+
+	err := s.train([]byte("Subject: free money\n\nsee you at lunch\n"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tc := range []struct {
+		word        string
+		expectTotal uint64
+	}{
+		{headerZone + "free m", 1},
+		{bodyZone + "free m", 0},
+		{bodyZone + "see yo", 1},
+		{"free m", 0},
+	} {
+		w, err := s.c.LookupWord([]byte(tc.word))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if w.Total != tc.expectTotal {
+			t.Errorf("expected %q to be trained %d times, got %s", tc.word, tc.expectTotal, w)
+		}
+	}
+
+	// The spammy words of the subject count less in the body than without zones
+	plain := newTestFilter()
+
+	err = plain.train([]byte("Subject: free money\n\nsee you at lunch\n"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	const msg = "Subject: hi\n\nfree money\n"
+
+	res, err := s.verdict([]byte(msg), ClassifyEmail, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	plainRes, err := plain.verdict([]byte(msg), ClassifyEmail, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Score >= plainRes.Score {
+		t.Errorf("expected header words to count less in the body with zones, got %s with zones and %s without", res, plainRes)
+	}
+
+	err = s.untrain([]byte("Subject: free money\n\nsee you at lunch\n"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w, _ := s.c.LookupWord([]byte(headerZone + "free m")); w.Total != 0 {
+		t.Errorf("expected untraining to remove the header words, got %s", w)
+	}
+}
+
+func TestSpamFilter_Meta(t *testing.T) {
+	s := newTestFilter()
+	words := classifier.New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, 6, classifier.WithWordShingles(1))
+	s.meta = classifier.NewMeta(s.c.Labels(), classifier.Member{Classifier: s.c, Weight: 1}, classifier.Member{Classifier: words, Weight: 1})
+
+	err := s.train([]byte("Subject: hi\n\ncheap pills online, best prices\n"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if w, _ := s.c.LookupWord([]byte("cheap ")); w.Spam != 1 {
+		t.Errorf("expected the ngram model to be trained, got %s", w)
+	}
+
+	if w, _ := words.LookupWord([]byte("pills")); w.Spam != 1 {
+		t.Errorf("expected the word model to be trained, got %s", w)
+	}
+
+	res, err := s.verdict([]byte("cheap pills"), ClassifyPlain, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label != "spam" || len(res.Components) != 2 {
+		t.Errorf("expected spam from both models, got %s with components %v", res, res.Components)
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	testCases := []struct {
+		list   string
+		expect []float64
+	}{
+		{"1,1", []float64{1, 1}},
+		{" 2 , 0.5", []float64{2, 0.5}},
+		{"1", nil},
+		{"1,0", nil},
+		{"1,lots", nil},
+	}
+
+	for _, tc := range testCases {
+		weights, err := parseWeights(tc.list, 2)
+		if tc.expect == nil {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %v", tc.list, weights)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(weights, tc.expect) {
+			t.Errorf("expected %v for %q, got %v (%v)", tc.expect, tc.list, weights, err)
+		}
+	}
+}
+
+func TestSpamFilter_HeaderLists(t *testing.T) {
+	const (
+		body = "Subject: lunch\n" +
+			"\n" +
+			"hello, just checking in about lunch tomorrow\n"
+
+		received = "Received: from mx.cheap-pills.example (mx.cheap-pills.example [192.0.2.1])\n" +
+			"\tby mail.example.org; Tue, 1 Jun 2021 10:00:00 +0000\n" +
+			"DKIM-Signature: v=1; d=cheap-pills.example; b=cheappillscheappills\n"
+	)
+
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("cheap-pills cheap pills"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = s.c.Train(strings.NewReader("hello, just checking in about lunch"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	score := func(msg string) float64 {
+		res, err := s.verdict([]byte(msg), ClassifyEmail, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return res.Score
+	}
+
+	if score(received+body) == score(body) {
+		t.Fatalf("expected received headers to affect the score when they are included")
+	}
+
+	s.excludeHeaders = []string{"Received", "DKIM-Signature"}
+
+	if got, expect := score(received+body), score(body); got != expect {
+		t.Errorf("expected excluded headers not to affect the score %f, got %f", expect, got)
+	}
+
+	s.excludeHeaders = nil
+	s.includeHeaders = []string{"subject"}
+
+	if got, expect := score(received+body), score(body); got != expect {
+		t.Errorf("expected headers that aren't included not to affect the score %f, got %f", expect, got)
+	}
+
+	if score("X-Mailer: cheap pills\n"+body) != score(body) {
+		t.Errorf("expected headers that aren't included not to affect the score")
+	}
+}
+
+func TestSpamFilter_ClassifyAndRoute(t *testing.T) {
+	s := newTestFilter()
+
+	err := s.c.Train(strings.NewReader("cheap pills online, best prices"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = s.c.Train(strings.NewReader("hello, just checking in about lunch"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var spam, ham, fallback bytes.Buffer
+
+	routes := map[string]io.Writer{
+		"spam": &spam,
+		"ham":  &ham,
+		"":     &fallback,
+	}
+
+	messages := []string{
+		"Subject: offer\n\ncheap pills online, best prices\n",
+		"Subject: lunch\n\nhello, just checking in about lunch\n",
+		"Subject: something else\n\nquarterly zebra figures\n",
+		"Subject: seen\nX-Mailfilter: label=\"spam\"\n\nhello, just checking in about lunch\n",
+	}
+
+	for _, msg := range messages {
+		err := s.ClassifyAndRoute(strings.NewReader(msg), routes)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if !strings.Contains(spam.String(), "Subject: offer") || strings.Count(spam.String(), "Subject:") != 1 {
+		t.Errorf("unexpected spam output %q", spam.String())
+	}
+
+	if !strings.Contains(ham.String(), "Subject: lunch") || strings.Count(ham.String(), "Subject:") != 1 {
+		t.Errorf("unexpected ham output %q", ham.String())
+	}
+
+	// Unsure messages have no route of their own, and already classified messages have no label
+	if !strings.Contains(fallback.String(), "Subject: something else") || !strings.Contains(fallback.String(), "Subject: seen") {
+		t.Errorf("unexpected fallback output %q", fallback.String())
+	}
+
+	delete(routes, "")
+
+	err = s.ClassifyAndRoute(strings.NewReader(messages[2]), routes)
+	if err == nil {
+		t.Errorf("expected an error without a fallback route")
+	}
+}
+
+func TestSpamFilter_Pipe(t *testing.T) {
+	s := newTestFilter()
+
+	in := bytes.NewBufferString("From: Bob <bob@example.com>\nSubject: hello\n\njust checking in\n")
+
+	var out bytes.Buffer
+
+	err := s.pipe(in, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header, body := splitHeader(t, out.String())
+	if !strings.Contains(header, "X-Mailfilter: label=") || body != "just checking in\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	// Without a header block, the message can't be written back
+	out.Reset()
+
+	err = s.pipe(bytes.NewBufferString("just some text"), &out)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("expected no output on error, got %q", out.String())
+	}
+}
+
+func TestSpamFilter_AlreadyClassified(t *testing.T) {
+	const msg = "From: Bob <bob@example.com>\n" +
+		"X-Mailfilter: label=\"spam\", score=0.123456, η=-2.197 [-2.1972,\n" +
+		"\t0.0000]\n" +
+		"Subject: hello\n" +
+		"\n" +
+		"just checking in\n"
+
+	for _, reclassify := range []bool{false, true} {
+		s := newTestFilter()
+		s.reclassify = reclassify
+
+		var out bytes.Buffer
+
+		err := s.classify(strings.NewReader(msg), &out, ClassifyEmail, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		header, body := splitHeader(t, out.String())
+
+		if n := strings.Count(header, "X-Mailfilter:"); n != 1 {
+			t.Errorf("expected exactly one verdict header with reclassify=%t, got %d: %q", reclassify, n, header)
+		}
+
+		if strings.Contains(header, "score=0.123456") == reclassify {
+			t.Errorf("unexpected old verdict with reclassify=%t: %q", reclassify, header)
+		}
+
+		if body != "just checking in\n" {
+			t.Errorf("unexpected body: %q", body)
+		}
+	}
+}
+
+func TestSpamFilter_ClassifyCRLF(t *testing.T) {
+	const msg = "From: Bob <bob@example.com>\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"just checking in\r\n"
+
+	s := newTestFilter()
+
+	var out bytes.Buffer
+
+	err := s.classify(strings.NewReader(msg), &out, ClassifyEmail, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	parts := strings.SplitN(out.String(), "\r\n\r\n", 2)
+	if len(parts) != 2 {
+		t.Fatalf("no CRLF header block in %q", out.String())
+	}
+
+	lines := strings.Split(parts[0], "\r\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "X-Mailfilter: label=") {
+		t.Errorf("expected verdict as last header line, got %q", parts[0])
+	}
+
+	if strings.Contains(strings.ReplaceAll(out.String(), "\r\n", ""), "\n") {
+		t.Errorf("found bare LF in output: %q", out.String())
+	}
+
+	if parts[1] != "just checking in\r\n" {
+		t.Errorf("unexpected body: %q", parts[1])
+	}
+}
+
+func TestSpamFilter_SpamAssassinHeaders(t *testing.T) {
+	const msg = "From: Bob <bob@example.com>\n" +
+		"X-Spam-Status: No, score=0.1 required=5.0\n" +
+		"Subject: cheap pills\n" +
+		"\n" +
+		"cheap pills online, best prices\n"
+
+	// Patterns that procmail recipes commonly use to sort spam
+	flag := regexp.MustCompile(`(?m)^X-Spam-Flag: YES$`)
+	status := regexp.MustCompile(`(?m)^X-Spam-Status: (Yes|No), score=-?[0-9]+\.[0-9] required=5\.0$`)
+
+	for _, style := range []HeaderStyle{HeaderSpamAssassin, HeaderBoth} {
+		s := newTestFilter()
+		s.headerStyle = style
+		s.reclassify = true
+
+		err := s.c.Train(strings.NewReader("cheap pills online, best prices"), true, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		var out bytes.Buffer
+
+		err = s.classify(strings.NewReader(msg), &out, ClassifyEmail, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		header, _ := splitHeader(t, out.String())
+
+		if !flag.MatchString(header) {
+			t.Errorf("style %d: expected spam flag in %q", style, header)
+		}
+
+		if m := status.FindAllStringSubmatch(header, -1); len(m) != 1 || m[0][1] != "Yes" {
+			t.Errorf("style %d: expected exactly one positive spam status in %q", style, header)
+		}
+
+		if strings.Contains(header, "X-Mailfilter:") != (style == HeaderBoth) {
+			t.Errorf("style %d: unexpected X-Mailfilter header in %q", style, header)
+		}
+	}
+}
+
+func TestSpamFilter_HeaderName(t *testing.T) {
+	const msg = "From: Bob <bob@example.com>\n" +
+		"X-Spam-Verdict: label=\"spam\", score=0.123456\n" +
+		"X-Mailfilter: label=\"ham\", score=0.000000, from upstream\n" +
+		"Subject: hello\n" +
+		"\n" +
+		"just checking in\n"
+
+	s := newTestFilter()
+	s.headerName = "X-Spam-Verdict"
+	s.reclassify = true
+
+	var out bytes.Buffer
+
+	err := s.classify(strings.NewReader(msg), &out, ClassifyEmail, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header, _ := splitHeader(t, out.String())
+	lines := strings.Split(header, "\n")
+
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "X-Spam-Verdict: label=") {
+		t.Errorf("expected verdict in custom header as last header line, got %q", header)
+	}
+
+	if n := strings.Count(header, "X-Spam-Verdict:"); n != 1 || strings.Contains(header, "score=0.123456") {
+		t.Errorf("expected old verdict to be replaced, got %q", header)
+	}
+
+	// Other headers with the default name are left alone
+	if !strings.Contains(header, "X-Mailfilter: label=\"ham\", score=0.000000, from upstream") {
+		t.Errorf("expected X-Mailfilter header to be kept, got %q", header)
+	}
+
+	s.reclassify = false
+
+	if name, ok := s.alreadyClassified([]byte(msg)); !ok || name != "X-Spam-Verdict" {
+		t.Errorf("expected message to be classified already by the custom header, got %q, %t", name, ok)
+	}
+}
+
+func TestValidateHeaderName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"X-Mailfilter":   true,
+		"X-Spam-Score":   true,
+		"x_verdict.2":    true,
+		"":               false,
+		"X Mailfilter":   false,
+		"X-Mailfilter:":  false,
+		"X-Mail\nfilter": false,
+		"X-Mäilfilter":   false,
+	} {
+		err := ValidateHeaderName(name)
+		if (err == nil) != valid {
+			t.Errorf("expected header name %q to be valid: %t, got %v", name, valid, err)
+		}
+	}
+}
+
+func TestSpamFilter_LanguageModels(t *testing.T) {
+	const (
+		englishSpam = "Subject: your prize\n\nCongratulations! You have been selected to receive a free gift card. Click the link below to claim your prize before it expires.\n"
+		germanHam   = "Subject: Treffen\n\nHallo zusammen, ich wollte nur kurz fragen, ob wir uns morgen wie geplant im Büro treffen oder lieber verschieben sollen.\n"
+	)
+
+	s := newTestFilter()
+	s.detector = lang.Default()
+
+	enTotal, deTotal := &testDB{}, &testDB{}
+	s.models = map[string]*classifier.Classifier{
+		"en": classifier.New(enTotal, &testDB{}, &testDB{}, 0.3, 0.7, 6),
+		"de": classifier.New(deTotal, &testDB{}, &testDB{}, 0.3, 0.7, 6),
+	}
+
+	for _, tc := range []struct {
+		msg  string
+		spam bool
+	}{
+		{englishSpam, true},
+		{germanHam, false},
+	} {
+		err := s.train([]byte(tc.msg), tc.spam, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if len(enTotal.m) == 0 || len(deTotal.m) == 0 {
+		t.Fatalf("expected both models to be trained")
+	}
+
+	if enTotal.Score([]byte("Hallo ")) != 0 || deTotal.Score([]byte("Congra")) != 0 {
+		t.Errorf("expected messages to be trained into the model for their language only")
+	}
+
+	for _, tc := range []struct {
+		msg   string
+		label string
+	}{
+		{englishSpam, "spam"},
+		{germanHam, "ham"},
+	} {
+		result, err := s.verdict([]byte(tc.msg), ClassifyEmail, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if result.Label != tc.label {
+			t.Errorf("expected %q, got %s for %q", tc.label, result, tc.msg)
+		}
+	}
+}
+
+// splitHeader splits the rewritten message msg into its header block and body.
+func splitHeader(t *testing.T, msg string) (string, string) {
+	t.Helper()
+
+	parts := strings.SplitN(msg, "\n\n", 2)
+	if len(parts) != 2 {
+		t.Fatalf("no header block in %q", msg)
+	}
+
+	return parts[0], parts[1]
+}
+
+func TestParseLabelBands(t *testing.T) {
+	bands, err := ParseLabelBands("0:clean, 0.3:suspect,0.7:junk")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expect := []classifier.LabelBand{
+		{Threshold: 0, Label: "clean"},
+		{Threshold: 0.3, Label: "suspect"},
+		{Threshold: 0.7, Label: "junk"},
+	}
+	if !reflect.DeepEqual(bands, expect) {
+		t.Errorf("expected %+v, got %+v", expect, bands)
+	}
+
+	for _, spec := range []string{"", "clean", "x:clean", "0:clean,0.7:junk,0.3:suspect"} {
+		_, err := ParseLabelBands(spec)
+		if err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	limits := httpLimits{
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		ReadTimeout:       time.Second,
+		WriteTimeout:      2 * time.Second,
+		IdleTimeout:       3 * time.Second,
+		MaxHeaderBytes:    1024,
+	}
+
+	srv := newHTTPServer("127.0.0.1:0", http.NotFoundHandler(), limits)
+
+	if srv.ReadHeaderTimeout != limits.ReadHeaderTimeout || srv.ReadTimeout != limits.ReadTimeout ||
+		srv.WriteTimeout != limits.WriteTimeout || srv.IdleTimeout != limits.IdleTimeout ||
+		srv.MaxHeaderBytes != limits.MaxHeaderBytes {
+		t.Fatalf("expected limits %+v to be applied, got %+v", limits, srv)
+	}
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// A client that never finishes its headers is disconnected
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /classify HTTP/1.1\r\nHost: localhost\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = ioutil.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("expected the server to close the connection of a slow client")
+	}
+}
@@ -0,0 +1,87 @@
+// Package mbox splits mbox files into the messages they contain.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// A Reader yields the messages of an mbox file one at a time. Messages are separated by
+// lines starting with "From ". Body lines that were escaped as ">From " (or ">>From " and so
+// on, as in mboxrd) have one level of quoting removed.
+type Reader struct {
+	r *bufio.Reader
+
+	// started is set once the separator line of the current message has been read
+	started bool
+}
+
+// NewReader creates a Reader that reads an mbox from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+var separator = []byte("From ")
+
+// Next returns a reader for the next message in the mbox, without its "From " separator
+// line. It returns io.EOF when there are no more messages.
+func (r *Reader) Next() (io.Reader, error) {
+	var msg bytes.Buffer
+
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, errors.Wrap(err, "reading mbox")
+		}
+
+		if bytes.HasPrefix(line, separator) {
+			if r.started {
+				// Start of the next message, its contents are read by the following call
+				return trimSeparator(&msg), nil
+			}
+
+			// Anything before the first separator line is not part of a message
+			r.started = true
+		} else if r.started {
+			msg.Write(unescape(line))
+		}
+
+		if err != nil {
+			if !r.started {
+				return nil, io.EOF
+			}
+
+			r.started = false
+			return trimSeparator(&msg), nil
+		}
+	}
+}
+
+// unescape removes one level of quoting from lines like ">From " or ">>From ".
+func unescape(line []byte) []byte {
+	trimmed := bytes.TrimLeft(line, ">")
+	if len(trimmed) < len(line) && bytes.HasPrefix(trimmed, separator) {
+		return line[1:]
+	}
+
+	return line
+}
+
+// trimSeparator removes the empty line that separates msg from the following message.
+func trimSeparator(msg *bytes.Buffer) io.Reader {
+	b := msg.Bytes()
+
+	switch {
+	case bytes.HasSuffix(b, []byte("\r\n\r\n")):
+		b = b[:len(b)-2]
+	case bytes.HasSuffix(b, []byte("\n\n")):
+		b = b[:len(b)-1]
+	}
+
+	return bytes.NewReader(b)
+}
@@ -0,0 +1,77 @@
+package mbox
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReader_Next(t *testing.T) {
+	const in = "From alice@example.com Sun Oct 18 23:46:34 2020\n" +
+		"From: Alice <alice@example.com>\n" +
+		"Subject: first\n" +
+		"\n" +
+		"Hello Bob,\n" +
+		">From here on, things get weird.\n" +
+		">>From quoted twice\n" +
+		"\n" +
+		"From bob@example.com Mon Oct 19 08:00:00 2020\n" +
+		"From: Bob <bob@example.com>\n" +
+		"Subject: second\n" +
+		"\n" +
+		"Hi Alice\n"
+
+	want := []string{
+		"From: Alice <alice@example.com>\n" +
+			"Subject: first\n" +
+			"\n" +
+			"Hello Bob,\n" +
+			"From here on, things get weird.\n" +
+			">From quoted twice\n",
+		"From: Bob <bob@example.com>\n" +
+			"Subject: second\n" +
+			"\n" +
+			"Hi Alice\n",
+	}
+
+	r := NewReader(strings.NewReader(in))
+
+	var have []string
+	for {
+		msg, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		buf, err := ioutil.ReadAll(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		have = append(have, string(buf))
+	}
+
+	if len(want) != len(have) {
+		t.Fatalf("expected %d messages, got %d: %q", len(want), len(have), have)
+	}
+
+	for i := range want {
+		if want[i] != have[i] {
+			t.Errorf("unexpected message %d:\nwant: %q\nhave: %q", i, want[i], have[i])
+		}
+	}
+}
+
+func TestReader_Empty(t *testing.T) {
+	r := NewReader(strings.NewReader(""))
+
+	_, err := r.Next()
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
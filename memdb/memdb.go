@@ -0,0 +1,75 @@
+// Package memdb implements a database for the classifier that keeps exact counts in memory,
+// for tests and experiments that shouldn't touch the disk. Nothing is ever persisted.
+package memdb
+
+import (
+	"sync"
+)
+
+// A DB counts byte sequences in a map. It is safe for concurrent use, and the zero value is an
+// empty DB that is ready to use.
+type DB struct {
+	mu sync.RWMutex
+
+	m map[string]uint64
+}
+
+// New returns an empty DB.
+func New() *DB {
+	return &DB{}
+}
+
+// Add adds factor to the count of w.
+func (d *DB) Add(w []byte, factor uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.m == nil {
+		d.m = make(map[string]uint64)
+	}
+
+	d.m[string(w)] += factor
+}
+
+// Remove subtracts factor from the count of w. Counts don't drop below 0.
+func (d *DB) Remove(w []byte, factor uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.m[string(w)] <= factor {
+		delete(d.m, string(w))
+		return
+	}
+
+	d.m[string(w)] -= factor
+}
+
+// Scale multiplies the count of w by factor, which has to be between 0 and 1, rounding down.
+func (d *DB) Scale(w []byte, factor float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := uint64(float64(d.m[string(w)]) * factor)
+	if n == 0 {
+		delete(d.m, string(w))
+		return
+	}
+
+	d.m[string(w)] = n
+}
+
+// Score returns the count of w.
+func (d *DB) Score(w []byte) uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.m[string(w)]
+}
+
+// Len returns the number of distinct sequences with a count above 0.
+func (d *DB) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return len(d.m)
+}
@@ -0,0 +1,100 @@
+package memdb_test
+
+import (
+	"strings"
+	"testing"
+
+	"mailfilter/classifier"
+	"mailfilter/memdb"
+)
+
+var _ classifier.ScalableDB = (*memdb.DB)(nil)
+
+func TestDB_AddRemove(t *testing.T) {
+	db := memdb.New()
+
+	db.Add([]byte("spam"), 3)
+	db.Add([]byte("spam"), 2)
+	db.Add([]byte("ham"), 1)
+
+	if got := db.Score([]byte("spam")); got != 5 {
+		t.Errorf("expected count 5, got %d", got)
+	}
+
+	db.Remove([]byte("spam"), 2)
+
+	if got := db.Score([]byte("spam")); got != 3 {
+		t.Errorf("expected count 3 after removing 2, got %d", got)
+	}
+
+	db.Remove([]byte("ham"), 5)
+	db.Remove([]byte("unknown"), 1)
+
+	if got := db.Score([]byte("ham")); got != 0 {
+		t.Errorf("expected count not to drop below 0, got %d", got)
+	}
+
+	if got := db.Len(); got != 1 {
+		t.Errorf("expected 1 sequence to be left, got %d", got)
+	}
+}
+
+func TestDB_Scale(t *testing.T) {
+	db := memdb.New()
+
+	db.Add([]byte("spam"), 9)
+	db.Add([]byte("ham"), 1)
+
+	db.Scale([]byte("spam"), 0.5)
+	db.Scale([]byte("ham"), 0.5)
+
+	if got := db.Score([]byte("spam")); got != 4 {
+		t.Errorf("expected count 4 after halving 9, got %d", got)
+	}
+
+	if got := db.Len(); got != 1 {
+		t.Errorf("expected counts that drop to 0 to be removed, got %d sequences", got)
+	}
+}
+
+func TestDB_Classifier(t *testing.T) {
+	c := classifier.New(memdb.New(), memdb.New(), memdb.New(), 0.3, 0.7, 6)
+
+	err := c.Train(strings.NewReader("cheap pills online, best prices"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = c.Train(strings.NewReader("hello, just checking in about lunch"), false, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for text, expect := range map[string]string{
+		"cheap pills at best prices": "spam",
+		"checking in about lunch":    "ham",
+	} {
+		res, err := c.Classify(strings.NewReader(text), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if res.Label != expect {
+			t.Errorf("expected %q to be %s, got %s", text, expect, res)
+		}
+	}
+
+	err = c.Untrain(strings.NewReader("cheap pills online, best prices"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	res, err := c.Classify(strings.NewReader("cheap pills online"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.Label == "spam" {
+		t.Errorf("expected untrained text not to be spam anymore, got %s", res)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"mailfilter/bloom"
+	"mailfilter/metrics"
+)
+
+var (
+	trainedMessages = metrics.NewCounter("mailfilter_trained_messages_total",
+		"Number of messages trained, by label.", "label")
+	untrainedMessages = metrics.NewCounter("mailfilter_untrained_messages_total",
+		"Number of messages untrained, by label.", "label")
+	classifiedMessages = metrics.NewCounter("mailfilter_classified_messages_total",
+		"Number of messages classified, by resulting label.", "label")
+	classifyRequests = metrics.NewCounter("mailfilter_classify_requests_total",
+		"Number of classification requests, by mode.", "mode")
+	classifyDuration = metrics.NewHistogram("mailfilter_classify_duration_seconds",
+		"Time spent classifying messages.", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5})
+)
+
+// registerDBMetrics adds a gauge for the load of each of the given bloom filter databases,
+// keyed by their name.
+func registerDBMetrics(dbs map[string]*bloom.DB) {
+	metrics.NewGaugeFunc("mailfilter_bloom_load",
+		"Fraction of non-zero fields in the bloom filter, by database.", "db",
+		func() map[string]float64 {
+			load := make(map[string]float64, len(dbs))
+			for name, db := range dbs {
+				load[name] = db.Stats().Load
+			}
+
+			return load
+		})
+}
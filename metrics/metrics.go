@@ -0,0 +1,242 @@
+// Package metrics implements a minimal set of metrics that can be scraped by Prometheus.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// A metric knows how to write itself in the Prometheus text exposition format.
+type metric interface {
+	write(w io.Writer) error
+}
+
+// A Registry holds a number of metrics and serves them over HTTP.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry that metrics created with the package level functions are added to.
+var Default = &Registry{}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes all metrics in r to w.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	err := r.Write(w)
+	if err != nil {
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code)+": "+err.Error(), code)
+	}
+}
+
+// Write writes all metrics in r to w.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		err := m.write(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A Counter is a monotonically increasing value, partitioned by the value of a single label.
+type Counter struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// NewCounter creates a counter with the given name, help text and label in the registry r.
+func (r *Registry) NewCounter(name, help, label string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]uint64),
+	}
+
+	r.add(c)
+
+	return c
+}
+
+// NewCounter creates a counter in the default registry.
+func NewCounter(name, help, label string) *Counter {
+	return Default.NewCounter(name, help, label)
+}
+
+// Inc increments the counter for the given label value by one.
+func (c *Counter) Inc(value string) {
+	c.Add(value, 1)
+}
+
+// Add increments the counter for the given label value by delta.
+func (c *Counter) Add(value string, delta uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[value] += delta
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mu.Lock()
+	values := make(map[string]float64, len(c.values))
+	for k, v := range c.values {
+		values[k] = float64(v)
+	}
+	c.mu.Unlock()
+
+	return writeFamily(w, c.name, c.help, "counter", c.label, values)
+}
+
+// A GaugeFunc is a value that is computed each time it is scraped, partitioned by the value of
+// a single label.
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+
+	f func() map[string]float64
+}
+
+// NewGaugeFunc creates a gauge with the given name, help text and label in the registry r. f
+// is called for each scrape and returns the current values, keyed by label value.
+func (r *Registry) NewGaugeFunc(name, help, label string, f func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{
+		name:  name,
+		help:  help,
+		label: label,
+		f:     f,
+	}
+
+	r.add(g)
+
+	return g
+}
+
+// NewGaugeFunc creates a gauge in the default registry.
+func NewGaugeFunc(name, help, label string, f func() map[string]float64) *GaugeFunc {
+	return Default.NewGaugeFunc(name, help, label, f)
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	return writeFamily(w, g.name, g.help, "gauge", g.label, g.f())
+}
+
+// A Histogram counts observations in buckets with configurable upper bounds.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the given name, help text and bucket upper bounds in the
+// registry r.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+
+	r.add(h)
+
+	return h
+}
+
+// NewHistogram creates a histogram in the default registry.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// Observe adds v to h.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	if err != nil {
+		return err
+	}
+
+	for i, b := range h.buckets {
+		_, err = fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, b, h.counts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h.name, h.count, h.name, h.sum, h.name, h.count)
+
+	return err
+}
+
+// writeFamily writes a metric family with the given values, sorted by label value.
+func writeFamily(w io.Writer, name, help, typ, label string, values map[string]float64) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		// %q takes care of escaping backslashes, double quotes and line breaks in label values
+		_, err = fmt.Fprintf(w, "%s{%s=%q} %g\n", name, label, k, values[k])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
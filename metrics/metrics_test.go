@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := &Registry{}
+
+	c := r.NewCounter("test_total", "A test counter.", "label")
+	c.Inc("spam")
+	c.Add("ham", 2)
+
+	r.NewGaugeFunc("test_load", "A test gauge.", "db", func() map[string]float64 {
+		return map[string]float64{"total": 0.5}
+	})
+
+	h := r.NewHistogram("test_seconds", "A test histogram.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+
+	err := r.Write(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := strings.Join([]string{
+		"# HELP test_total A test counter.",
+		"# TYPE test_total counter",
+		`test_total{label="ham"} 2`,
+		`test_total{label="spam"} 1`,
+		"# HELP test_load A test gauge.",
+		"# TYPE test_load gauge",
+		`test_load{db="total"} 0.5`,
+		"# HELP test_seconds A test histogram.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 5.55",
+		"test_seconds_count 3",
+		"",
+	}, "\n")
+
+	if want != buf.String() {
+		t.Errorf("unexpected output:\nwant:\n%s\nhave:\n%s", want, buf.String())
+	}
+}
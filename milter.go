@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"mailfilter/logger"
+	"mailfilter/milter"
+)
+
+// milterHandler classifies a message that an MTA passed to the milter server and returns the
+// verdict headers that should be added to it, along with the names of old verdict headers that
+// should be removed. It follows the same rules as classify in email mode.
+func (s *SpamFilter) milterHandler(msg []byte) ([]milter.Header, []string, error) {
+	if !s.isReady() {
+		return nil, nil, errors.New("databases are still loading")
+	}
+
+	if !s.reclassify {
+		if name, ok := s.alreadyClassified(msg); ok {
+			logger.Debugf("message already has a %s header, passing it through", name)
+
+			return nil, nil, nil
+		}
+	}
+
+	label, verdict, err := s.judge(msg, ClassifyEmail, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Debugf("milter classified message as %s", label)
+
+	var add []milter.Header
+	for _, f := range s.verdictFields(label, verdict) {
+		add = append(add, milter.Header{Name: f.name, Value: f.value})
+	}
+
+	return add, s.headerStyle.names(s.verdictHeaderName()), nil
+}
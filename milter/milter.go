@@ -0,0 +1,381 @@
+// Package milter implements the filter side of the milter protocol, which Sendmail and Postfix
+// use to pass messages to content filters. Only what's needed to look at complete messages and
+// add or remove headers is supported.
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"mailfilter/logger"
+)
+
+// Commands sent by the MTA
+const (
+	cmdOptNeg  = 'O'
+	cmdMacro   = 'D'
+	cmdConnect = 'C'
+	cmdHelo    = 'H'
+	cmdMail    = 'M'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+	cmdHeader  = 'L'
+	cmdEOH     = 'N'
+	cmdBody    = 'B'
+	cmdEOB     = 'E'
+	cmdAbort   = 'A'
+	cmdQuit    = 'Q'
+	cmdQuitNC  = 'K'
+	cmdUnknown = 'U'
+)
+
+// Responses sent by the filter
+const (
+	respOptNeg    = 'O'
+	respContinue  = 'c'
+	respAddHeader = 'h'
+	respChgHeader = 'm'
+)
+
+// Actions the filter may take, negotiated with cmdOptNeg
+const (
+	actAddHeaders    = 0x01
+	actChangeHeaders = 0x10
+)
+
+// Protocol steps the filter doesn't need to see, negotiated with cmdOptNeg
+const (
+	protoNoConnect = 0x01
+	protoNoHelo    = 0x02
+	protoNoMail    = 0x04
+	protoNoRcpt    = 0x08
+)
+
+// version is the highest protocol version the filter speaks.
+const version = 6
+
+// maxPacket is the largest packet the filter accepts. MTAs send message bodies in chunks of at
+// most 64KB.
+const maxPacket = 1 << 20
+
+// A Header is a header field of a message.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// A Handler looks at a complete message and returns the headers that should be added to it, and
+// the names of headers that should be removed from it. The message is in RFC 5322 format with
+// CRLF line endings. If the handler returns an error, the message is passed on unchanged.
+type Handler func(msg []byte) (add []Header, remove []string, err error)
+
+// A Server accepts connections from MTAs and passes the messages they send to a Handler.
+type Server struct {
+	Handler Handler
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// ErrServerClosed is returned by Serve after Close was called.
+var ErrServerClosed = errors.New("milter: server closed")
+
+// Serve accepts connections on l and serves each of them in a new goroutine. It always returns a
+// non-nil error and closes l.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		go func() {
+			err := s.serveConn(conn)
+			if err != nil {
+				logger.Errorf("milter connection from %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops all listeners that were passed to Serve. Connections that are already established
+// are served until the MTA closes them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		cerr := l.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// session holds the state of one connection from an MTA.
+type session struct {
+	handler Handler
+	r       *bufio.Reader
+	w       io.Writer
+
+	// actions holds the actions that the MTA granted during option negotiation
+	actions uint32
+
+	headers []Header
+	body    bytes.Buffer
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	defer conn.Close()
+
+	sess := &session{
+		handler: s.Handler,
+		r:       bufio.NewReader(conn),
+		w:       conn,
+	}
+
+	for {
+		cmd, data, err := sess.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		quit, err := sess.handle(cmd, data)
+		if err != nil {
+			return err
+		}
+
+		if quit {
+			return nil
+		}
+	}
+}
+
+// read reads a packet from the MTA.
+func (s *session) read() (byte, []byte, error) {
+	var size uint32
+
+	err := binary.Read(s.r, binary.BigEndian, &size)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if size == 0 || size > maxPacket {
+		return 0, nil, fmt.Errorf("invalid packet size %d", size)
+	}
+
+	buf := make([]byte, size)
+
+	_, err = io.ReadFull(s.r, buf)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading packet: %w", err)
+	}
+
+	return buf[0], buf[1:], nil
+}
+
+// write sends a packet to the MTA.
+func (s *session) write(cmd byte, data ...[]byte) error {
+	size := 1
+	for _, d := range data {
+		size += len(d)
+	}
+
+	buf := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	buf = append(buf, cmd)
+
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+
+	_, err := s.w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// reset forgets the current message.
+func (s *session) reset() {
+	s.headers = nil
+	s.body.Reset()
+}
+
+// handle handles a command from the MTA and reports whether the connection should be closed.
+func (s *session) handle(cmd byte, data []byte) (bool, error) {
+	switch cmd {
+	case cmdOptNeg:
+		if len(data) < 12 {
+			return false, errors.New("short option negotiation")
+		}
+
+		v := binary.BigEndian.Uint32(data[0:4])
+		actions := binary.BigEndian.Uint32(data[4:8])
+		protocol := binary.BigEndian.Uint32(data[8:12])
+
+		if v < 2 {
+			return false, fmt.Errorf("unsupported protocol version %d", v)
+		}
+		if v > version {
+			v = version
+		}
+
+		s.actions = actions & (actAddHeaders | actChangeHeaders)
+
+		var resp [12]byte
+		binary.BigEndian.PutUint32(resp[0:4], v)
+		binary.BigEndian.PutUint32(resp[4:8], s.actions)
+		binary.BigEndian.PutUint32(resp[8:12], protocol&(protoNoConnect|protoNoHelo|protoNoMail|protoNoRcpt))
+
+		return false, s.write(respOptNeg, resp[:])
+	case cmdMacro:
+		// Macros don't get a response
+		return false, nil
+	case cmdConnect, cmdHelo, cmdMail, cmdRcpt, cmdData, cmdEOH, cmdUnknown:
+		return false, s.write(respContinue)
+	case cmdHeader:
+		fields := bytes.SplitN(data, []byte{0}, 3)
+		if len(fields) < 2 {
+			return false, errors.New("malformed header")
+		}
+
+		s.headers = append(s.headers, Header{Name: string(fields[0]), Value: string(fields[1])})
+
+		return false, s.write(respContinue)
+	case cmdBody:
+		s.body.Write(data)
+
+		return false, s.write(respContinue)
+	case cmdEOB:
+		s.body.Write(data)
+
+		err := s.endOfMessage()
+		s.reset()
+
+		return false, err
+	case cmdAbort:
+		// Abort doesn't get a response
+		s.reset()
+
+		return false, nil
+	case cmdQuitNC:
+		// The MTA reuses the connection for another client
+		s.reset()
+
+		return false, nil
+	case cmdQuit:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// endOfMessage passes the complete message to the handler and sends the resulting header changes
+// to the MTA.
+func (s *session) endOfMessage() error {
+	var msg bytes.Buffer
+
+	for _, h := range s.headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.Name, h.Value)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(s.body.Bytes())
+
+	add, remove, err := s.handler(msg.Bytes())
+	if err != nil {
+		logger.Errorf("can't handle message, passing it on unchanged: %s", err)
+
+		return s.write(respContinue)
+	}
+
+	// MTAs reject actions they didn't grant
+	if len(remove) > 0 && s.actions&actChangeHeaders == 0 {
+		logger.Infof("MTA doesn't allow changing headers, not removing %s", strings.Join(remove, ", "))
+		remove = nil
+	}
+
+	if len(add) > 0 && s.actions&actAddHeaders == 0 {
+		logger.Infof("MTA doesn't allow adding headers, not adding %d headers", len(add))
+		add = nil
+	}
+
+	for _, name := range remove {
+		// Header indices count occurrences of a header name, starting at 1. Remove the last one
+		// first so that the indices of the others stay the same.
+		var count uint32
+		for _, h := range s.headers {
+			if strings.EqualFold(h.Name, name) {
+				count++
+			}
+		}
+
+		for idx := count; idx > 0; idx-- {
+			var buf [4]byte
+			binary.BigEndian.PutUint32(buf[:], idx)
+
+			// An empty value removes the header
+			err := s.write(respChgHeader, buf[:], cstring(name), cstring(""))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, h := range add {
+		err := s.write(respAddHeader, cstring(h.Name), cstring(h.Value))
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.write(respContinue)
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
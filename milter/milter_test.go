@@ -0,0 +1,284 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mta is the MTA side of a milter connection.
+type mta struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (m *mta) send(cmd byte, data ...string) {
+	m.t.Helper()
+
+	payload := []byte{cmd}
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+
+	_, err := m.conn.Write(append(size[:], payload...))
+	if err != nil {
+		m.t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func (m *mta) receive() (byte, []byte) {
+	m.t.Helper()
+
+	var size uint32
+
+	err := binary.Read(m.conn, binary.BigEndian, &size)
+	if err != nil {
+		m.t.Fatalf("unexpected error: %s", err)
+	}
+
+	buf := make([]byte, size)
+
+	_, err = io.ReadFull(m.conn, buf)
+	if err != nil {
+		m.t.Fatalf("unexpected error: %s", err)
+	}
+
+	return buf[0], buf[1:]
+}
+
+func (m *mta) expectContinue() {
+	m.t.Helper()
+
+	cmd, _ := m.receive()
+	if cmd != respContinue {
+		m.t.Fatalf("expected continue, got %q", cmd)
+	}
+}
+
+func uint32s(vs ...uint32) string {
+	var buf bytes.Buffer
+	for _, v := range vs {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+
+	return buf.String()
+}
+
+func TestServer_Message(t *testing.T) {
+	var got string
+
+	s := &Server{
+		Handler: func(msg []byte) ([]Header, []string, error) {
+			got = string(msg)
+
+			return []Header{{"X-Verdict", "spam"}}, []string{"X-Old-Verdict"}, nil
+		},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serveConn(server)
+	}()
+
+	m := &mta{t: t, conn: client}
+
+	m.send(cmdOptNeg, uint32s(6, 0x1ff, 0x1fffff))
+
+	cmd, data := m.receive()
+	if cmd != respOptNeg || len(data) != 12 {
+		t.Fatalf("unexpected option negotiation response %q %v", cmd, data)
+	}
+
+	if v := binary.BigEndian.Uint32(data[0:4]); v != 6 {
+		t.Errorf("expected version 6, got %d", v)
+	}
+
+	if a := binary.BigEndian.Uint32(data[4:8]); a != actAddHeaders|actChangeHeaders {
+		t.Errorf("unexpected actions %#x", a)
+	}
+
+	m.send(cmdMacro, "C", "j\x00mx.example.org\x00")
+	m.send(cmdConnect, "client.example.com\x00", "4", "\x00\x19", "192.0.2.1\x00")
+	m.expectContinue()
+	m.send(cmdMail, "<bob@example.com>\x00")
+	m.expectContinue()
+	m.send(cmdRcpt, "<alice@example.org>\x00")
+	m.expectContinue()
+
+	for _, h := range [][2]string{
+		{"From", "bob@example.com"},
+		{"X-Old-Verdict", "ham"},
+		{"Subject", "hello"},
+		{"x-old-verdict", "unsure"},
+	} {
+		m.send(cmdHeader, h[0], "\x00", h[1], "\x00")
+		m.expectContinue()
+	}
+
+	m.send(cmdEOH)
+	m.expectContinue()
+	m.send(cmdBody, "just checking ")
+	m.expectContinue()
+	m.send(cmdBody, "in\r\n")
+	m.expectContinue()
+	m.send(cmdEOB)
+
+	var changes []string
+	for {
+		cmd, data := m.receive()
+		if cmd == respContinue {
+			break
+		}
+
+		switch cmd {
+		case respChgHeader:
+			idx := binary.BigEndian.Uint32(data[:4])
+			fields := strings.Split(string(data[4:]), "\x00")
+			changes = append(changes, fmt.Sprintf("m %s %d %s", fields[0], idx, fields[1]))
+		case respAddHeader:
+			fields := strings.Split(string(data), "\x00")
+			changes = append(changes, fmt.Sprintf("h %s %s", fields[0], fields[1]))
+		default:
+			t.Fatalf("unexpected response %q", cmd)
+		}
+	}
+
+	m.send(cmdQuit)
+
+	err := <-errs
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	wantMsg := "From: bob@example.com\r\nX-Old-Verdict: ham\r\nSubject: hello\r\nx-old-verdict: unsure\r\n\r\njust checking in\r\n"
+	if got != wantMsg {
+		t.Errorf("expected message %q, got %q", wantMsg, got)
+	}
+
+	wantChanges := []string{
+		"m X-Old-Verdict 2 ",
+		"m X-Old-Verdict 1 ",
+		"h X-Verdict spam",
+	}
+	if strings.Join(changes, "\n") != strings.Join(wantChanges, "\n") {
+		t.Errorf("expected changes %q, got %q", wantChanges, changes)
+	}
+}
+
+func TestServer_Abort(t *testing.T) {
+	var got []string
+
+	s := &Server{
+		Handler: func(msg []byte) ([]Header, []string, error) {
+			got = append(got, string(msg))
+
+			return nil, nil, nil
+		},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serveConn(server)
+	}()
+
+	m := &mta{t: t, conn: client}
+
+	m.send(cmdOptNeg, uint32s(6, 0x1ff, 0x1fffff))
+	m.receive()
+
+	m.send(cmdHeader, "Subject\x00first\x00")
+	m.expectContinue()
+	m.send(cmdAbort)
+
+	m.send(cmdHeader, "Subject\x00second\x00")
+	m.expectContinue()
+	m.send(cmdEOB, "body\r\n")
+	m.expectContinue()
+
+	client.Close()
+
+	err := <-errs
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(got) != 1 || got[0] != "Subject: second\r\n\r\nbody\r\n" {
+		t.Errorf("expected only the second message, got %q", got)
+	}
+}
+
+func TestServer_Actions(t *testing.T) {
+	s := &Server{
+		Handler: func(msg []byte) ([]Header, []string, error) {
+			return []Header{{"X-Verdict", "spam"}}, []string{"X-Old-Verdict"}, nil
+		},
+	}
+
+	testCases := []struct {
+		actions uint32
+		want    []byte
+	}{
+		{actAddHeaders | actChangeHeaders, []byte{respChgHeader, respAddHeader, respContinue}},
+		{actAddHeaders, []byte{respAddHeader, respContinue}},
+		{actChangeHeaders, []byte{respChgHeader, respContinue}},
+		{0, []byte{respContinue}},
+	}
+
+	for _, tc := range testCases {
+		client, server := net.Pipe()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- s.serveConn(server)
+		}()
+
+		m := &mta{t: t, conn: client}
+
+		m.send(cmdOptNeg, uint32s(6, tc.actions, 0))
+
+		_, data := m.receive()
+		if a := binary.BigEndian.Uint32(data[4:8]); a != tc.actions {
+			t.Errorf("expected actions %#x to be granted, got %#x", tc.actions, a)
+		}
+
+		m.send(cmdHeader, "X-Old-Verdict\x00ham\x00")
+		m.expectContinue()
+		m.send(cmdEOB, "body\r\n")
+
+		var got []byte
+		for {
+			cmd, _ := m.receive()
+			got = append(got, cmd)
+
+			if cmd == respContinue {
+				break
+			}
+		}
+
+		m.send(cmdQuit)
+
+		err := <-errs
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		client.Close()
+
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("actions %#x: expected responses %q, got %q", tc.actions, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpamFilter_MilterHandler(t *testing.T) {
+	const msg = "From: Bob <bob@example.com>\r\n" +
+		"X-Mailfilter: label=\"ham\", score=0.123456\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"just checking in\r\n"
+
+	s := newTestFilter()
+
+	add, remove, err := s.milterHandler([]byte(msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(add) != 0 || len(remove) != 0 {
+		t.Errorf("expected classified message to be passed on unchanged, got %v, %v", add, remove)
+	}
+
+	s.reclassify = true
+
+	add, remove, err = s.milterHandler([]byte(msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(add) != 1 || add[0].Name != "X-Mailfilter" || !strings.HasPrefix(add[0].Value, "label=") {
+		t.Errorf("expected a new verdict header, got %v", add)
+	}
+
+	if len(remove) != 1 || remove[0] != "X-Mailfilter" {
+		t.Errorf("expected old verdict header to be removed, got %v", remove)
+	}
+}
+
+func TestSpamFilter_MilterHandlerNotReady(t *testing.T) {
+	s := &SpamFilter{}
+
+	_, _, err := s.milterHandler([]byte("Subject: hello\r\n\r\nbody\r\n"))
+	if err == nil {
+		t.Errorf("expected error while databases are loading")
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/classifier"
+)
+
+// extractText parses the RFC2046-encoded message in msg and returns the text that should be
+// fed to the classifier: the raw header block, followed by the decoded contents of all
+// text/plain and text/html parts. Binary attachments are skipped. If include is not empty, only
+// the headers listed in it are kept. Headers listed in exclude are dropped either way.
+func extractText(msg []byte, include, exclude []string) ([]byte, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing message")
+	}
+
+	var out bytes.Buffer
+
+	// Keep the header block as it is, it carries a lot of signal on its own
+	writeHeaderBlock(&out, msg, include, exclude)
+
+	err = extractPart(&out, m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// extractBody parses the RFC2046-encoded message in msg and returns the decoded contents of all
+// its text/plain and text/html parts, without the header block.
+func extractBody(msg []byte) ([]byte, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing message")
+	}
+
+	var out bytes.Buffer
+
+	err = extractPart(&out, m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// writeHeaderBlock writes the header fields of msg to out, one line per field, skipping all
+// fields whose names are listed in exclude or, if include is not empty, not listed in include.
+// Folded fields are unfolded like net/mail does, joining their lines with a single space, so
+// that the words around a fold end up next to each other.
+func writeHeaderBlock(out *bytes.Buffer, msg []byte, include, exclude []string) {
+	var (
+		field string
+		skip  bool
+	)
+
+	flush := func() {
+		if field != "" && !skip {
+			out.WriteString(field)
+			out.WriteString("\n")
+		}
+
+		field = ""
+	}
+
+	r := bufio.NewReader(bytes.NewReader(msg))
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if err != nil || line == "" {
+			break
+		}
+
+		name, ok := headerFieldName(line)
+		if !ok && field != "" {
+			// Continuation line of a folded field
+			field = strings.TrimRight(field, " \t") + " " + strings.TrimLeft(line, " \t")
+			continue
+		}
+
+		flush()
+
+		if ok {
+			skip = (len(include) > 0 && !containsFold(include, name)) || containsFold(exclude, name)
+		}
+
+		field = line
+	}
+
+	flush()
+
+	out.WriteString("\n")
+}
+
+// containsFold reports whether names contains name, ignoring case.
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerFieldName returns the name of the header field that starts in line. If line is a
+// continuation line of a folded header field, ok is false.
+func headerFieldName(line string) (name string, ok bool) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return "", false
+	}
+
+	return strings.TrimSpace(strings.SplitN(line, ":", 2)[0]), true
+}
+
+// hasHeader reports whether the header block of msg contains a field with the given name.
+func hasHeader(msg []byte, name string) bool {
+	r := bufio.NewReader(bytes.NewReader(msg))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimRight(line, "\r\n") == "" {
+			return false
+		}
+
+		if n, ok := headerFieldName(line); ok && strings.EqualFold(n, name) {
+			return true
+		}
+	}
+}
+
+// headerSegments returns one classifier segment with the given weight for each of the named
+// headers that is present in msg. RFC2047-encoded header values are decoded.
+func headerSegments(msg []byte, names []string, weight float64) ([]classifier.Segment, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing message")
+	}
+
+	var (
+		dec      mime.WordDecoder
+		segments []classifier.Segment
+	)
+
+	for _, name := range names {
+		value := m.Header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		decoded, err := dec.DecodeHeader(value)
+		if err == nil {
+			value = decoded
+		}
+
+		segments = append(segments, classifier.Segment{
+			Text:   strings.NewReader(name + ": " + value),
+			Weight: weight,
+		})
+	}
+
+	return segments, nil
+}
+
+// extractPart writes the decoded text of the MIME entity in body to out. Multipart entities are
+// walked recursively, entities that are neither text/plain nor text/html are ignored. The markup
+// of text/html entities is stripped, see stripHTML.
+func extractPart(out io.Writer, contentType, encoding string, body io.Reader) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Can't make sense of the content type, treat it as plain text like an untyped body
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			// NextPart transparently decodes quoted-printable parts and removes their
+			// Content-Transfer-Encoding header.
+			p, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "reading multipart message")
+			}
+
+			err = extractPart(out, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch mediaType {
+	case "text/plain", "text/html":
+	default:
+		// Binary attachments only add noise
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	text, err := ioutil.ReadAll(body)
+	if err != nil {
+		return errors.Wrapf(err, "decoding %s part", mediaType)
+	}
+
+	if mediaType == "text/html" {
+		text = stripHTML(text)
+	}
+
+	_, err = out.Write(text)
+	if err != nil {
+		return errors.Wrap(err, "writing decoded text")
+	}
+
+	_, err = io.WriteString(out, "\n")
+	if err != nil {
+		return errors.Wrap(err, "writing decoded text")
+	}
+
+	return nil
+}
+
+// inlineTags are the HTML elements that don't separate words, so that "<b>c</b>heap" still reads
+// as "cheap". All other tags are replaced with a space.
+var inlineTags = map[string]bool{
+	"a": true, "abbr": true, "b": true, "big": true, "code": true, "em": true, "font": true,
+	"i": true, "small": true, "span": true, "strong": true, "sub": true, "sup": true, "u": true,
+}
+
+// stripHTML returns the text of the HTML document in doc without its markup: tags, comments and
+// the contents of script and style elements are dropped and character references are decoded.
+// It doesn't try to be a conforming parser, it only has to keep the markup out of the
+// classifier, including that of broken or deliberately obfuscated documents.
+func stripHTML(doc []byte) []byte {
+	var (
+		out  bytes.Buffer
+		text []byte
+		skip string // Name of the script or style element whose contents are dropped
+	)
+
+	flush := func() {
+		if skip == "" {
+			out.WriteString(html.UnescapeString(string(text)))
+		}
+
+		text = text[:0]
+	}
+
+	for i := 0; i < len(doc); {
+		if doc[i] != '<' {
+			text = append(text, doc[i])
+			i++
+
+			continue
+		}
+
+		if bytes.HasPrefix(doc[i:], []byte("<!--")) {
+			flush()
+
+			end := bytes.Index(doc[i+4:], []byte("-->"))
+			if end < 0 {
+				break
+			}
+
+			i += 4 + end + 3
+
+			continue
+		}
+
+		name, closing, ok := tagName(doc[i+1:])
+		if !ok {
+			// A lone "<", like in "a < b"
+			text = append(text, doc[i])
+			i++
+
+			continue
+		}
+
+		flush()
+
+		i += 1 + tagEnd(doc[i+1:])
+
+		switch {
+		case skip != "":
+			if closing && name == skip {
+				skip = ""
+			}
+		case !closing && (name == "script" || name == "style"):
+			skip = name
+		case !inlineTags[name]:
+			out.WriteByte(' ')
+		}
+	}
+
+	flush()
+
+	return out.Bytes()
+}
+
+// tagName returns the lowercased name of the tag that starts after a "<" at the beginning of b,
+// and whether it is a closing tag. Declarations like "<!DOCTYPE html>" have an empty name. If b
+// doesn't start a tag, ok is false.
+func tagName(b []byte) (name string, closing, ok bool) {
+	if len(b) > 0 && b[0] == '/' {
+		closing = true
+		b = b[1:]
+	}
+
+	if len(b) > 0 && (b[0] == '!' || b[0] == '?') && !closing {
+		return "", false, true
+	}
+
+	n := 0
+	for n < len(b) && (b[n] >= 'a' && b[n] <= 'z' || b[n] >= 'A' && b[n] <= 'Z' || n > 0 && b[n] >= '0' && b[n] <= '9') {
+		n++
+	}
+
+	if n == 0 {
+		return "", false, false
+	}
+
+	return strings.ToLower(string(b[:n])), closing, true
+}
+
+// tagEnd returns the length of the tag at the beginning of b, up to and including its closing
+// ">", skipping quoted attribute values. An unterminated tag extends to the end of b.
+func tagEnd(b []byte) int {
+	var quote byte
+
+	for i, c := range b {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+
+	return len(b)
+}
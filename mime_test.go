@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const multipartMessage = `From: Emma Johnson <info@example.com>
+To: someone@example.org
+Subject: RE: Leads and Scheduled appointments
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+This is a multi-part message in MIME format.
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Are you interested to get qualified leads for your busin=
+ess?
+
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+R2V0IHlvdXIgbGVhZHMgbm93PC9wPg==
+
+--inner--
+
+--outer
+Content-Type: application/octet-stream; name="brochure.bin"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="brochure.bin"
+
+U0VDUkVUQVRUQUNITUVOVA==
+
+--outer--
+`
+
+func TestExtractText_Multipart(t *testing.T) {
+	text, err := extractText([]byte(multipartMessage), nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Logf("extracted text: %q", text)
+
+	for _, want := range []string{
+		"Subject: RE: Leads and Scheduled appointments",
+		"qualified leads for your business?",
+		"Get your leads now",
+	} {
+		if !bytes.Contains(text, []byte(want)) {
+			t.Errorf("expected extracted text to contain %q", want)
+		}
+	}
+
+	for _, unwanted := range []string{
+		"--inner",
+		"--outer",
+		"PHA+R2V0IHlvdXIgbGVhZHMgbm93PC9wPg==",
+		"SECRETATTACHMENT",
+		"<p>",
+		"U0VDUkVUQVRUQUNITUVOVA==",
+	} {
+		if bytes.Contains(text, []byte(unwanted)) {
+			t.Errorf("expected extracted text not to contain %q", unwanted)
+		}
+	}
+}
+
+func TestSpamFilter_ClassifyMultipart(t *testing.T) {
+	s := newTestFilter()
+
+	var out bytes.Buffer
+
+	err := s.classify(strings.NewReader(multipartMessage), &out, ClassifyEmail, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header, body := splitHeader(t, out.String())
+	if !strings.Contains(header, "\nX-Mailfilter: label=") {
+		t.Errorf("expected verdict at the end of the header block, got %q", header)
+	}
+
+	if strings.SplitN(multipartMessage, "\n\n", 2)[1] != body {
+		t.Errorf("message body was modified: %q", body)
+	}
+}
+
+func TestExtractText_FoldedHeader(t *testing.T) {
+	const (
+		folded = "From: Bob <bob@example.com>\r\n" +
+			"Subject: cheap\r\n" +
+			"\tpills online,  \r\n" +
+			"   best prices\r\n" +
+			"X-Excluded: cheap\r\n" +
+			" pills\r\n" +
+			"\r\n" +
+			"hello, just checking in\r\n"
+
+		unfolded = "From: Bob <bob@example.com>\n" +
+			"Subject: cheap pills online, best prices\n" +
+			"\n" +
+			"hello, just checking in\n"
+	)
+
+	text, err := extractText([]byte(folded), nil, []string{"X-Excluded"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header := strings.SplitN(string(text), "\n\n", 2)[0]
+	if header != "From: Bob <bob@example.com>\nSubject: cheap pills online, best prices" {
+		t.Errorf("expected folded subject to be unfolded and excluded field to be dropped entirely, got %q", header)
+	}
+
+	// The words around the folds are tokenized together, so both versions score the same
+	s := newTestFilter()
+
+	err = s.c.Train(strings.NewReader("cheap pills online, best prices"), true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var scores []float64
+
+	for _, msg := range []string{folded, unfolded} {
+		res, err := s.verdict([]byte(msg), ClassifyEmail, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		scores = append(scores, res.Score)
+	}
+
+	if scores[0] != scores[1] {
+		t.Errorf("expected folded subject to score like the unfolded one (%f), got %f", scores[1], scores[0])
+	}
+}
+
+func TestExtractText_HTMLOnly(t *testing.T) {
+	const msg = "Subject: offer\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<html><head><style>p { color: red; }</style></head>\r\n" +
+		"<body><!-- hidden --><p class=3D\"x\">Buy <b>ch</b>eap pills</p><p>Fish &amp; chips</p></body></html>\r\n"
+
+	text, err := extractBody([]byte(msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, want := range []string{"Buy cheap pills", "Fish & chips"} {
+		if !bytes.Contains(text, []byte(want)) {
+			t.Errorf("expected %q in the text, got %q", want, text)
+		}
+	}
+
+	for _, unwanted := range []string{"<", ">", "color", "hidden", "class", "&amp;"} {
+		if bytes.Contains(text, []byte(unwanted)) {
+			t.Errorf("expected no %q in the text, got %q", unwanted, text)
+		}
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	testCases := []struct {
+		doc  string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"a < b and c > d", "a < b and c > d"},
+		{"<p>one</p><p>two</p>", " one  two "},
+		{"<a href=\"x>y\">link</a>", "link"},
+		{"<script>if (a < b) {}</script>after", "after"},
+		{"<SCRIPT>x</SCRIPT>y", "y"},
+		{"<!DOCTYPE html>text", " text"},
+		{"unterminated <!-- comment", "unterminated "},
+		{"&lt;b&gt; &eacute;", "<b> é"},
+	}
+
+	for _, tc := range testCases {
+		got := string(stripHTML([]byte(tc.doc)))
+		if got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.doc, tc.want, got)
+		}
+	}
+}
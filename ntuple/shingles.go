@@ -0,0 +1,135 @@
+package ntuple
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// A ShingleReader produces subsequent runs of a predefined number of words from an io.Reader,
+// joined by single spaces:
+//
+//  r := NewShingles(bytes.NewBufferString("The cat sat, on the mat."), 2)
+//
+//  // Each call to r.Next() will return the following shingles
+//  "the cat"
+//  "cat sat"
+//  "sat on"
+//  "on the"
+//  "the mat"
+//
+// Words are separated by white space and normalized to lower case, with leading and trailing
+// punctuation removed. Words that consist only of punctuation or contain control bytes or
+// invalid UTF-8 are dropped.
+type ShingleReader struct {
+	scanner *bufio.Scanner
+	size    int
+	words   [][]byte
+
+	// shouting, if set, is returned for each word in upper case, see MarkShouting
+	shouting []byte
+	pending  int
+}
+
+// NewShingles creates a ShingleReader that produces shingles of size words from in.
+func NewShingles(in io.Reader, size int) *ShingleReader {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, bufSz)
+	scanner.Split(bufio.ScanWords)
+
+	return &ShingleReader{
+		scanner: scanner,
+		size:    size,
+	}
+}
+
+// MarkShouting makes r return token once for each word that has at least two letters, all of
+// them upper case, in addition to the shingles. Normalizing words to lower case would lose that
+// they were shouted, which is a signal of its own. Words in scripts without case are never
+// shouted.
+func (r *ShingleReader) MarkShouting(token []byte) {
+	r.shouting = token
+}
+
+// Next returns the next shingle from r's input reader. Next will return io.EOF when the input
+// reader has been exhausted, and it will return all other errors produced by the underlying
+// reader as they come. Texts with fewer words than the shingle size produce no shingles.
+func (r *ShingleReader) Next() ([]byte, error) {
+	for {
+		if r.pending > 0 {
+			r.pending--
+			return append([]byte(nil), r.shouting...), nil
+		}
+
+		if !r.scanner.Scan() {
+			err := r.scanner.Err()
+			if err != nil {
+				return nil, errors.Wrap(err, "reading from underlying")
+			}
+
+			return nil, io.EOF
+		}
+
+		word := normalizeWord(r.scanner.Bytes())
+		if word == nil {
+			continue
+		}
+
+		if r.shouting != nil && isShouting(r.scanner.Bytes()) {
+			r.pending++
+		}
+
+		if len(r.words) == r.size {
+			r.words = r.words[1:]
+		}
+		r.words = append(r.words, word)
+
+		if len(r.words) == r.size {
+			return bytes.Join(r.words, []byte(" ")), nil
+		}
+	}
+}
+
+// normalizeWord returns a lower case copy of word without leading and trailing punctuation, or
+// nil if nothing remains of it or it contains control bytes or invalid UTF-8.
+func normalizeWord(word []byte) []byte {
+	if !utf8.Valid(word) {
+		return nil
+	}
+
+	for _, b := range word {
+		if b < 0x20 || b == 0x7F {
+			return nil
+		}
+	}
+
+	word = bytes.TrimFunc(word, unicode.IsPunct)
+	if len(word) == 0 {
+		return nil
+	}
+
+	return bytes.ToLower(word)
+}
+
+// isShouting reports whether word has at least two letters and all of them are upper case.
+func isShouting(word []byte) bool {
+	letters := 0
+
+	for _, c := range string(word) {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+
+		if !unicode.IsUpper(c) {
+			return false
+		}
+
+		letters++
+	}
+
+	return letters >= 2
+}
@@ -0,0 +1,83 @@
+package ntuple
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShingleReader_Next(t *testing.T) {
+	testCases := []struct {
+		text   string
+		size   int
+		expect []string
+	}{
+		{"The cat sat, on the mat.", 1, []string{"the", "cat", "sat", "on", "the", "mat"}},
+		{"The cat sat, on the mat.", 2, []string{"the cat", "cat sat", "sat on", "on the", "the mat"}},
+		{"The cat sat, on the mat.", 3, []string{"the cat sat", "cat sat on", "sat on the", "on the mat"}},
+		{"  Grüße\n\t-- aus\r\nBERLIN!!  ", 2, []string{"grüße aus", "aus berlin"}},
+		{"one word", 3, nil},
+		{"", 1, nil},
+		{"bad \xff\xfe bytes", 2, []string{"bad bytes"}},
+	}
+
+	for _, tc := range testCases {
+		r := NewShingles(strings.NewReader(tc.text), tc.size)
+
+		var got []string
+
+		for {
+			shingle, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got = append(got, string(shingle))
+		}
+
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("expected shingles %q of size %d for %q, got %q", tc.expect, tc.size, tc.text, got)
+		}
+	}
+}
+
+func TestShingleReader_MarkShouting(t *testing.T) {
+	testCases := []struct {
+		text   string
+		expect []string
+	}{
+		{"buy CHEAP pills NOW!", []string{"buy cheap", "!", "cheap pills", "pills now", "!"}},
+		{"I am OK, A-1 sale", []string{"i am", "am ok", "!", "ok a-1", "a-1 sale"}},
+		{"Cheap GRÜSSE", []string{"cheap grüsse", "!"}},
+		{"ОЧЕНЬ дёшево 安い", []string{"!", "очень дёшево", "дёшево 安い"}},
+		{"SHOUT", []string{"!"}},
+	}
+
+	for _, tc := range testCases {
+		r := NewShingles(strings.NewReader(tc.text), 2)
+		r.MarkShouting([]byte("!"))
+
+		var got []string
+
+		for {
+			shingle, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got = append(got, string(shingle))
+		}
+
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("expected shingles %q for %q, got %q", tc.expect, tc.text, got)
+		}
+	}
+}
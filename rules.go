@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/classifier"
+)
+
+// A rule forces the verdict for messages with a matching header, regardless of their content.
+type rule struct {
+	spam bool
+
+	// kind is one of "from", "domain" or "header". header holds the name of the header field
+	// for rules of kind "header". value is always lower case.
+	kind   string
+	header string
+	value  string
+
+	// text is the rule as it was written in the rules file, used to explain overrides
+	text string
+}
+
+// matches reports whether the message with the given header matches r.
+func (r rule) matches(h mail.Header) bool {
+	switch r.kind {
+	case "from", "domain":
+		addr, err := mail.ParseAddress(h.Get("From"))
+		if err != nil {
+			return false
+		}
+
+		addr.Address = strings.ToLower(addr.Address)
+
+		if r.kind == "from" {
+			return addr.Address == r.value
+		}
+
+		domain := addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+
+		return domain == r.value || strings.HasSuffix(domain, "."+r.value)
+	case "header":
+		var dec mime.WordDecoder
+
+		value := h.Get(r.header)
+
+		decoded, err := dec.DecodeHeader(value)
+		if err == nil {
+			value = decoded
+		}
+
+		return value != "" && strings.Contains(strings.ToLower(value), r.value)
+	}
+
+	return false
+}
+
+// parseRules reads rules from in. Each line holds one rule, empty lines and lines starting with
+// '#' are ignored. Rules look like this:
+//
+//	ham from alice@example.com
+//	ham domain example.org
+//	spam header Subject cheap meds
+//
+// The first word is the verdict for matching messages. "from" rules match the address in the
+// From header, "domain" rules match the domain of that address and its subdomains, and "header"
+// rules match if the named header contains the rest of the line. All matches are case
+// insensitive.
+func parseRules(in io.Reader) ([]rule, error) {
+	var rules []rule
+
+	scanner := bufio.NewScanner(in)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.Errorf("line %d: expected verdict, kind and value", lineNo)
+		}
+
+		r := rule{
+			kind: fields[1],
+			text: strings.Join(fields, " "),
+		}
+
+		switch fields[0] {
+		case "ham":
+		case "spam":
+			r.spam = true
+		default:
+			return nil, errors.Errorf("line %d: unknown verdict %q, expected 'ham' or 'spam'", lineNo, fields[0])
+		}
+
+		switch r.kind {
+		case "from", "domain":
+			if len(fields) != 3 {
+				return nil, errors.Errorf("line %d: expected a single address or domain", lineNo)
+			}
+
+			r.value = strings.ToLower(fields[2])
+		case "header":
+			if len(fields) < 4 {
+				return nil, errors.Errorf("line %d: expected header name and value", lineNo)
+			}
+
+			r.header = fields[2]
+			r.value = strings.ToLower(strings.Join(fields[3:], " "))
+		default:
+			return nil, errors.Errorf("line %d: unknown kind %q, expected 'from', 'domain' or 'header'", lineNo, r.kind)
+		}
+
+		rules = append(rules, r)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading rules")
+	}
+
+	return rules, nil
+}
+
+// Rules is a list of whitelist and blacklist rules that is consulted before a message is
+// classified. Rules are loaded from a file and can be reloaded while the server is running.
+type Rules struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []rule
+}
+
+// LoadRules loads the rules in the file at path.
+func LoadRules(path string) (*Rules, error) {
+	r := &Rules{path: path}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the rules file again. If it can't be parsed, the old rules are kept.
+func (r *Rules) Reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return errors.Wrap(err, "opening rules")
+	}
+	defer f.Close()
+
+	rules, err := parseRules(f)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", r.path)
+	}
+
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Len returns the number of rules in r.
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.rules)
+}
+
+// Match returns the forced verdict for msg according to the first matching rule, along with a
+// description of that rule. Spam is labeled like the last of bands and ham like the first one.
+// ok is false if no rule matches. A nil *Rules never matches.
+func (r *Rules) Match(msg []byte, bands []classifier.LabelBand) (result classifier.Result, reason string, ok bool) {
+	if r == nil {
+		return classifier.Result{}, "", false
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return classifier.Result{}, "", false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if !rule.matches(m.Header) {
+			continue
+		}
+
+		if rule.spam {
+			return classifier.Result{Label: bands[len(bands)-1].Label, Score: 1, HamScore: 0}, rule.text, true
+		}
+
+		return classifier.Result{Label: bands[0].Label, Score: 0, HamScore: 1}, rule.text, true
+	}
+
+	return classifier.Result{}, "", false
+}
+
+// overrideVerdict formats the verdict header value for a result that was forced by a rule.
+func overrideVerdict(result classifier.Result, reason string) string {
+	return fmt.Sprintf("label=%q, score=%.6f, override=%q", result.Label, result.Score, reason)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mailfilter/classifier"
+)
+
+const rulesFile = `# my own domain
+ham domain example.org
+ham from newsletter@example.com
+
+spam header Subject cheap meds
+`
+
+func TestRules_Match(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(rulesFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := &Rules{rules: rules}
+
+	testCases := []struct {
+		msg    string
+		label  string
+		reason string
+	}{
+		{"From: Newsletter <Newsletter@Example.com>\nSubject: News\n\nbody\n", "ham", "ham from newsletter@example.com"},
+		{"From: other@example.com\nSubject: News\n\nbody\n", "", ""},
+		{"From: alice@mail.example.org\nSubject: Hi\n\nbody\n", "ham", "ham domain example.org"},
+		{"From: alice@notexample.org\nSubject: Hi\n\nbody\n", "", ""},
+		{"From: spammer@example.net\nSubject: Buy CHEAP Meds now\n\nbody\n", "spam", "spam header Subject cheap meds"},
+		{"From: spammer@example.net\nSubject: =?utf-8?q?cheap_meds?=\n\nbody\n", "spam", "spam header Subject cheap meds"},
+		{"From: spammer@example.net\nSubject: Hi\n\ncheap meds\n", "", ""},
+	}
+
+	for _, tc := range testCases {
+		result, reason, ok := r.Match([]byte(tc.msg), classifier.DefaultBands(0.3, 0.7))
+		if ok != (tc.label != "") {
+			t.Errorf("%q: expected match=%v, got %v", tc.msg, tc.label != "", ok)
+			continue
+		}
+
+		if result.Label != tc.label || reason != tc.reason {
+			t.Errorf("%q: expected %q by %q, got %q by %q", tc.msg, tc.label, tc.reason, result.Label, reason)
+		}
+	}
+}
+
+func TestRules_Parse(t *testing.T) {
+	for _, line := range []string{
+		"ham from",
+		"maybe from alice@example.com",
+		"ham sender alice@example.com",
+		"ham from alice@example.com bob@example.com",
+		"spam header Subject",
+	} {
+		_, err := parseRules(strings.NewReader(line))
+		if err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestRules_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailfilter-rules")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules")
+
+	err = ioutil.WriteFile(path, []byte("ham from alice@example.com\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("ham from alice@example.com\nspam from bob@example.com\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = r.Reload()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if r.Len() != 2 {
+		t.Errorf("expected 2 rules after reload, got %d", r.Len())
+	}
+
+	err = ioutil.WriteFile(path, []byte("bogus\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = r.Reload()
+	if err == nil {
+		t.Errorf("expected error for broken rules file")
+	}
+
+	if r.Len() != 2 {
+		t.Errorf("expected old rules to be kept, got %d rules", r.Len())
+	}
+}
+
+func TestSpamFilter_ClassifyOverride(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(rulesFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s := newTestFilter()
+	s.rules = &Rules{rules: rules}
+
+	var out bytes.Buffer
+
+	err = s.classify(strings.NewReader("From: spammer@example.net\nSubject: cheap meds\n\nbody\n"), &out, ClassifyEmail, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header, _ := splitHeader(t, out.String())
+
+	want := `X-Mailfilter: label="spam", score=1.000000, override="spam header Subject cheap meds"`
+	if !strings.Contains(header, want) {
+		t.Errorf("expected header to contain %q, got %q", want, header)
+	}
+}
+
+func TestSpamFilter_ClassifyOverrideCustomLabels(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(rulesFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	bands := []classifier.LabelBand{{Threshold: 0, Label: "clean"}, {Threshold: 0.5, Label: "suspect"}, {Threshold: 0.9, Label: "junk"}}
+
+	s := newTestFilter()
+	s.c = classifier.New(&testDB{}, &testDB{}, &testDB{}, 0.3, 0.7, 6, classifier.WithLabels(bands))
+	s.rules = &Rules{rules: rules}
+	s.headerStyle = HeaderBoth
+
+	testCases := []struct {
+		msg   string
+		label string
+		flag  bool
+	}{
+		{"From: spammer@example.net\nSubject: cheap meds\n\nbody\n", "junk", true},
+		{"From: alice@mail.example.org\nSubject: Hi\n\nbody\n", "clean", false},
+	}
+
+	for _, tc := range testCases {
+		var out bytes.Buffer
+
+		err = s.classify(strings.NewReader(tc.msg), &out, ClassifyEmail, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		header, _ := splitHeader(t, out.String())
+
+		if !strings.Contains(header, `X-Mailfilter: label="`+tc.label+`"`) {
+			t.Errorf("expected label %q in %q", tc.label, header)
+		}
+
+		if strings.Contains(header, "X-Spam-Flag: YES") != tc.flag {
+			t.Errorf("expected spam flag %v in %q", tc.flag, header)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"mailfilter/logger"
+	"mailfilter/mbox"
+)
+
+// trainMaildir trains every message in the cur and new subdirectories of the maildir at dir
+// as spam or ham. Messages that can't be read or trained are logged and skipped. It returns
+// the number of trained and the number of failed messages. Training stops early with an error
+// if ctx is canceled.
+func trainMaildir(ctx context.Context, s *SpamFilter, dir string, spam bool, factor uint64) (trained, failed int, err error) {
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return trained, failed, errors.Wrapf(err, "reading maildir %s", dir)
+		}
+
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return trained, failed, ctx.Err()
+			}
+
+			p := filepath.Join(dir, sub, e.Name())
+
+			err := trainFile(s, p, spam, factor)
+			if err != nil {
+				logger.Errorf("can't train %s: %s", p, err)
+				failed++
+				continue
+			}
+
+			trained++
+		}
+	}
+
+	return trained, failed, nil
+}
+
+// trainFile trains the message stored in the file at p.
+func trainFile(s *SpamFilter, p string, spam bool, factor uint64) error {
+	raw, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	return s.train(raw, spam, factor)
+}
+
+// trainMbox trains every message in the mbox file at p as spam or ham. Messages that can't be
+// trained are logged and skipped. It returns the number of trained and the number of failed
+// messages. Training stops early with an error if ctx is canceled.
+//
+// If progress is not nil, messages whose index it holds are skipped, and the indices of
+// trained messages are added to it.
+func trainMbox(ctx context.Context, s *SpamFilter, p string, spam bool, factor uint64, progress *trainProgress) (trained, failed int, err error) {
+	fh, err := os.Open(p)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "opening mbox")
+	}
+	defer fh.Close()
+
+	skipped := 0
+	defer func() {
+		if skipped > 0 {
+			logger.Infof("skipped %d messages in %s that were trained before", skipped, p)
+		}
+	}()
+
+	r := mbox.NewReader(fh)
+	for i := 0; ; i++ {
+		if ctx.Err() != nil {
+			return trained, failed, ctx.Err()
+		}
+
+		msg, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return trained, failed, nil
+		}
+		if err != nil {
+			return trained, failed, err
+		}
+
+		if progress.has(i) {
+			skipped++
+			continue
+		}
+
+		raw, err := ioutil.ReadAll(msg)
+		if err == nil {
+			err = s.train(raw, spam, factor)
+		}
+		if err != nil {
+			logger.Errorf("can't train message %d in %s: %s", i, p, err)
+			failed++
+			continue
+		}
+
+		progress.add(i)
+		trained++
+	}
+}
+
+// splitMessages splits the body of a training request into the messages it holds. If separator
+// is not empty, messages are separated by lines that consist of it. Otherwise, a body that starts
+// with a "From " line is read as an mbox, and any other body is a single message. Parts that are
+// empty or only hold white space are dropped.
+func splitMessages(raw []byte, separator string) ([][]byte, error) {
+	var msgs [][]byte
+
+	add := func(msg []byte) {
+		if len(bytes.TrimSpace(msg)) > 0 {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	switch {
+	case separator != "":
+		// msg starts at start, pos is the start of the current line
+		start, pos := 0, 0
+
+		for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+			if string(bytes.TrimRight(line, "\r\n")) == separator {
+				add(raw[start:pos])
+				start = pos + len(line)
+			}
+
+			pos += len(line)
+		}
+
+		add(raw[start:])
+	case bytes.HasPrefix(raw, []byte("From ")):
+		r := mbox.NewReader(bytes.NewReader(raw))
+		for {
+			msg, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			text, err := ioutil.ReadAll(msg)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading message")
+			}
+
+			add(text)
+		}
+	default:
+		add(raw)
+	}
+
+	if len(msgs) == 0 {
+		return nil, errors.New("no message to train")
+	}
+
+	return msgs, nil
+}
+
+// trainProgress records the indices of the messages of an mbox that have been trained, so
+// that training can be resumed after it was interrupted. The indices are kept as a sorted list
+// of disjoint ranges that don't touch each other, which stays short since messages are trained
+// in order. The methods of a nil trainProgress do nothing.
+type trainProgress struct {
+	path   string
+	ranges []indexRange
+}
+
+// indexRange holds the indices from first to last, inclusive.
+type indexRange struct {
+	first, last int
+}
+
+// loadTrainProgress reads the progress stored in the file at path, which holds one range per
+// line in the form "first-last". If the file doesn't exist, no message has been trained yet.
+func loadTrainProgress(path string) (*trainProgress, error) {
+	p := &trainProgress{path: path}
+
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening progress")
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var r indexRange
+
+		_, err := fmt.Sscanf(scanner.Text(), "%d-%d", &r.first, &r.last)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing range %q", scanner.Text())
+		}
+
+		for i := r.first; i <= r.last; i++ {
+			p.add(i)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading progress")
+	}
+
+	return p, nil
+}
+
+// has returns whether the message with index i has been trained.
+func (p *trainProgress) has(i int) bool {
+	if p == nil {
+		return false
+	}
+
+	k := sort.Search(len(p.ranges), func(k int) bool {
+		return p.ranges[k].last >= i
+	})
+
+	return k < len(p.ranges) && p.ranges[k].first <= i
+}
+
+// add records that the message with index i has been trained, coalescing it with the ranges
+// next to it.
+func (p *trainProgress) add(i int) {
+	if p == nil {
+		return
+	}
+
+	// The first range that i is in or could extend at its end
+	k := sort.Search(len(p.ranges), func(k int) bool {
+		return p.ranges[k].last >= i-1
+	})
+
+	switch {
+	case k < len(p.ranges) && p.ranges[k].first <= i && i <= p.ranges[k].last:
+		return
+	case k < len(p.ranges) && p.ranges[k].last == i-1:
+		p.ranges[k].last = i
+
+		if k+1 < len(p.ranges) && p.ranges[k+1].first == i+1 {
+			p.ranges[k].last = p.ranges[k+1].last
+			p.ranges = append(p.ranges[:k+1], p.ranges[k+2:]...)
+		}
+	case k < len(p.ranges) && p.ranges[k].first == i+1:
+		p.ranges[k].first = i
+	default:
+		p.ranges = append(p.ranges, indexRange{})
+		copy(p.ranges[k+1:], p.ranges[k:])
+		p.ranges[k] = indexRange{first: i, last: i}
+	}
+}
+
+// save writes p to its file, replacing the previous contents atomically.
+func (p *trainProgress) save() error {
+	if p == nil {
+		return nil
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(p.path), ".progress-*")
+	if err != nil {
+		return errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	w := bufio.NewWriter(fh)
+	for _, r := range p.ranges {
+		fmt.Fprintf(w, "%d-%d\n", r.first, r.last)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return errors.Wrap(err, "writing progress")
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return errors.Wrap(err, "writing progress")
+	}
+
+	return errors.Wrap(os.Rename(fh.Name(), p.path), "renaming temp file")
+}
+
+// csvFormat describes the columns of a CSV file of labeled texts. Columns are counted from 0.
+type csvFormat struct {
+	Comma  rune // field separator, ',' for CSV or '\t' for TSV
+	Header bool // the first row holds column names and is skipped
+
+	LabelColumn int
+	TextColumns []int // joined with newlines, e.g. a subject and a body
+
+	// Rows labeled SpamLabel are trained as spam and rows labeled HamLabel as ham, ignoring
+	// case. Rows with other labels are skipped.
+	SpamLabel, HamLabel string
+}
+
+// csvCounts holds how many rows of a CSV file were trained as spam and ham, skipped because of
+// an unknown label, and failed.
+type csvCounts struct {
+	Spam, Ham, Skipped, Failed int
+}
+
+// parseColumns parses a comma separated list of column numbers.
+func parseColumns(spec string) ([]int, error) {
+	var columns []int
+
+	for _, field := range strings.Split(spec, ",") {
+		column, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || column < 0 {
+			return nil, errors.Errorf("bad column %q", field)
+		}
+
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+// trainCSV trains every row of the CSV file in r as plain text, labeled according to format.
+// Quoted fields may span several lines. Rows that lack a column or can't be trained are logged
+// and counted as failed. Training stops early with an error if ctx is canceled or r isn't
+// valid CSV.
+func trainCSV(ctx context.Context, s *SpamFilter, r io.Reader, format csvFormat, factor uint64) (csvCounts, error) {
+	var counts csvCounts
+
+	cr := csv.NewReader(r)
+	cr.Comma = format.Comma
+	cr.FieldsPerRecord = -1
+
+	if format.Header {
+		_, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return counts, nil
+		}
+		if err != nil {
+			return counts, errors.Wrap(err, "reading header")
+		}
+	}
+
+	for row := 1; ; row++ {
+		if ctx.Err() != nil {
+			return counts, ctx.Err()
+		}
+
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return counts, nil
+		}
+		if err != nil {
+			return counts, err
+		}
+
+		text, label, err := csvRow(record, format)
+		if err != nil {
+			logger.Errorf("can't train row %d: %s", row, err)
+			counts.Failed++
+			continue
+		}
+
+		var spam bool
+
+		switch {
+		case strings.EqualFold(label, format.SpamLabel):
+			spam = true
+		case strings.EqualFold(label, format.HamLabel):
+		default:
+			logger.Debugf("skipping row %d with label %q", row, label)
+			counts.Skipped++
+			continue
+		}
+
+		err = s.modelFor(text, ClassifyPlain).Train(bytes.NewReader(text), spam, factor)
+		if err != nil {
+			logger.Errorf("can't train row %d: %s", row, err)
+			counts.Failed++
+			continue
+		}
+
+		if spam {
+			counts.Spam++
+		} else {
+			counts.Ham++
+		}
+	}
+}
+
+// csvRow returns the text and the label of a CSV record.
+func csvRow(record []string, format csvFormat) (text []byte, label string, err error) {
+	if format.LabelColumn >= len(record) {
+		return nil, "", errors.Errorf("no label column %d in row with %d columns", format.LabelColumn, len(record))
+	}
+
+	var parts []string
+
+	for _, c := range format.TextColumns {
+		if c >= len(record) {
+			return nil, "", errors.Errorf("no text column %d in row with %d columns", c, len(record))
+		}
+
+		parts = append(parts, record[c])
+	}
+
+	return []byte(strings.Join(parts, "\n")), strings.TrimSpace(record[format.LabelColumn]), nil
+}
+
+// trainCSVFile trains the rows of the CSV file at p like trainCSV and logs how many were trained.
+func trainCSVFile(ctx context.Context, s *SpamFilter, p string, format csvFormat, factor uint64) error {
+	fh, err := os.Open(p)
+	if err != nil {
+		return errors.Wrap(err, "opening CSV file")
+	}
+	defer fh.Close()
+
+	start := time.Now()
+
+	counts, err := trainCSV(ctx, s, bufio.NewReader(fh), format, factor)
+	logger.Infof("took %s to train %d rows from %s as spam and %d as ham, skipped %d, %d failed",
+		time.Since(start), counts.Spam, p, counts.Ham, counts.Skipped, counts.Failed)
+
+	return err
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrainMaildir(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		err := os.Mkdir(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	messages := map[string]string{
+		"cur/1:2,S": "Subject: buy coins\n\nbuy coins now\n",
+		"new/2":     "Subject: cheap pills\n\ncheap pills online\n",
+		"tmp/3":     "Subject: incomplete\n\nnot delivered yet\n",
+	}
+
+	for name, msg := range messages {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(msg), 0600)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// Directories can't be trained, but shouldn't stop training the other messages
+	err := os.Mkdir(filepath.Join(dir, "cur", "broken"), 0700)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s := newTestFilter()
+
+	trained, failed, err := trainMaildir(context.Background(), s, dir, true, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if trained != 2 || failed != 1 {
+		t.Errorf("expected 2 trained and 1 failed message, got %d and %d", trained, failed)
+	}
+}
+
+func TestTrainMbox(t *testing.T) {
+	s := newTestFilter()
+
+	trained, failed, err := trainMbox(context.Background(), s, "test-message/spam1.msg", true, 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if trained != 1 || failed != 0 {
+		t.Errorf("expected 1 trained and 0 failed messages, got %d and %d", trained, failed)
+	}
+}
+
+func TestTrainMbox_Resume(t *testing.T) {
+	dir := t.TempDir()
+
+	var mbox strings.Builder
+	for _, subject := range []string{"one", "two", "three", "four"} {
+		mbox.WriteString("From bob@example.com Thu Jan  1 00:00:00 1970\nSubject: " + subject + "\n\ncheap pills\n\n")
+	}
+
+	mboxPath := filepath.Join(dir, "spam.mbox")
+
+	err := ioutil.WriteFile(mboxPath, []byte(mbox.String()), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	progressPath := filepath.Join(dir, "progress")
+
+	// An earlier run trained the second message before it was interrupted
+	err = ioutil.WriteFile(progressPath, []byte("1-1\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	progress, err := loadTrainProgress(progressPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s := newTestFilter()
+
+	trained, failed, err := trainMbox(context.Background(), s, mboxPath, true, 1, progress)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if trained != 3 || failed != 0 {
+		t.Errorf("expected 3 trained and 0 failed messages, got %d and %d", trained, failed)
+	}
+
+	err = progress.save()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	raw, err := ioutil.ReadFile(progressPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if string(raw) != "0-3\n" {
+		t.Errorf("expected coalesced progress, got %q", raw)
+	}
+
+	// Resuming a complete run trains nothing
+	progress, err = loadTrainProgress(progressPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	trained, _, err = trainMbox(context.Background(), s, mboxPath, true, 1, progress)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if trained != 0 {
+		t.Errorf("expected no messages to be trained again, got %d", trained)
+	}
+
+	// Interrupted runs stop before the next message
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	trained, _, err = trainMbox(ctx, s, mboxPath, true, 1, nil)
+	if !errors.Is(err, context.Canceled) || trained != 0 {
+		t.Errorf("expected training to stop right away, got %d trained messages and error %v", trained, err)
+	}
+}
+
+func TestTrainProgress_Add(t *testing.T) {
+	var p trainProgress
+
+	for _, i := range []int{5, 1, 3, 2, 9, 4, 3, 10, 0} {
+		p.add(i)
+	}
+
+	expect := []indexRange{{0, 5}, {9, 10}}
+	if !reflect.DeepEqual(p.ranges, expect) {
+		t.Errorf("expected %v, got %v", expect, p.ranges)
+	}
+
+	for i := 0; i < 12; i++ {
+		want := i <= 5 || i == 9 || i == 10
+		if p.has(i) != want {
+			t.Errorf("expected has(%d) to be %t", i, want)
+		}
+	}
+}
+
+func TestTrainCSV(t *testing.T) {
+	const data = "label,subject,body\n" +
+		"spam,cheap pills,\"buy now,\nbest prices\"\n" +
+		"HAM,lunch,see you tomorrow\n" +
+		"unknown,whatever,not trained\n" +
+		"spam,no body\n"
+
+	s := newTestFilter()
+
+	format := csvFormat{
+		Comma:       ',',
+		Header:      true,
+		LabelColumn: 0,
+		TextColumns: []int{1, 2},
+		SpamLabel:   "spam",
+		HamLabel:    "ham",
+	}
+
+	counts, err := trainCSV(context.Background(), s, strings.NewReader(data), format, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if want := (csvCounts{Spam: 1, Ham: 1, Skipped: 1, Failed: 1}); counts != want {
+		t.Errorf("expected counts %+v, got %+v", want, counts)
+	}
+
+	// The quoted body spans two lines and is trained along with the subject
+	for _, tc := range []struct {
+		word      string
+		spam, ham uint64
+	}{
+		{"cheap ", 1, 0},
+		{"prices", 1, 0},
+		{"tomorr", 0, 1},
+		{"not tr", 0, 0},
+	} {
+		word, err := s.c.LookupWord([]byte(tc.word))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if word.Spam != tc.spam || word.Ham != tc.ham {
+			t.Errorf("expected %q to be trained %d times as spam and %d times as ham, got %s", tc.word, tc.spam, tc.ham, word)
+		}
+	}
+
+	tsv := "ham\tsee you tomorrow\n"
+	format = csvFormat{Comma: '\t', LabelColumn: 0, TextColumns: []int{1}, SpamLabel: "spam", HamLabel: "ham"}
+
+	counts, err = trainCSV(context.Background(), s, strings.NewReader(tsv), format, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if counts.Ham != 1 {
+		t.Errorf("expected a TSV row to be trained as ham, got %+v", counts)
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	columns, err := parseColumns("1, 2")
+	if err != nil || !reflect.DeepEqual(columns, []int{1, 2}) {
+		t.Errorf("expected columns 1 and 2, got %v and error %v", columns, err)
+	}
+
+	for _, spec := range []string{"", "a", "-1", "1,,2"} {
+		if _, err := parseColumns(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	testCases := []struct {
+		raw       string
+		separator string
+		want      []string
+	}{
+		{"Subject: a\n\none\n", "", []string{"Subject: a\n\none\n"}},
+		{
+			"From a@example.com Mon Jan  1 00:00:00 2024\nSubject: a\n\none\n\n" +
+				"From b@example.com Mon Jan  1 00:00:00 2024\nSubject: b\n\n>From here\n",
+			"",
+			[]string{"Subject: a\n\none\n", "Subject: b\n\nFrom here\n"},
+		},
+		{
+			"Subject: a\n\none\n--next--\nSubject: b\r\n\r\ntwo\r\n--next--\r\n\n--next--\n",
+			"--next--",
+			[]string{"Subject: a\n\none\n", "Subject: b\r\n\r\ntwo\r\n"},
+		},
+		{"Subject: a\n\n--next-- isn't a separator\n", "--next--", []string{"Subject: a\n\n--next-- isn't a separator\n"}},
+	}
+
+	for _, tc := range testCases {
+		msgs, err := splitMessages([]byte(tc.raw), tc.separator)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tc.raw, err)
+		}
+
+		var got []string
+		for _, msg := range msgs {
+			got = append(got, string(msg))
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expected %q for %q, got %q", tc.want, tc.raw, got)
+		}
+	}
+
+	for _, raw := range []string{"", " \n", "--next--\n"} {
+		if _, err := splitMessages([]byte(raw), "--next--"); err == nil {
+			t.Errorf("expected an error for %q without messages", raw)
+		}
+	}
+}
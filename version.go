@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// These are set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Builds without them fall back to what the Go toolchain recorded in the binary.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo describes which build of mailfilter is running.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("mailfilter %s (commit %s, built %s with %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
+
+// getBuildInfo returns the version information set with -ldflags. Fields that weren't set are
+// taken from the module information embedded by the Go toolchain, or "unknown" if there is none.
+func getBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+
+	for _, field := range []*string{&info.Version, &info.Commit, &info.BuildDate} {
+		if *field == "" {
+			*field = "unknown"
+		}
+	}
+
+	return info
+}